@@ -0,0 +1,85 @@
+package clientutil
+
+import (
+	"context"
+	"sort"
+
+	"github.com/moby/buildkit/client"
+	"github.com/moby/buildkit/client/llb"
+	"github.com/moby/buildkit/util/testutil/integration"
+	digest "github.com/opencontainers/go-digest"
+)
+
+// CacheReport records which vertices of a solve were cached.
+type CacheReport struct {
+	vertices map[digest.Digest]*client.Vertex
+}
+
+// SolveWithCacheReport solves def, or the frontend of opt if def is nil,
+// with the client of the sandbox and reports which vertices were cached.
+func SolveWithCacheReport(ctx context.Context, sb integration.Sandbox, def *llb.Definition, opt client.SolveOpt) (*CacheReport, error) {
+	c, err := New(ctx, sb)
+	if err != nil {
+		return nil, err
+	}
+	r := &CacheReport{vertices: map[digest.Digest]*client.Vertex{}}
+	ch := make(chan *client.SolveStatus)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for st := range ch {
+			for _, v := range st.Vertexes {
+				prev, ok := r.vertices[v.Digest]
+				if ok && prev.Cached {
+					// a vertex that was cached once stays cached
+					continue
+				}
+				r.vertices[v.Digest] = v
+			}
+		}
+	}()
+	_, err = c.Solve(ctx, def, opt, ch)
+	<-done
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Cached reports whether the vertex with name was cached. If several
+// vertices have the name all of them must be cached. Found is false if no
+// vertex has the name.
+func (r *CacheReport) Cached(name string) (cached, found bool) {
+	for _, v := range r.vertices {
+		if v.Name != name {
+			continue
+		}
+		if !v.Cached {
+			return false, true
+		}
+		found = true
+	}
+	return found, found
+}
+
+// CachedVertices returns the sorted names of the cached vertices.
+func (r *CacheReport) CachedVertices() []string {
+	return r.names(true)
+}
+
+// UncachedVertices returns the sorted names of the vertices that were
+// executed.
+func (r *CacheReport) UncachedVertices() []string {
+	return r.names(false)
+}
+
+func (r *CacheReport) names(cached bool) []string {
+	var out []string
+	for _, v := range r.vertices {
+		if v.Cached == cached {
+			out = append(out, v.Name)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
@@ -0,0 +1,45 @@
+// Package clientutil provides helpers for driving a sandbox from the
+// integration framework through the typed BuildKit client.
+//
+// These helpers can't live in the integration package itself because the
+// client package uses integration for its own tests.
+package clientutil
+
+import (
+	"context"
+	"sync"
+
+	"github.com/moby/buildkit/client"
+	"github.com/moby/buildkit/util/testutil/integration"
+)
+
+var (
+	mu      sync.Mutex
+	clients = map[integration.Sandbox]*client.Client{}
+)
+
+// New returns a client connected to the daemon of the sandbox. The client is
+// created on first use and is shared by all callers for the same sandbox. It
+// is closed by the sandbox cleanup when the test completes and must not be
+// closed by the caller.
+func New(ctx context.Context, sb integration.Sandbox) (*client.Client, error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if c, ok := clients[sb]; ok {
+		return c, nil
+	}
+
+	c, err := client.New(ctx, sb.Address())
+	if err != nil {
+		return nil, err
+	}
+	clients[sb] = c
+	sb.Cleanup(func() error {
+		mu.Lock()
+		delete(clients, sb)
+		mu.Unlock()
+		return c.Close()
+	})
+	return c, nil
+}
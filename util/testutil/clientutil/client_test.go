@@ -0,0 +1,120 @@
+package clientutil
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	controlapi "github.com/moby/buildkit/api/services/control"
+	"github.com/moby/buildkit/util/testutil/integration"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+)
+
+// fakeControl is a control service standing in for the daemon. Solves fail
+// if the frontend attribute "fail" is set and every status stream sends
+// statuses. Prune removes the records that are not in use.
+type fakeControl struct {
+	controlapi.UnimplementedControlServer
+
+	mu       sync.Mutex
+	solves   int
+	statuses []*controlapi.StatusResponse
+	records  []*controlapi.UsageRecord
+	prune    *controlapi.PruneRequest
+}
+
+// Session ends the session right away, the fake never calls back into it.
+func (*fakeControl) Session(controlapi.Control_SessionServer) error {
+	return nil
+}
+
+func (f *fakeControl) Solve(ctx context.Context, req *controlapi.SolveRequest) (*controlapi.SolveResponse, error) {
+	f.mu.Lock()
+	f.solves++
+	f.mu.Unlock()
+	if msg, ok := req.FrontendAttrs["fail"]; ok {
+		return nil, errors.New(msg)
+	}
+	return &controlapi.SolveResponse{ExporterResponse: map[string]string{"ref": req.Ref}}, nil
+}
+
+func (f *fakeControl) Status(req *controlapi.StatusRequest, stream controlapi.Control_StatusServer) error {
+	for _, st := range f.statuses {
+		if err := stream.Send(st); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *fakeControl) DiskUsage(context.Context, *controlapi.DiskUsageRequest) (*controlapi.DiskUsageResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return &controlapi.DiskUsageResponse{Record: f.records}, nil
+}
+
+func (f *fakeControl) Prune(req *controlapi.PruneRequest, stream controlapi.Control_PruneServer) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.prune = req
+	var kept []*controlapi.UsageRecord
+	for _, r := range f.records {
+		if r.InUse {
+			kept = append(kept, r)
+			continue
+		}
+		if err := stream.Send(r); err != nil {
+			return err
+		}
+	}
+	f.records = kept
+	return nil
+}
+
+// fakeSandbox is a sandbox whose daemon is served by fakeControl. Only the
+// methods used by the helpers are implemented.
+type fakeSandbox struct {
+	integration.Sandbox
+
+	address  string
+	cleanups []func() error
+}
+
+func (sb *fakeSandbox) Address() string {
+	return sb.address
+}
+
+func (sb *fakeSandbox) Cleanup(f func() error) {
+	sb.cleanups = append(sb.cleanups, f)
+}
+
+func newFakeSandbox(t *testing.T, ctrl *fakeControl) *fakeSandbox {
+	l, err := net.Listen("unix", filepath.Join(t.TempDir(), "buildkitd.sock"))
+	require.NoError(t, err)
+	srv := grpc.NewServer()
+	controlapi.RegisterControlServer(srv, ctrl)
+	go srv.Serve(l)
+
+	sb := &fakeSandbox{address: "unix://" + l.Addr().String()}
+	t.Cleanup(func() {
+		for i := len(sb.cleanups) - 1; i >= 0; i-- {
+			require.NoError(t, sb.cleanups[i]())
+		}
+		srv.Stop()
+	})
+	return sb
+}
+
+func TestNewShared(t *testing.T) {
+	sb := newFakeSandbox(t, &fakeControl{})
+	c1, err := New(context.TODO(), sb)
+	require.NoError(t, err)
+	c2, err := New(context.TODO(), sb)
+	require.NoError(t, err)
+	require.Same(t, c1, c2)
+	require.Len(t, sb.cleanups, 1)
+}
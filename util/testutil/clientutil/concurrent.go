@@ -0,0 +1,71 @@
+package clientutil
+
+import (
+	"context"
+	"time"
+
+	"github.com/moby/buildkit/client"
+	"github.com/moby/buildkit/client/llb"
+	"github.com/moby/buildkit/util/testutil/integration"
+	"github.com/pkg/errors"
+	"golang.org/x/sync/errgroup"
+)
+
+// SolveRequest is a solve run by RunConcurrentSolves. Def is solved, or the
+// frontend of Opt if Def is nil.
+type SolveRequest struct {
+	Def *llb.Definition
+	Opt client.SolveOpt
+}
+
+// SolveResult is the result of a solve run by RunConcurrentSolves.
+type SolveResult struct {
+	Response *client.SolveResponse
+	// Statuses are the status updates of the solve. Vertexes that were
+	// deduplicated with another solve are reported as cached.
+	Statuses []*client.SolveStatus
+	// Started is when the solve was started and Duration how long it took.
+	Started  time.Time
+	Duration time.Duration
+	Err      error
+}
+
+// RunConcurrentSolves runs n solves in parallel with the client of the
+// sandbox, the request for the i-th solve is returned by build, and waits
+// for all of them to finish. The results are indexed like the solves and are
+// returned even if a solve failed, in which case the error of the first
+// failed solve is returned.
+func RunConcurrentSolves(ctx context.Context, sb integration.Sandbox, n int, build func(i int) SolveRequest) ([]SolveResult, error) {
+	c, err := New(ctx, sb)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]SolveResult, n)
+	var eg errgroup.Group
+	for i := 0; i < n; i++ {
+		i := i
+		req := build(i)
+		eg.Go(func() error {
+			res := &results[i]
+			ch := make(chan *client.SolveStatus)
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				for st := range ch {
+					res.Statuses = append(res.Statuses, st)
+				}
+			}()
+			res.Started = time.Now()
+			res.Response, res.Err = c.Solve(ctx, req.Def, req.Opt, ch)
+			res.Duration = time.Since(res.Started)
+			<-done
+			if res.Err != nil {
+				return errors.Wrapf(res.Err, "solve %d failed", i)
+			}
+			return nil
+		})
+	}
+	// the solves are not cancelled on error so that all of them finish
+	// before the daemon is inspected or stopped
+	return results, eg.Wait()
+}
@@ -0,0 +1,43 @@
+package clientutil
+
+import (
+	"context"
+	"testing"
+
+	controlapi "github.com/moby/buildkit/api/services/control"
+	"github.com/moby/buildkit/client"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunConcurrentSolves(t *testing.T) {
+	ctrl := &fakeControl{statuses: []*controlapi.StatusResponse{{
+		Vertexes: []*controlapi.Vertex{{Digest: "sha256:abc", Name: "foo", Cached: true}},
+	}}}
+	sb := newFakeSandbox(t, ctrl)
+
+	results, err := RunConcurrentSolves(context.TODO(), sb, 3, func(i int) SolveRequest {
+		opt := client.SolveOpt{Frontend: "dockerfile.v0"}
+		if i == 1 {
+			opt.FrontendAttrs = map[string]string{"fail": "failed"}
+		}
+		return SolveRequest{Opt: opt}
+	})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "solve 1 failed")
+	require.Contains(t, err.Error(), "failed to solve")
+	require.Equal(t, 3, ctrl.solves)
+	require.Len(t, results, 3)
+	for i, res := range results {
+		require.False(t, res.Started.IsZero())
+		if i == 1 {
+			require.Error(t, res.Err)
+			require.Nil(t, res.Response)
+			continue
+		}
+		require.NoError(t, res.Err)
+		require.NotNil(t, res.Response)
+		require.NotEmpty(t, res.Response.ExporterResponse["ref"])
+		require.Len(t, res.Statuses, 1)
+		require.True(t, res.Statuses[0].Vertexes[0].Cached)
+	}
+}
@@ -0,0 +1,73 @@
+package clientutil
+
+import (
+	"context"
+
+	"github.com/moby/buildkit/client"
+	"github.com/moby/buildkit/util/testutil/integration"
+)
+
+// PruneResult is the result of Prune.
+type PruneResult struct {
+	// Before and After are the records of the build cache before and after
+	// pruning.
+	Before []*client.UsageInfo
+	After  []*client.UsageInfo
+	// Pruned are the records that were removed.
+	Pruned []*client.UsageInfo
+}
+
+// Freed returns the sum of the sizes of the pruned records.
+func (r PruneResult) Freed() int64 {
+	return totalSize(r.Pruned)
+}
+
+// Size returns the sum of the sizes of the records in the build cache
+// before and after pruning.
+func (r PruneResult) Size() (before, after int64) {
+	return totalSize(r.Before), totalSize(r.After)
+}
+
+func totalSize(records []*client.UsageInfo) int64 {
+	var n int64
+	for _, r := range records {
+		n += r.Size
+	}
+	return n
+}
+
+// Prune prunes the build cache of the sandbox with opts, e.g.
+// client.WithKeepOpt, and returns the records it removed together with the
+// usage of the build cache before and after.
+func Prune(ctx context.Context, sb integration.Sandbox, opts ...client.PruneOption) (PruneResult, error) {
+	c, err := New(ctx, sb)
+	if err != nil {
+		return PruneResult{}, err
+	}
+
+	var res PruneResult
+	if res.Before, err = c.DiskUsage(ctx); err != nil {
+		return PruneResult{}, err
+	}
+
+	ch := make(chan client.UsageInfo)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for r := range ch {
+			r := r
+			res.Pruned = append(res.Pruned, &r)
+		}
+	}()
+	err = c.Prune(ctx, ch, opts...)
+	close(ch)
+	<-done
+	if err != nil {
+		return PruneResult{}, err
+	}
+
+	if res.After, err = c.DiskUsage(ctx); err != nil {
+		return PruneResult{}, err
+	}
+	return res, nil
+}
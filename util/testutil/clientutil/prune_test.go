@@ -0,0 +1,37 @@
+package clientutil
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	controlapi "github.com/moby/buildkit/api/services/control"
+	"github.com/moby/buildkit/client"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrune(t *testing.T) {
+	ctrl := &fakeControl{records: []*controlapi.UsageRecord{
+		{ID: "a", Size_: 10},
+		{ID: "b", Size_: 20},
+		{ID: "c", Size_: 5, InUse: true},
+	}}
+	sb := newFakeSandbox(t, ctrl)
+
+	res, err := Prune(context.TODO(), sb, client.WithKeepOpt(time.Hour, 1000), client.WithFilter([]string{"type==regular"}))
+	require.NoError(t, err)
+	require.Equal(t, int64(time.Hour), ctrl.prune.KeepDuration)
+	require.Equal(t, int64(1000), ctrl.prune.KeepBytes)
+	require.Equal(t, []string{"type==regular"}, ctrl.prune.Filter)
+
+	require.Len(t, res.Before, 3)
+	require.Len(t, res.Pruned, 2)
+	require.Equal(t, "a", res.Pruned[0].ID)
+	require.Equal(t, "b", res.Pruned[1].ID)
+	require.Len(t, res.After, 1)
+	require.Equal(t, "c", res.After[0].ID)
+	require.Equal(t, int64(30), res.Freed())
+	before, after := res.Size()
+	require.Equal(t, int64(35), before)
+	require.Equal(t, int64(5), after)
+}
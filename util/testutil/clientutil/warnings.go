@@ -0,0 +1,89 @@
+package clientutil
+
+import (
+	"context"
+	"net/url"
+	"strings"
+
+	"github.com/moby/buildkit/client"
+	"github.com/moby/buildkit/client/llb"
+	"github.com/moby/buildkit/util/testutil/integration"
+)
+
+// BuildWarning is a warning reported by a frontend during a solve, e.g. for
+// deprecated Dockerfile syntax.
+type BuildWarning struct {
+	// Rule is the name of the rule that triggered the warning as it appears
+	// in the link to its documentation, e.g. "json-args-recommended" for
+	// https://docs.docker.com/go/dockerfile/rule/json-args-recommended/.
+	// It is empty if URL doesn't link to the documentation of a rule.
+	Rule    string
+	Message string
+	Detail  []string
+	URL     string
+	Level   int
+	// File is the name of the source, e.g. the Dockerfile, the warning
+	// refers to. StartLine and EndLine are 1-based and zero if the warning
+	// has no location.
+	File      string
+	StartLine int
+	EndLine   int
+}
+
+// BuildWarnings solves def, or the frontend of opt if def is nil, with the
+// client of the sandbox and returns the warnings of the solve in the order
+// they were reported. The warnings are returned even if the solve failed.
+func BuildWarnings(ctx context.Context, sb integration.Sandbox, def *llb.Definition, opt client.SolveOpt) ([]BuildWarning, error) {
+	c, err := New(ctx, sb)
+	if err != nil {
+		return nil, err
+	}
+	var out []BuildWarning
+	ch := make(chan *client.SolveStatus)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for st := range ch {
+			for _, w := range st.Warnings {
+				out = append(out, newBuildWarning(w))
+			}
+		}
+	}()
+	_, err = c.Solve(ctx, def, opt, ch)
+	<-done
+	return out, err
+}
+
+func newBuildWarning(w *client.VertexWarning) BuildWarning {
+	bw := BuildWarning{
+		Rule:    ruleName(w.URL),
+		Message: string(w.Short),
+		URL:     w.URL,
+		Level:   w.Level,
+	}
+	for _, d := range w.Detail {
+		bw.Detail = append(bw.Detail, string(d))
+	}
+	if w.SourceInfo != nil {
+		bw.File = w.SourceInfo.Filename
+	}
+	if len(w.Range) > 0 {
+		bw.StartLine = int(w.Range[0].Start.Line)
+		bw.EndLine = int(w.Range[len(w.Range)-1].End.Line)
+	}
+	return bw
+}
+
+// ruleName returns the name of the rule documented at u, a link like
+// https://docs.docker.com/go/dockerfile/rule/<rule>/.
+func ruleName(u string) string {
+	pu, err := url.Parse(u)
+	if err != nil {
+		return ""
+	}
+	parts := strings.Split(strings.Trim(pu.Path, "/"), "/")
+	if len(parts) < 2 || parts[len(parts)-2] != "rule" {
+		return ""
+	}
+	return parts[len(parts)-1]
+}
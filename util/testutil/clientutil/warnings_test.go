@@ -0,0 +1,50 @@
+package clientutil
+
+import (
+	"context"
+	"testing"
+
+	controlapi "github.com/moby/buildkit/api/services/control"
+	"github.com/moby/buildkit/client"
+	"github.com/moby/buildkit/solver/pb"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuildWarnings(t *testing.T) {
+	ctrl := &fakeControl{statuses: []*controlapi.StatusResponse{
+		{Warnings: []*controlapi.VertexWarning{{
+			Vertex: "sha256:abc",
+			Level:  1,
+			Short:  []byte("JSON arguments recommended for CMD"),
+			Detail: [][]byte{[]byte("line 3")},
+			Url:    "https://docs.docker.com/go/dockerfile/rule/json-args-recommended/",
+			Info:   &pb.SourceInfo{Filename: "Dockerfile"},
+			Ranges: []*pb.Range{{Start: pb.Position{Line: 3}, End: pb.Position{Line: 4}}},
+		}}},
+		{Warnings: []*controlapi.VertexWarning{{
+			Vertex: "sha256:abc",
+			Short:  []byte("Empty continuation lines will become errors in a future release"),
+			Url:    "https://github.com/moby/moby/pull/33719",
+		}}},
+	}}
+	sb := newFakeSandbox(t, ctrl)
+
+	warnings, err := BuildWarnings(context.TODO(), sb, nil, client.SolveOpt{Frontend: "dockerfile.v0"})
+	require.NoError(t, err)
+	require.Equal(t, []BuildWarning{
+		{
+			Rule:      "json-args-recommended",
+			Message:   "JSON arguments recommended for CMD",
+			Detail:    []string{"line 3"},
+			URL:       "https://docs.docker.com/go/dockerfile/rule/json-args-recommended/",
+			Level:     1,
+			File:      "Dockerfile",
+			StartLine: 3,
+			EndLine:   4,
+		},
+		{
+			Message: "Empty continuation lines will become errors in a future release",
+			URL:     "https://github.com/moby/moby/pull/33719",
+		},
+	}, warnings)
+}
@@ -0,0 +1,159 @@
+package testutil
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/images"
+	"github.com/moby/buildkit/util/contentutil"
+	digest "github.com/opencontainers/go-digest"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// ReadImageTarball reads the images of a tarball written by the oci or
+// docker exporter. Every manifest referenced by the tarball is returned,
+// including the ones of nested indexes.
+func ReadImageTarball(ctx context.Context, dt []byte) ([]*ImageInfo, error) {
+	buf := contentutil.NewBuffer()
+	var index []byte
+	tr := tar.NewReader(bytes.NewReader(dt))
+	for {
+		h, err := tr.Next()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, errors.Wrap(err, "error reading tar")
+		}
+		if h.Typeflag != tar.TypeReg {
+			continue
+		}
+		blob, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error reading %s", h.Name)
+		}
+		if h.Name == "index.json" {
+			index = blob
+			continue
+		}
+		if !strings.HasPrefix(h.Name, "blobs/") {
+			continue
+		}
+		dgst := digest.Digest(path.Base(path.Dir(h.Name)) + ":" + path.Base(h.Name))
+		if err := dgst.Validate(); err != nil {
+			continue
+		}
+		if err := content.WriteBlob(ctx, buf, h.Name, bytes.NewReader(blob), ocispecs.Descriptor{Digest: dgst, Size: int64(len(blob))}); err != nil {
+			return nil, err
+		}
+	}
+	if index == nil {
+		return nil, errors.New("index.json not found in tarball")
+	}
+	var idx ocispecs.Index
+	if err := json.Unmarshal(index, &idx); err != nil {
+		return nil, errors.Wrap(err, "failed to parse index.json")
+	}
+	var out []*ImageInfo
+	for _, m := range idx.Manifests {
+		imgs, err := readManifests(ctx, buf, m)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, imgs...)
+	}
+	return out, nil
+}
+
+// ReadImageRef reads the images of ref from a registry, e.g. one started by
+// the integration sandbox.
+func ReadImageRef(ctx context.Context, ref string) ([]*ImageInfo, error) {
+	desc, provider, err := contentutil.ProviderFromRef(ref)
+	if err != nil {
+		return nil, err
+	}
+	return readManifests(ctx, provider, desc)
+}
+
+func readManifests(ctx context.Context, p content.Provider, desc ocispecs.Descriptor) ([]*ImageInfo, error) {
+	switch desc.MediaType {
+	case images.MediaTypeDockerSchema2ManifestList, ocispecs.MediaTypeImageIndex:
+		dt, err := content.ReadBlob(ctx, p, desc)
+		if err != nil {
+			return nil, err
+		}
+		var idx ocispecs.Index
+		if err := json.Unmarshal(dt, &idx); err != nil {
+			return nil, err
+		}
+		var out []*ImageInfo
+		for _, m := range idx.Manifests {
+			imgs, err := readManifests(ctx, p, m)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, imgs...)
+		}
+		return out, nil
+	case images.MediaTypeDockerSchema2Manifest, ocispecs.MediaTypeImageManifest:
+		img, err := ReadImage(ctx, p, desc)
+		if err != nil {
+			return nil, err
+		}
+		return []*ImageInfo{img}, nil
+	default:
+		// attestations and other artifacts are not images
+		return nil, nil
+	}
+}
+
+// Flatten returns the filesystem of the image with all layers applied in
+// order. Whiteout files remove the entries of lower layers and are not part
+// of the result.
+func (ii *ImageInfo) Flatten() map[string]*TarItem {
+	return flattenLayers(ii.Layers)
+}
+
+func flattenLayers(layers []map[string]*TarItem) map[string]*TarItem {
+	out := map[string]*TarItem{}
+	for _, layer := range layers {
+		var whiteouts, entries []string
+		for name := range layer {
+			if strings.HasPrefix(path.Base(name), ".wh.") {
+				whiteouts = append(whiteouts, name)
+			} else {
+				entries = append(entries, name)
+			}
+		}
+		for _, name := range whiteouts {
+			dir, base := path.Split(name)
+			if base == ".wh..wh..opq" {
+				removeTree(out, dir, false)
+				continue
+			}
+			removeTree(out, dir+strings.TrimPrefix(base, ".wh."), true)
+		}
+		for _, name := range entries {
+			out[name] = layer[name]
+		}
+	}
+	return out
+}
+
+// removeTree deletes the entries below p and p itself if self is set.
+func removeTree(m map[string]*TarItem, p string, self bool) {
+	p = strings.TrimSuffix(p, "/")
+	for name := range m {
+		n := strings.TrimSuffix(name, "/")
+		if (self && n == p) || strings.HasPrefix(n, p+"/") {
+			delete(m, name)
+		}
+	}
+}
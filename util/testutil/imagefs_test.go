@@ -0,0 +1,41 @@
+package testutil
+
+import (
+	"archive/tar"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFlattenLayers(t *testing.T) {
+	item := func(name string, data string) *TarItem {
+		return &TarItem{Header: &tar.Header{Name: name}, Data: []byte(data)}
+	}
+	layers := []map[string]*TarItem{
+		{
+			"etc/":        item("etc/", ""),
+			"etc/a":       item("etc/a", "a"),
+			"etc/b":       item("etc/b", "b"),
+			"opt/":        item("opt/", ""),
+			"opt/x/":      item("opt/x/", ""),
+			"opt/x/file":  item("opt/x/file", "x"),
+			"usr/old":     item("usr/old", "old"),
+			"usr/oldtree": item("usr/oldtree", ""),
+		},
+		{
+			"etc/.wh.a":        item("etc/.wh.a", ""),
+			"etc/b":            item("etc/b", "b2"),
+			"opt/.wh..wh..opq": item("opt/.wh..wh..opq", ""),
+			"opt/y":            item("opt/y", "y"),
+			"usr/.wh.old":      item("usr/.wh.old", ""),
+		},
+	}
+
+	fs := flattenLayers(layers)
+	var names []string
+	for name := range fs {
+		names = append(names, name)
+	}
+	require.ElementsMatch(t, []string{"etc/", "etc/b", "opt/", "opt/y", "usr/oldtree"}, names)
+	require.Equal(t, "b2", string(fs["etc/b"].Data))
+}
@@ -0,0 +1,76 @@
+package integration
+
+import (
+	"os"
+	"testing"
+
+	"github.com/moby/buildkit/util/appcontext"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+// RunBenchmark runs benchmarks against the daemons of all workers. For every
+// worker and matrix combination one sandbox is started and shared by the
+// benchmarks, that are run as sub-benchmarks named like
+// Benchmark/worker=oci/benchBuild. Like any benchmark function the bodies are
+// called several times and must run their operation b.N times. The mirror,
+// sandbox options and requirements are set up with the same TestOpts as Run.
+func RunBenchmark(b *testing.B, benches []func(*testing.B, Sandbox), opt ...TestOpt) {
+	if testing.Short() {
+		b.Skip("skipping in short mode")
+	}
+
+	if os.Getenv("SKIP_INTEGRATION_TESTS") == "1" {
+		b.Skip("skipping integration tests")
+	}
+
+	installLeakCheck(b)
+	tc, mirror := prepareRun(b, opt)
+	matrix := runMatrix(b, tc)
+
+	for _, w := range runWorkers(b) {
+		for _, mv := range matrix {
+			w, mv := w, mv
+			b.Run("worker="+w.Name()+mv.functionSuffix(), func(b *testing.B) {
+				sb, closer, err := newSandboxWithRetry(appcontext.Context(), b, w, mirror, mv, tc.sandboxOpts)
+				if errors.Is(err, ErrRequirements) {
+					skipRequirement(b, w.Name(), err)
+				}
+				require.NoError(b, err)
+				defer func() {
+					if err := closer(); errors.Is(err, errUncleanShutdown) {
+						b.Error(err)
+					}
+				}()
+				if err := checkRequirements(sb, tc.requirements); err != nil {
+					if errors.Is(err, ErrRequirements) {
+						skipRequirement(b, w.Name(), err)
+					}
+					require.NoError(b, err)
+				}
+				s, _ := sb.(*sandbox)
+				defer func() {
+					if b.Failed() && s != nil {
+						s.printLogs(b.Log)
+					}
+				}()
+
+				for _, bench := range benches {
+					bench := bench
+					b.Run(getFunctionName(bench), func(b *testing.B) {
+						if s != nil {
+							// functions registered with Cleanup by the body
+							// run before it is called again with a new b.N
+							defer func() {
+								if err := s.runCleanups(); err != nil {
+									b.Errorf("sandbox cleanup failed: %v", err)
+								}
+							}()
+						}
+						bench(b, sb)
+					})
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package integration
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// BuildContext describes the files of a build context. Paths use forward
+// slashes and are relative to the root of the context. Parent directories
+// are created as needed.
+type BuildContext struct {
+	// Files maps paths to the contents of regular files.
+	Files map[string][]byte
+	// Symlinks maps paths to the targets of symlinks.
+	Symlinks map[string]string
+	// Modes overrides the permissions of files and directories. Files
+	// default to 0644 and directories to 0755.
+	Modes map[string]os.FileMode
+}
+
+type contextEntry struct {
+	name     string
+	typeflag byte
+	mode     os.FileMode
+	data     []byte
+	target   string
+}
+
+// entries returns the entries of the context sorted by path, including the
+// parent directories.
+func (bc BuildContext) entries() ([]contextEntry, error) {
+	m := map[string]contextEntry{}
+	addDirs := func(p string) error {
+		for dir := path.Dir(p); dir != "."; dir = path.Dir(dir) {
+			e, ok := m[dir]
+			if !ok {
+				m[dir] = contextEntry{name: dir, typeflag: tar.TypeDir, mode: 0755}
+			} else if e.typeflag != tar.TypeDir {
+				return errors.Errorf("%q in build context is not a directory", dir)
+			}
+		}
+		return nil
+	}
+	clean := func(p string) (string, error) {
+		c := path.Clean(p)
+		if c == "." || path.IsAbs(c) || c == ".." || strings.HasPrefix(c, "../") {
+			return "", errors.Errorf("invalid path %q in build context", p)
+		}
+		if _, ok := m[c]; ok {
+			return "", errors.Errorf("duplicate path %q in build context", p)
+		}
+		return c, nil
+	}
+	for p, dt := range bc.Files {
+		c, err := clean(p)
+		if err != nil {
+			return nil, err
+		}
+		m[c] = contextEntry{name: c, typeflag: tar.TypeReg, mode: 0644, data: dt}
+	}
+	for p, target := range bc.Symlinks {
+		c, err := clean(p)
+		if err != nil {
+			return nil, err
+		}
+		m[c] = contextEntry{name: c, typeflag: tar.TypeSymlink, mode: 0777, target: target}
+	}
+	paths := make([]string, 0, len(m))
+	for p := range m {
+		paths = append(paths, p)
+	}
+	for _, p := range paths {
+		if err := addDirs(p); err != nil {
+			return nil, err
+		}
+	}
+	for p, mode := range bc.Modes {
+		e, ok := m[path.Clean(p)]
+		if !ok {
+			return nil, errors.Errorf("mode set for unknown path %q in build context", p)
+		}
+		e.mode = mode
+		m[e.name] = e
+	}
+
+	out := make([]contextEntry, 0, len(m))
+	for _, e := range m {
+		out = append(out, e)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].name < out[j].name })
+	return out, nil
+}
+
+// WriteTo creates the files of the context in dir.
+func (bc BuildContext) WriteTo(dir string) error {
+	entries, err := bc.entries()
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		p := filepath.Join(dir, filepath.FromSlash(e.name))
+		switch e.typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(p, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.WriteFile(p, e.data, e.mode); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if err := os.Symlink(e.target, p); err != nil {
+				return err
+			}
+		}
+		// modes are applied explicitly so that they are not affected by
+		// the umask
+		if e.typeflag != tar.TypeSymlink {
+			if err := os.Chmod(p, e.mode); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Dir writes the context to a new directory under the temp directory of
+// the sandbox and returns its path, e.g. for the --local flags of buildctl.
+func (bc BuildContext) Dir(sb Sandbox) (string, error) {
+	dir, err := os.MkdirTemp(sb.TempDir(), "context")
+	if err != nil {
+		return "", err
+	}
+	if err := bc.WriteTo(dir); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// Tar returns the context as a tar archive, e.g. to be sent on the stdin
+// of buildctl. Entries are sorted and have a fixed modification time so
+// that the archive is reproducible.
+func (bc BuildContext) Tar() ([]byte, error) {
+	entries, err := bc.entries()
+	if err != nil {
+		return nil, err
+	}
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	for _, e := range entries {
+		h := &tar.Header{
+			Typeflag: e.typeflag,
+			Name:     e.name,
+			Mode:     int64(e.mode.Perm()),
+			Linkname: e.target,
+			Size:     int64(len(e.data)),
+			ModTime:  time.Unix(0, 0),
+			Format:   tar.FormatPAX,
+		}
+		if e.typeflag == tar.TypeDir {
+			h.Name += "/"
+		}
+		if err := tw.WriteHeader(h); err != nil {
+			return nil, err
+		}
+		if _, err := tw.Write(e.data); err != nil {
+			return nil, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,77 @@
+package integration
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuildContext(t *testing.T) {
+	bc := BuildContext{
+		Files: map[string][]byte{
+			"Dockerfile":     []byte("FROM scratch\nCOPY . /\n"),
+			"sub/dir/run.sh": []byte("#!/bin/sh\n"),
+		},
+		Symlinks: map[string]string{
+			"sub/link": "dir/run.sh",
+		},
+		Modes: map[string]os.FileMode{
+			"sub/dir/run.sh": 0755,
+		},
+	}
+
+	dir := t.TempDir()
+	require.NoError(t, bc.WriteTo(dir))
+	dt, err := os.ReadFile(filepath.Join(dir, "Dockerfile"))
+	require.NoError(t, err)
+	require.Equal(t, "FROM scratch\nCOPY . /\n", string(dt))
+	fi, err := os.Stat(filepath.Join(dir, "sub/dir/run.sh"))
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0755), fi.Mode().Perm())
+	target, err := os.Readlink(filepath.Join(dir, "sub/link"))
+	require.NoError(t, err)
+	require.Equal(t, "dir/run.sh", target)
+
+	dt, err = bc.Tar()
+	require.NoError(t, err)
+	var names []string
+	tr := tar.NewReader(bytes.NewReader(dt))
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		names = append(names, h.Name)
+		if h.Name == "Dockerfile" {
+			require.Equal(t, int64(0644), h.Mode)
+		}
+		if h.Name == "sub/link" {
+			require.Equal(t, byte(tar.TypeSymlink), h.Typeflag)
+			require.Equal(t, "dir/run.sh", h.Linkname)
+		}
+	}
+	require.Equal(t, []string{"Dockerfile", "sub/", "sub/dir/", "sub/dir/run.sh", "sub/link"}, names)
+
+	_, err = BuildContext{Files: map[string][]byte{"../x": nil}}.Tar()
+	require.Error(t, err)
+	_, err = BuildContext{Files: map[string][]byte{"a": nil, "a/b": nil}}.Tar()
+	require.Error(t, err)
+}
+
+func TestWriteContext(t *testing.T) {
+	dir := t.TempDir()
+	var bo buildOpts
+	WithContext(BuildContext{Files: map[string][]byte{"src/main.go": []byte("package main")}})(&bo)
+	require.NoError(t, bo.writeContext(dir, "FROM scratch"))
+	require.FileExists(t, dir+"/src/main.go")
+	require.FileExists(t, dir+"/Dockerfile")
+
+	WithContext(BuildContext{Files: map[string][]byte{"Dockerfile": nil}})(&bo)
+	require.Error(t, bo.writeContext(t.TempDir(), "FROM scratch"))
+}
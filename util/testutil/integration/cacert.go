@@ -0,0 +1,91 @@
+package integration
+
+import (
+	"bytes"
+	"crypto/x509"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// systemCertFiles are the locations of the system CA bundle on common
+// distributions, as searched by crypto/x509.
+var systemCertFiles = []string{
+	"/etc/ssl/certs/ca-certificates.crt",
+	"/etc/pki/tls/certs/ca-bundle.crt",
+	"/etc/ssl/ca-bundle.pem",
+	"/etc/pki/tls/cacert.pem",
+	"/etc/pki/ca-trust/extracted/pem/tls-ca-bundle.pem",
+	"/etc/ssl/cert.pem",
+}
+
+// WithCACert returns a SandboxOpt that makes the daemon trust the PEM encoded
+// CA certificates in pem in addition to the system roots, e.g. to ADD files
+// from an HTTPS test server or to pull from a private registry. The bundle is
+// passed to the daemon with SSL_CERT_FILE, so it applies to HTTP sources and
+// registries alike. The option can be used several times.
+func WithCACert(pem []byte) SandboxOpt {
+	return caCertOpt(pem)
+}
+
+type caCertOpt []byte
+
+func (o caCertOpt) UpdateBackendConfig(cfg *BackendConfig) {
+	cfg.caCerts = append(cfg.caCerts, []byte(o))
+}
+
+// writeCABundle writes the system CA bundle followed by certs to a new
+// directory that is readable by rootless daemons and returns the path of the
+// bundle.
+func writeCABundle(certs [][]byte) (string, func() error, error) {
+	buf := &bytes.Buffer{}
+	if dt, err := systemCABundle(); err != nil {
+		return "", nil, err
+	} else if len(dt) > 0 {
+		buf.Write(dt)
+		buf.WriteString("\n")
+	}
+	for i, pem := range certs {
+		if !x509.NewCertPool().AppendCertsFromPEM(pem) {
+			return "", nil, errors.Errorf("no certificates found in CA %d", i)
+		}
+		buf.Write(pem)
+		buf.WriteString("\n")
+	}
+
+	dir, err := os.MkdirTemp("", "bktest_ca")
+	if err != nil {
+		return "", nil, err
+	}
+	cl := func() error { return os.RemoveAll(dir) }
+	if err := os.Chmod(dir, 0755); err != nil {
+		cl()
+		return "", nil, err
+	}
+	p := filepath.Join(dir, "ca-certificates.crt")
+	if err := os.WriteFile(p, buf.Bytes(), 0644); err != nil {
+		cl()
+		return "", nil, err
+	}
+	return p, cl, nil
+}
+
+// systemCABundle returns the CA bundle the daemon would use without
+// SSL_CERT_FILE being overridden. Nil is returned if there is none.
+func systemCABundle() ([]byte, error) {
+	files := systemCertFiles
+	if f := os.Getenv("SSL_CERT_FILE"); f != "" {
+		files = []string{f}
+	}
+	for _, f := range files {
+		dt, err := os.ReadFile(f)
+		if err == nil {
+			return dt, nil
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,41 @@
+package integration
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteCABundle(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	require.NoError(t, writeRegistryCert(certFile, filepath.Join(dir, "key.pem"), nil))
+	ca, err := os.ReadFile(certFile)
+	require.NoError(t, err)
+
+	system := filepath.Join(dir, "system.pem")
+	require.NoError(t, os.WriteFile(system, []byte("system roots"), 0644))
+	t.Setenv("SSL_CERT_FILE", system)
+
+	cfg := &BackendConfig{}
+	WithCACert(ca).UpdateBackendConfig(cfg)
+	p, cl, err := writeCABundle(cfg.caCerts)
+	require.NoError(t, err)
+	defer cl()
+
+	dt, err := os.ReadFile(p)
+	require.NoError(t, err)
+	require.Equal(t, "system roots\n"+string(ca)+"\n", string(dt))
+	fi, err := os.Stat(filepath.Dir(p))
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0755), fi.Mode().Perm())
+
+	require.NoError(t, cl())
+	_, err = os.Stat(p)
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	_, _, err = writeCABundle([][]byte{[]byte("not a certificate")})
+	require.Error(t, err)
+}
@@ -0,0 +1,90 @@
+package integration
+
+import (
+	"strings"
+
+	"github.com/containerd/containerd/platforms"
+	"github.com/moby/buildkit/worker/label"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Capabilities is the set of features supported by the daemon of a
+// sandbox. Worker labels are reported as "executor=oci",
+// "snapshotter=overlayfs", "network=cni" and "process-mode=sandbox",
+// platforms as "platform=linux/amd64" and allowed insecure entitlements by
+// their name, e.g. "security.insecure". Rootless sandboxes report
+// "rootless".
+type Capabilities map[string]struct{}
+
+// Has reports whether all caps are supported.
+func (c Capabilities) Has(caps ...string) bool {
+	for _, name := range caps {
+		if _, ok := c[name]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// capabilityLabels maps worker labels to capability names.
+var capabilityLabels = map[string]string{
+	label.Executor:       "executor",
+	label.Snapshotter:    "snapshotter",
+	label.Network:        "network",
+	label.OCIProcessMode: "process-mode",
+}
+
+func (sb *sandbox) Capabilities() (Capabilities, error) {
+	// subset of client.WorkerInfo
+	var workers []struct {
+		Labels    map[string]string   `json:"labels"`
+		Platforms []ocispecs.Platform `json:"platforms"`
+	}
+	if err := RunJSON(sb, &workers, "debug", "workers", "--format", "{{json .}}"); err != nil {
+		return nil, err
+	}
+
+	caps := Capabilities{}
+	for _, w := range workers {
+		for k, v := range w.Labels {
+			if name, ok := capabilityLabels[k]; ok {
+				caps[name+"="+v] = struct{}{}
+			}
+		}
+		for _, p := range w.Platforms {
+			caps["platform="+platforms.Format(p)] = struct{}{}
+		}
+	}
+	entitlements, err := sb.insecureEntitlements()
+	if err != nil {
+		return nil, err
+	}
+	for e := range entitlements {
+		caps[e] = struct{}{}
+	}
+	if sb.Rootless() {
+		caps["rootless"] = struct{}{}
+	}
+	return caps, nil
+}
+
+// RequireCapabilities requires the daemon to report all caps, see
+// Capabilities.
+func RequireCapabilities(caps ...string) Requirement {
+	return func(sb Sandbox) error {
+		c, err := sb.Capabilities()
+		if err != nil {
+			return err
+		}
+		var missing []string
+		for _, name := range caps {
+			if !c.Has(name) {
+				missing = append(missing, name)
+			}
+		}
+		if len(missing) > 0 {
+			return RequirementErrorf(SkipMissingCapability, "requires capabilities %s", strings.Join(missing, ", "))
+		}
+		return nil
+	}
+}
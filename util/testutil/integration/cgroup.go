@@ -0,0 +1,162 @@
+package integration
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// CgroupVersion is the cgroup hierarchy used by the containers of builds.
+// runc always uses the hierarchy mounted on the host, it can't be selected
+// for a daemon, so tests that depend on it use RequireCgroupVersion.
+type CgroupVersion string
+
+const (
+	CgroupV1 CgroupVersion = "v1"
+	CgroupV2 CgroupVersion = "v2"
+)
+
+// RequireCgroupVersion requires the host to use the cgroup version v.
+func RequireCgroupVersion(v CgroupVersion) Requirement {
+	return func(Sandbox) error {
+		host, err := HostCgroupVersion()
+		if err != nil {
+			return err
+		}
+		if host != v {
+			return RequirementErrorf(SkipMissingKernelFeature, "host uses cgroup %s instead of %s", host, v)
+		}
+		return nil
+	}
+}
+
+// HostCgroupVersion returns the cgroup version used by the host, and by the
+// containers of builds started by the daemons of the sandboxes.
+func HostCgroupVersion() (CgroupVersion, error) {
+	f, err := os.Open("/proc/self/mounts")
+	if err != nil {
+		return "", RequirementErrorf(SkipMissingKernelFeature, "cgroup version requires /proc/self/mounts: %v", err)
+	}
+	defer f.Close()
+	return parseCgroupVersion(f)
+}
+
+// parseCgroupVersion returns the cgroup version of the hierarchy in the
+// mounts table r. Hosts with cgroup v1 controllers mounted, including the
+// hybrid mode with cgroup v2 at /sys/fs/cgroup/unified, use cgroup v1.
+func parseCgroupVersion(r io.Reader) (CgroupVersion, error) {
+	var v1, v2 bool
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) < 3 {
+			continue
+		}
+		switch fields[2] {
+		case "cgroup":
+			v1 = true
+		case "cgroup2":
+			if fields[1] == "/sys/fs/cgroup" {
+				v2 = true
+			}
+		}
+	}
+	if err := s.Err(); err != nil {
+		return "", err
+	}
+	switch {
+	case v2:
+		return CgroupV2, nil
+	case v1:
+		return CgroupV1, nil
+	}
+	return "", RequirementErrorf(SkipMissingKernelFeature, "no cgroup hierarchy is mounted")
+}
+
+// ResourceLimits are limits of the cgroup the daemon runs in, see
+// WithResourceLimits. Zero values are unlimited.
+type ResourceLimits struct {
+	// Memory is the memory limit in bytes. Swap is disabled if it is set
+	// so that exceeding it triggers the OOM killer.
+	Memory int64
+	// CPUs is the number of CPUs, e.g. 0.5 to throttle the daemon to half
+	// of a CPU.
+	CPUs float64
+}
+
+// cpuPeriod is the period of cpu.max in microseconds.
+const cpuPeriod = 100000
+
+// WithResourceLimits returns a SandboxOpt that starts the daemon in a new
+// cgroup v2 with limits, e.g. to reproduce OOM kills or CPU throttling.
+// Containers started by the oci worker are limited as they are created in
+// the same cgroup, while containers started by containerd are not. Creating
+// the sandbox fails with ErrRequirements for rootless and non-root tests,
+// if cgroup v2 is not available or if the controllers can't be delegated to
+// the new cgroup, and for workers that don't start buildkitd directly.
+func WithResourceLimits(limits ResourceLimits) SandboxOpt {
+	return resourceLimitsOpt(limits)
+}
+
+type resourceLimitsOpt ResourceLimits
+
+func (o resourceLimitsOpt) UpdateBackendConfig(cfg *BackendConfig) {
+	l := ResourceLimits(o)
+	cfg.resourceLimits = &l
+}
+
+// files returns the interface files of the cgroup and their content for
+// the limits.
+func (l ResourceLimits) files() map[string]string {
+	files := map[string]string{}
+	if l.Memory > 0 {
+		files["memory.max"] = strconv.FormatInt(l.Memory, 10)
+		files["memory.swap.max"] = "0"
+	}
+	if l.CPUs > 0 {
+		quota := int64(l.CPUs * cpuPeriod)
+		if quota < 1000 {
+			// minimum allowed by the kernel
+			quota = 1000
+		}
+		files["cpu.max"] = strconv.FormatInt(quota, 10) + " " + strconv.Itoa(cpuPeriod)
+	}
+	return files
+}
+
+// daemonCgroup is a cgroup created for the limits of a sandbox.
+type daemonCgroup struct {
+	// path is the path of the cgroup relative to the root of the cgroup
+	// hierarchy, that is the parent of the cgroups of containers.
+	path string
+	// procs is the cgroup.procs file of the leaf cgroup the daemon is
+	// moved to, as processes can't be in a cgroup with children.
+	procs string
+}
+
+// config returns the daemon configuration that makes the oci worker create
+// the cgroups of containers in cg.
+func (cg *daemonCgroup) config() string {
+	return "[worker.oci]\ndefaultCgroupParent = " + strconv.Quote(cg.path) + "\n"
+}
+
+// cgroupArgs returns args prefixed with a command that moves itself to the
+// cgroup of cfg before running them. args are returned as is if the daemon
+// is not limited.
+func (cfg *BackendConfig) cgroupArgs(args []string) []string {
+	if cfg.cgroup == nil {
+		return args
+	}
+	script := `echo $$ > "$1" && shift && exec "$@"`
+	return append([]string{"sh", "-c", script, "sh", cfg.cgroup.procs}, args...)
+}
+
+// ResourceLimits returns the limits set with WithResourceLimits.
+func (sb *sandbox) ResourceLimits() ResourceLimits {
+	if sb.resourceLimits == nil {
+		return ResourceLimits{}
+	}
+	return *sb.resourceLimits
+}
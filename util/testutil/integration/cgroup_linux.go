@@ -0,0 +1,147 @@
+//go:build linux
+// +build linux
+
+package integration
+
+import (
+	"bufio"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const cgroupRoot = "/sys/fs/cgroup"
+
+// newDaemonCgroup creates a cgroup with limits next to the cgroup of the
+// test process. Its parent needs the memory and cpu controllers, that are
+// enabled if possible.
+func newDaemonCgroup(limits ResourceLimits) (cg *daemonCgroup, cl func() error, err error) {
+	if err := requireRoot(); err != nil {
+		return nil, nil, errors.Wrap(err, "resource limits")
+	}
+	if _, err := os.Stat(filepath.Join(cgroupRoot, "cgroup.controllers")); err != nil {
+		return nil, nil, RequirementErrorf(SkipMissingKernelFeature, "resource limits require cgroup v2")
+	}
+	own, err := ownCgroup()
+	if err != nil {
+		return nil, nil, err
+	}
+	// the cgroup of the test can't have both processes and children with
+	// controllers, so that a sibling is created
+	parent := filepath.Join(cgroupRoot, path.Dir(own))
+	if err := enableControllers(parent); err != nil {
+		return nil, nil, err
+	}
+
+	dir, err := os.MkdirTemp(parent, "bktest-")
+	if err != nil {
+		return nil, nil, RequirementErrorf(SkipMissingKernelFeature, "failed to create cgroup: %v", err)
+	}
+	cl = func() error { return removeCgroup(dir) }
+	defer func() {
+		if err != nil {
+			cl()
+		}
+	}()
+
+	for name, v := range limits.files() {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(v), 0); err != nil {
+			if name == "memory.swap.max" && errors.Is(err, os.ErrNotExist) {
+				// swap accounting is disabled
+				continue
+			}
+			return nil, nil, errors.Wrapf(err, "failed to set %s of cgroup", name)
+		}
+	}
+	if err := enableControllers(dir); err != nil {
+		return nil, nil, err
+	}
+	leaf := filepath.Join(dir, "daemon")
+	if err := os.Mkdir(leaf, 0755); err != nil {
+		return nil, nil, err
+	}
+	return &daemonCgroup{
+		path:  strings.TrimPrefix(dir, cgroupRoot),
+		procs: filepath.Join(leaf, "cgroup.procs"),
+	}, cl, nil
+}
+
+// ownCgroup returns the cgroup v2 path of the test process.
+func ownCgroup() (string, error) {
+	f, err := os.Open("/proc/self/cgroup")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		if p, ok := cutPrefix(s.Text(), "0::"); ok {
+			return p, nil
+		}
+	}
+	if err := s.Err(); err != nil {
+		return "", err
+	}
+	return "", RequirementErrorf(SkipMissingKernelFeature, "test process is not in a cgroup v2")
+}
+
+// enableControllers enables the memory and cpu controllers for the children
+// of the cgroup dir.
+func enableControllers(dir string) error {
+	dt, err := os.ReadFile(filepath.Join(dir, "cgroup.subtree_control"))
+	if err != nil {
+		return err
+	}
+	enabled := strings.Fields(string(dt))
+	var missing []string
+	for _, c := range []string{"memory", "cpu"} {
+		if !contains(enabled, c) {
+			missing = append(missing, "+"+c)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	if err := os.WriteFile(filepath.Join(dir, "cgroup.subtree_control"), []byte(strings.Join(missing, " ")), 0); err != nil {
+		return RequirementErrorf(SkipMissingKernelFeature, "cgroup controllers can't be delegated from %s: %v", dir, err)
+	}
+	return nil
+}
+
+// removeCgroup removes dir and the cgroups below it, e.g. of containers,
+// waiting for processes that are still exiting.
+func removeCgroup(dir string) error {
+	var dirs []string
+	if err := filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			dirs = append(dirs, p)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	// children first
+	sort.Sort(sort.Reverse(sort.StringSlice(dirs)))
+	for _, d := range dirs {
+		var err error
+		for i := 0; i < 50; i++ {
+			if err = os.Remove(d); err == nil || errors.Is(err, os.ErrNotExist) {
+				err = nil
+				break
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		if err != nil {
+			return errors.Wrapf(err, "failed to remove cgroup %s", d)
+		}
+	}
+	return nil
+}
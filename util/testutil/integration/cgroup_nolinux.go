@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package integration
+
+import (
+	"runtime"
+)
+
+func newDaemonCgroup(limits ResourceLimits) (*daemonCgroup, func() error, error) {
+	return nil, nil, RequirementErrorf(SkipUnsupportedPlatform, "resource limits are not supported on %s", runtime.GOOS)
+}
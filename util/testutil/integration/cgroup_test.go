@@ -0,0 +1,75 @@
+package integration
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResourceLimitsFiles(t *testing.T) {
+	require.Empty(t, ResourceLimits{}.files())
+	require.Equal(t, map[string]string{
+		"memory.max":      "67108864",
+		"memory.swap.max": "0",
+		"cpu.max":         "50000 100000",
+	}, ResourceLimits{Memory: 64 << 20, CPUs: 0.5}.files())
+	require.Equal(t, map[string]string{"cpu.max": "1000 100000"}, ResourceLimits{CPUs: 0.001}.files())
+}
+
+func TestCgroupArgs(t *testing.T) {
+	cfg := &BackendConfig{}
+	require.Equal(t, []string{"buildkitd"}, cfg.cgroupArgs([]string{"buildkitd"}))
+
+	cfg.cgroup = &daemonCgroup{path: "/user.slice/bktest-1", procs: "/sys/fs/cgroup/user.slice/bktest-1/daemon/cgroup.procs"}
+	require.Equal(t, []string{"sh", "-c", `echo $$ > "$1" && shift && exec "$@"`, "sh", cfg.cgroup.procs, "buildkitd", "--debug"}, cfg.cgroupArgs([]string{"buildkitd", "--debug"}))
+	require.Equal(t, "[worker.oci]\ndefaultCgroupParent = \"/user.slice/bktest-1\"\n", cfg.cgroup.config())
+}
+
+func TestRequireCgroupVersion(t *testing.T) {
+	host, err := HostCgroupVersion()
+	if errors.Is(err, ErrRequirements) {
+		t.Skip(err.Error())
+	}
+	require.NoError(t, err)
+	require.NoError(t, RequireCgroupVersion(host)(nil))
+
+	other := CgroupV1
+	if host == CgroupV1 {
+		other = CgroupV2
+	}
+	require.ErrorIs(t, RequireCgroupVersion(other)(nil), ErrRequirements)
+}
+
+func TestParseCgroupVersion(t *testing.T) {
+	for name, tc := range map[string]struct {
+		mounts string
+		exp    CgroupVersion
+	}{
+		"v2": {
+			mounts: "cgroup2 /sys/fs/cgroup cgroup2 rw,nosuid,nodev,noexec,relatime 0 0\n",
+			exp:    CgroupV2,
+		},
+		"v1": {
+			mounts: "tmpfs /sys/fs/cgroup tmpfs ro,nosuid,nodev,noexec,mode=755 0 0\n" +
+				"cgroup /sys/fs/cgroup/memory cgroup rw,nosuid,nodev,noexec,relatime,memory 0 0\n",
+			exp: CgroupV1,
+		},
+		"hybrid": {
+			mounts: "tmpfs /sys/fs/cgroup tmpfs ro,nosuid,nodev,noexec,mode=755 0 0\n" +
+				"cgroup2 /sys/fs/cgroup/unified cgroup2 rw,nosuid,nodev,noexec,relatime 0 0\n" +
+				"cgroup /sys/fs/cgroup/memory cgroup rw,nosuid,nodev,noexec,relatime,memory 0 0\n",
+			exp: CgroupV1,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			v, err := parseCgroupVersion(strings.NewReader(tc.mounts))
+			require.NoError(t, err)
+			require.Equal(t, tc.exp, v)
+		})
+	}
+
+	_, err := parseCgroupVersion(strings.NewReader("proc /proc proc rw 0 0\n"))
+	require.ErrorIs(t, err, ErrRequirements)
+}
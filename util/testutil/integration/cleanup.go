@@ -0,0 +1,104 @@
+package integration
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"sync"
+	"syscall"
+)
+
+// cleanupRegistry holds cleanup functions that are still pending so they can
+// be run if the process is interrupted.
+type cleanupRegistry struct {
+	mu   sync.Mutex
+	next int
+	fns  map[int]func() error
+}
+
+func newCleanupRegistry() *cleanupRegistry {
+	return &cleanupRegistry{fns: map[int]func() error{}}
+}
+
+// pendingCleanups holds the cleanup functions of the mirror and the sandboxes
+// that are still alive.
+var pendingCleanups = newCleanupRegistry()
+
+// track records fn to be run by run. The returned function removes fn again
+// and reports whether it was still pending, so fn is never run by both the
+// caller and run.
+func (r *cleanupRegistry) track(fn func() error) (untrack func() bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	id := r.next
+	r.next++
+	r.fns[id] = fn
+	return func() bool {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		_, ok := r.fns[id]
+		delete(r.fns, id)
+		return ok
+	}
+}
+
+// closer wraps cl so that it is run by run if it has not been called before.
+func (r *cleanupRegistry) closer(cl func() error) func() error {
+	untrack := r.track(cl)
+	return func() error {
+		if !untrack() {
+			return nil
+		}
+		return cl()
+	}
+}
+
+// run runs all pending cleanups, newest first.
+func (r *cleanupRegistry) run() {
+	r.mu.Lock()
+	ids := make([]int, 0, len(r.fns))
+	for id := range r.fns {
+		ids = append(ids, id)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(ids)))
+	fns := make([]func() error, 0, len(ids))
+	for _, id := range ids {
+		fns = append(fns, r.fns[id])
+		delete(r.fns, id)
+	}
+	r.mu.Unlock()
+
+	for _, fn := range fns {
+		if err := fn(); err != nil {
+			fmt.Fprintf(os.Stderr, "cleanup failed: %v\n", err)
+		}
+	}
+}
+
+// trackedCloser wraps cl so that it is run on SIGINT or SIGTERM if it has not
+// been called before.
+func trackedCloser(cl func() error) func() error {
+	return pendingCleanups.closer(cl)
+}
+
+var signalHandlerOnce sync.Once
+
+// installSignalHandler makes the process run the pending cleanups and exit
+// when it receives SIGINT or SIGTERM. A second signal exits right away.
+func installSignalHandler() {
+	signalHandlerOnce.Do(func() {
+		ch := make(chan os.Signal, 2)
+		signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			sig := <-ch
+			fmt.Fprintf(os.Stderr, "received %v, cleaning up sandboxes\n", sig)
+			go func() {
+				<-ch
+				os.Exit(1)
+			}()
+			pendingCleanups.run()
+			os.Exit(1)
+		}()
+	})
+}
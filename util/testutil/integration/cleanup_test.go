@@ -0,0 +1,59 @@
+package integration
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPendingCleanups(t *testing.T) {
+	r := newCleanupRegistry()
+	var calls []string
+	first := r.closer(func() error { calls = append(calls, "first"); return nil })
+	r.closer(func() error { calls = append(calls, "second"); return nil })
+	closed := r.closer(func() error { calls = append(calls, "closed"); return nil })
+
+	require.NoError(t, closed())
+	r.run()
+	require.Equal(t, []string{"closed", "second", "first"}, calls)
+
+	// already run by the signal path
+	require.NoError(t, first())
+	require.Len(t, calls, 3)
+}
+
+func TestPendingCleanupsDuringStart(t *testing.T) {
+	// the signal path runs the closers of a sandbox that is still appending
+	// to them
+	r := newCleanupRegistry()
+	mc := &multiCloser{}
+	cl := r.closer(mc.F())
+
+	var mu sync.Mutex
+	runs := map[int]int{}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			i := i
+			mc.append(func() error {
+				mu.Lock()
+				runs[i]++
+				mu.Unlock()
+				return nil
+			})
+		}
+	}()
+	r.run()
+	wg.Wait()
+
+	require.NoError(t, cl())
+	// closers appended after the signal are left to the caller
+	require.NoError(t, mc.F()())
+	require.Len(t, runs, 100)
+	for i, n := range runs {
+		require.Equal(t, 1, n, "closer %d", i)
+	}
+}
@@ -0,0 +1,83 @@
+package integration
+
+import (
+	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/moby/buildkit/util/compression"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// Compression is the compression of the layers of exported images. The
+// values can be used in a matrix dimension, see CompressionMatrix, to run an
+// export test for all layer formats. Sandboxes for workers that can't export
+// a format are skipped.
+type Compression string
+
+const (
+	CompressionUncompressed Compression = "uncompressed"
+	CompressionGzip         Compression = "gzip"
+	CompressionZstd         Compression = "zstd"
+	CompressionEStargz      Compression = "estargz"
+)
+
+// CompressionMatrix returns a matrix dimension over all compressions, e.g.
+// for WithMatrix("compression", CompressionMatrix()).
+func CompressionMatrix() map[string]interface{} {
+	m := map[string]interface{}{}
+	for _, c := range []Compression{CompressionUncompressed, CompressionGzip, CompressionZstd, CompressionEStargz} {
+		m[string(c)] = c
+	}
+	return m
+}
+
+func (c Compression) UpdateBackendConfig(cfg *BackendConfig) {
+	cfg.Compression = string(c)
+}
+
+// CompressionOf returns the compression selected through the matrix of sb,
+// or CompressionGzip, the default of the exporters.
+func CompressionOf(sb Sandbox) Compression {
+	for _, v := range sb.Values() {
+		if c, ok := v.(Compression); ok {
+			return c
+		}
+	}
+	return CompressionGzip
+}
+
+// ExportAttrs returns the attributes of the image exporters that make them
+// compress all layers with c, e.g. to append to a --output flag.
+func (c Compression) ExportAttrs() string {
+	attrs := "compression=" + string(c) + ",force-compression=true"
+	if c == CompressionZstd || c == CompressionEStargz {
+		attrs += ",oci-mediatypes=true"
+	}
+	return attrs
+}
+
+// LayerMediaType returns the OCI media type of layers exported with c.
+// Layers in estargz format have the gzip media type.
+func (c Compression) LayerMediaType() string {
+	return compression.Parse(string(c)).DefaultMediaType()
+}
+
+// CheckLayers returns an error if a layer of mfst was not exported with c.
+func (c Compression) CheckLayers(mfst ocispecs.Manifest) error {
+	ct := compression.Parse(string(c))
+	if ct == compression.UnknownCompression {
+		return errors.Errorf("unknown compression %s", c)
+	}
+	for i, l := range mfst.Layers {
+		if !ct.IsMediaType(l.MediaType) {
+			return errors.Errorf("layer %d has media type %s, expected %s", i, l.MediaType, c.LayerMediaType())
+		}
+		_, toc := l.Annotations[estargz.TOCJSONDigestAnnotation]
+		if c == CompressionEStargz && !toc {
+			return errors.Errorf("layer %d is not in estargz format", i)
+		}
+		if c != CompressionEStargz && toc {
+			return errors.Errorf("layer %d is in estargz format, expected %s", i, c)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,36 @@
+package integration
+
+import (
+	"testing"
+
+	"github.com/containerd/stargz-snapshotter/estargz"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompressionCheckLayers(t *testing.T) {
+	gzipLayer := ocispecs.Descriptor{MediaType: ocispecs.MediaTypeImageLayerGzip}
+	zstdLayer := ocispecs.Descriptor{MediaType: ocispecs.MediaTypeImageLayerZstd}
+	estargzLayer := ocispecs.Descriptor{
+		MediaType:   ocispecs.MediaTypeImageLayerGzip,
+		Annotations: map[string]string{estargz.TOCJSONDigestAnnotation: "sha256:abc"},
+	}
+
+	require.NoError(t, CompressionGzip.CheckLayers(ocispecs.Manifest{Layers: []ocispecs.Descriptor{gzipLayer, gzipLayer}}))
+	require.NoError(t, CompressionZstd.CheckLayers(ocispecs.Manifest{Layers: []ocispecs.Descriptor{zstdLayer}}))
+	require.NoError(t, CompressionEStargz.CheckLayers(ocispecs.Manifest{Layers: []ocispecs.Descriptor{estargzLayer}}))
+
+	err := CompressionGzip.CheckLayers(ocispecs.Manifest{Layers: []ocispecs.Descriptor{gzipLayer, zstdLayer}})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "layer 1 has media type")
+
+	require.Error(t, CompressionEStargz.CheckLayers(ocispecs.Manifest{Layers: []ocispecs.Descriptor{gzipLayer}}))
+	require.Error(t, CompressionGzip.CheckLayers(ocispecs.Manifest{Layers: []ocispecs.Descriptor{estargzLayer}}))
+	require.Error(t, Compression("lz4").CheckLayers(ocispecs.Manifest{}))
+}
+
+func TestCompressionExportAttrs(t *testing.T) {
+	require.Equal(t, "compression=gzip,force-compression=true", CompressionGzip.ExportAttrs())
+	require.Equal(t, "compression=zstd,force-compression=true,oci-mediatypes=true", CompressionZstd.ExportAttrs())
+	require.Len(t, CompressionMatrix(), 4)
+}
@@ -17,6 +17,8 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
+// InitContainerdWorker registers the workers that run buildkitd with the
+// containerd worker backend on top of a throwaway containerd instance.
 func InitContainerdWorker() {
 	Register(&containerd{
 		name:       "containerd",
@@ -88,12 +90,15 @@ func (c *containerd) New(ctx context.Context, cfg *BackendConfig) (b Backend, cl
 	if err := lookupBinary(c.containerd); err != nil {
 		return nil, nil, err
 	}
-	if err := lookupBinary("buildkitd"); err != nil {
+	if err := lookupBinary(cfg.buildkitdBinary()); err != nil {
 		return nil, nil, err
 	}
 	if err := requireRoot(); err != nil {
 		return nil, nil, err
 	}
+	if cfg.Rootless && c.uid == 0 {
+		return nil, nil, RequirementErrorf(SkipUnsupportedWorker, "%s worker can't switch to rootless mode", c.name)
+	}
 
 	deferF := &multiCloser{}
 	cl = deferF.F()
@@ -112,8 +117,22 @@ func (c *containerd) New(ctx context.Context, cfg *BackendConfig) (b Backend, cl
 		}
 		rootless = true
 	}
+	net, err := rootlessNet(cfg, rootless)
+	if err != nil {
+		return nil, nil, err
+	}
+	snapshotter, err := selectSnapshotter(cfg, c.snapshotter)
+	if err != nil {
+		return nil, nil, err
+	}
+	if snapshotter == "fuse-overlayfs" {
+		return nil, nil, RequirementErrorf(SkipUnsupportedWorker, "%s worker does not support %s snapshotter", c.name, snapshotter)
+	}
+	if net == "" {
+		net = "host"
+	}
 
-	tmpdir, err := os.MkdirTemp("", "bktest_containerd")
+	tmpdir, err := newDataDir("bktest_containerd")
 	if err != nil {
 		return nil, nil, err
 	}
@@ -125,6 +144,11 @@ func (c *containerd) New(ctx context.Context, cfg *BackendConfig) (b Backend, cl
 
 	deferF.append(func() error { return os.RemoveAll(tmpdir) })
 
+	root, err := cfg.dataRoot(filepath.Join(tmpdir, "root"), "containerd", c.uid, c.gid)
+	if err != nil {
+		return nil, nil, err
+	}
+
 	address := filepath.Join(tmpdir, "containerd.sock")
 	config := fmt.Sprintf(`root = %q
 state = %q
@@ -138,13 +162,13 @@ disabled_plugins = ["cri"]
 [debug]
   level = "debug"
   address = %q
-`, filepath.Join(tmpdir, "root"), filepath.Join(tmpdir, "state"), address, filepath.Join(tmpdir, "debug.sock"))
+`, root, filepath.Join(tmpdir, "state"), address, filepath.Join(tmpdir, "debug.sock"))
 
 	var snBuildkitdArgs []string
-	if c.snapshotter != "" {
+	if snapshotter != "" {
 		snBuildkitdArgs = append(snBuildkitdArgs,
-			fmt.Sprintf("--containerd-worker-snapshotter=%s", c.snapshotter))
-		if c.snapshotter == "stargz" {
+			fmt.Sprintf("--containerd-worker-snapshotter=%s", snapshotter))
+		if snapshotter == "stargz" {
 			snPath, snCl, err := runStargzSnapshotter(cfg)
 			if err != nil {
 				return nil, nil, err
@@ -172,7 +196,7 @@ disabled_plugins = ["cri"]
 			fmt.Sprintf("CONTAINERD_ROOTLESS_ROOTLESSKIT_STATE_DIR=%s", rootlessKitState),
 			// Integration test requires the access to localhost of the host network namespace.
 			// TODO: remove these configurations
-			"CONTAINERD_ROOTLESS_ROOTLESSKIT_NET=host",
+			"CONTAINERD_ROOTLESS_ROOTLESSKIT_NET=" + net,
 			"CONTAINERD_ROOTLESS_ROOTLESSKIT_PORT_DRIVER=none",
 			"CONTAINERD_ROOTLESS_ROOTLESSKIT_FLAGS=--mtu=0",
 		}, c.extraEnv...), "containerd-rootless.sh", "-c", configFile)
@@ -180,6 +204,7 @@ disabled_plugins = ["cri"]
 
 	cmd := exec.Command(containerdArgs[0], containerdArgs[1:]...)
 	cmd.Env = append(os.Environ(), c.extraEnv...)
+	streamLogs(cmd, cfg)
 
 	ctdStop, err := startCmd(cmd, cfg.Logs)
 	if err != nil {
@@ -191,7 +216,7 @@ disabled_plugins = ["cri"]
 	}
 	deferF.append(ctdStop)
 
-	buildkitdArgs := append([]string{"buildkitd",
+	buildkitdArgs := append([]string{cfg.buildkitdBinary(),
 		"--oci-worker=false",
 		"--containerd-worker-gc=false",
 		"--containerd-worker=true",
@@ -199,7 +224,7 @@ disabled_plugins = ["cri"]
 		"--containerd-worker-labels=org.mobyproject.buildkit.worker.sandbox=true", // Include use of --containerd-worker-labels to trigger https://github.com/moby/buildkit/pull/603
 	}, snBuildkitdArgs...)
 
-	if runtime.GOOS != "windows" && c.snapshotter != "native" {
+	if runtime.GOOS != "windows" && snapshotter != "native" {
 		c.extraEnv = append(c.extraEnv, "BUILDKIT_DEBUG_FORCE_OVERLAY_DIFF=true")
 	}
 	if rootless {
@@ -215,7 +240,7 @@ disabled_plugins = ["cri"]
 			"nsenter", "-U", "--preserve-credentials", "-m", "-t", fmt.Sprintf("%d", pid)},
 			append(buildkitdArgs, "--containerd-worker-snapshotter=native")...)
 	}
-	buildkitdSock, stop, err := runBuildkitd(ctx, cfg, buildkitdArgs, cfg.Logs, c.uid, c.gid, c.extraEnv)
+	buildkitdSock, daemon, stop, err := runBuildkitd(ctx, cfg, buildkitdArgs, cfg.Logs, c.uid, c.gid, c.extraEnv)
 	if err != nil {
 		printLogs(cfg.Logs, log.Println)
 		return nil, nil, err
@@ -226,16 +251,15 @@ disabled_plugins = ["cri"]
 		address:           buildkitdSock,
 		containerdAddress: address,
 		rootless:          rootless,
-		snapshotter:       c.snapshotter,
+		snapshotter:       snapshotter,
+		daemon:            daemon,
 	}, cl, nil
 }
 
 func formatLogs(m map[string]*bytes.Buffer) string {
 	var ss []string
-	for k, b := range m {
-		if b != nil {
-			ss = append(ss, fmt.Sprintf("%q:%q", k, b.String()))
-		}
+	for k, dt := range copyLogs(m) {
+		ss = append(ss, fmt.Sprintf("%q:%q", k, dt))
 	}
 	return strings.Join(ss, ",")
 }
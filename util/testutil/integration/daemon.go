@@ -0,0 +1,84 @@
+package integration
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// daemonProcess is the daemon of a backend. Daemons with a start function
+// can be restarted with the same arguments and state directory.
+type daemonProcess struct {
+	start func() (*exec.Cmd, func() error, error)
+	logs  map[string]*bytes.Buffer
+
+	mu       sync.Mutex
+	cmd      *exec.Cmd
+	stop     func() error
+	restarts int
+}
+
+// startDaemon starts a restartable daemon with start.
+func startDaemon(logs map[string]*bytes.Buffer, start func() (*exec.Cmd, func() error, error)) (*daemonProcess, error) {
+	cmd, stop, err := start()
+	if err != nil {
+		return nil, err
+	}
+	return &daemonProcess{start: start, logs: logs, cmd: cmd, stop: stop}, nil
+}
+
+func (p *daemonProcess) process() *exec.Cmd {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.cmd
+}
+
+// Stop stops the daemon if it is running.
+func (p *daemonProcess) Stop() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.stop == nil {
+		return nil
+	}
+	stop := p.stop
+	p.stop = nil
+	return stop()
+}
+
+// Restart stops the daemon, waits for it to exit and starts it again. The
+// logs of the previous process are kept under a new name.
+func (p *daemonProcess) Restart() error {
+	if p.start == nil {
+		return RequirementErrorf(SkipUnsupportedWorker, "daemon can't be restarted")
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.stop != nil {
+		stop := p.stop
+		p.stop = nil
+		if err := stop(); err != nil {
+			return errors.Wrap(err, "failed to stop daemon")
+		}
+	}
+
+	p.restarts++
+	logsMu.Lock()
+	for _, stream := range []string{"stdout", "stderr"} {
+		k := stream + ": " + p.cmd.Path
+		if b, ok := p.logs[k]; ok {
+			p.logs[fmt.Sprintf("%s (before restart %d)", k, p.restarts)] = b
+			delete(p.logs, k)
+		}
+	}
+	logsMu.Unlock()
+
+	cmd, stop, err := p.start()
+	if err != nil {
+		return errors.Wrap(err, "failed to start daemon")
+	}
+	p.cmd, p.stop = cmd, stop
+	return nil
+}
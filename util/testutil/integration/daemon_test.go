@@ -0,0 +1,89 @@
+package integration
+
+import (
+	"bytes"
+	"os/exec"
+	"runtime"
+	"sync"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDaemonProcessRestart(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("requires sleep binary")
+	}
+	logs := map[string]*bytes.Buffer{}
+	var started int
+	p, err := startDaemon(logs, func() (*exec.Cmd, func() error, error) {
+		cmd := exec.Command("sleep", "30")
+		stop, err := startCmdWithOpts(cmd, logs, stopOpts{})
+		if err != nil {
+			return nil, nil, err
+		}
+		started++
+		return cmd, stop, nil
+	})
+	require.NoError(t, err)
+	defer p.Stop()
+
+	first := p.process().Process.Pid
+	require.NoError(t, p.Restart())
+	require.Equal(t, 2, started)
+	require.NotEqual(t, first, p.process().Process.Pid)
+	require.Contains(t, logs, "stderr: "+p.process().Path)
+	require.Contains(t, logs, "stderr: "+p.process().Path+" (before restart 1)")
+
+	require.NoError(t, p.Stop())
+	require.NoError(t, p.Stop())
+
+	err = (&daemonProcess{cmd: exec.Command("sleep")}).Restart()
+	require.True(t, errors.Is(err, ErrRequirements))
+}
+
+func TestDaemonProcessRestartLogs(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("requires sh binary")
+	}
+	logs := map[string]*bytes.Buffer{}
+	p, err := startDaemon(logs, func() (*exec.Cmd, func() error, error) {
+		cmd := exec.Command("sh", "-c", "while :; do echo running; sleep 0.01; done")
+		stop, err := startCmdWithOpts(cmd, logs, stopOpts{})
+		if err != nil {
+			return nil, nil, err
+		}
+		return cmd, stop, nil
+	})
+	require.NoError(t, err)
+	defer p.Stop()
+	sb := newTestSandbox(t)
+	sb.logs = logs
+
+	// the logs are read while the daemon is restarted, run with -race
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			sb.Logs()
+			printLogs(logs, func(...interface{}) {})
+		}
+	}()
+	for i := 0; i < 3; i++ {
+		require.NoError(t, p.Restart())
+	}
+	close(done)
+	wg.Wait()
+
+	l := sb.Logs()
+	require.Contains(t, l.Stderr, p.process().Path)
+	require.Contains(t, l.Stderr, p.process().Path+" (before restart 3)")
+}
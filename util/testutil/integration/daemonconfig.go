@@ -0,0 +1,114 @@
+package integration
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pelletier/go-toml"
+	"github.com/pkg/errors"
+)
+
+// WithDaemonConfig returns a SandboxOpt that merges the TOML document cfg into
+// the generated buildkitd configuration. Tables defined by both documents are
+// merged key by key, with cfg taking precedence.
+func WithDaemonConfig(cfg string) SandboxOpt {
+	return daemonConfig(cfg)
+}
+
+type daemonConfig string
+
+func (dc daemonConfig) UpdateBackendConfig(cfg *BackendConfig) {
+	cfg.DaemonConfig = append(cfg.DaemonConfig, string(dc))
+}
+
+// WithEntitlements returns a SandboxOpt that allows the insecure
+// entitlements, e.g. "security.insecure" or "network.host", in the daemon.
+// Tests are skipped on workers that can't allow them.
+func WithEntitlements(entitlements ...string) SandboxOpt {
+	return entitlementsOpt(entitlements)
+}
+
+type entitlementsOpt []string
+
+func (e entitlementsOpt) UpdateBackendConfig(cfg *BackendConfig) {
+	for _, ent := range e {
+		if !contains(cfg.Entitlements, ent) {
+			cfg.Entitlements = append(cfg.Entitlements, ent)
+		}
+	}
+}
+
+var knownEntitlements = []string{"security.insecure", "network.host"}
+
+// entitlementsConfig returns the daemon configuration allowing
+// entitlements.
+func entitlementsConfig(entitlements []string) (string, error) {
+	quoted := make([]string, 0, len(entitlements))
+	for _, e := range entitlements {
+		if !contains(knownEntitlements, e) {
+			return "", errors.Errorf("unknown entitlement %q", e)
+		}
+		quoted = append(quoted, strconv.Quote(e))
+	}
+	return "insecure-entitlements = [" + strings.Join(quoted, ", ") + "]\n", nil
+}
+
+func mergeConfig(in string, fragments []string) (string, error) {
+	base, err := toml.Load(in)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to parse generated config")
+	}
+	m := base.ToMap()
+	for _, f := range fragments {
+		t, err := toml.Load(f)
+		if err != nil {
+			return "", errors.Wrapf(err, "failed to parse daemon config %q", f)
+		}
+		mergeMaps(m, t.ToMap())
+	}
+	t, err := toml.TreeFromMap(m)
+	if err != nil {
+		return "", err
+	}
+	return t.ToTomlString()
+}
+
+func mergeMaps(dst, src map[string]interface{}) {
+	for k, v := range src {
+		if sm, ok := v.(map[string]interface{}); ok {
+			if dm, ok := dst[k].(map[string]interface{}); ok {
+				mergeMaps(dm, sm)
+				continue
+			}
+		}
+		dst[k] = v
+	}
+}
+
+func writeConfig(updaters []ConfigUpdater, fragments []string) (string, error) {
+	tmpdir, err := os.MkdirTemp("", "bktest_config")
+	if err != nil {
+		return "", err
+	}
+	if err := os.Chmod(tmpdir, 0711); err != nil {
+		return "", err
+	}
+
+	s := ""
+	for _, upt := range updaters {
+		s = upt.UpdateConfigFile(s)
+	}
+	if len(fragments) > 0 {
+		s, err = mergeConfig(s, fragments)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if err := os.WriteFile(filepath.Join(tmpdir, buildkitdConfigFile), []byte(s), 0644); err != nil {
+		return "", err
+	}
+	return tmpdir, nil
+}
@@ -0,0 +1,54 @@
+package integration
+
+import (
+	"testing"
+
+	"github.com/pelletier/go-toml"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMergeConfig(t *testing.T) {
+	in := withMirrorConfig("localhost:5000", "quay.io").UpdateConfigFile(`
+[worker.oci]
+  gc = false
+  snapshotter = "overlayfs"
+`)
+	out, err := mergeConfig(in, []string{`
+[worker.oci]
+  gc = true
+  max-parallelism = 4
+`, `
+debug = true
+`})
+	require.NoError(t, err)
+
+	tree, err := toml.Load(out)
+	require.NoError(t, err)
+	require.Equal(t, true, tree.Get("debug"))
+	require.Equal(t, true, tree.GetPath([]string{"worker", "oci", "gc"}))
+	require.Equal(t, int64(4), tree.GetPath([]string{"worker", "oci", "max-parallelism"}))
+	require.Equal(t, "overlayfs", tree.GetPath([]string{"worker", "oci", "snapshotter"}))
+	require.Equal(t, []interface{}{"localhost:5000"}, tree.GetPath([]string{"registry", "docker.io", "mirrors"}))
+	require.Equal(t, []interface{}{"localhost:5000"}, tree.GetPath([]string{"registry", "quay.io", "mirrors"}))
+
+	_, err = mergeConfig(in, []string{"[worker"})
+	require.Error(t, err)
+}
+
+func TestEntitlementsConfig(t *testing.T) {
+	cfg := &BackendConfig{}
+	WithEntitlements("security.insecure").UpdateBackendConfig(cfg)
+	WithEntitlements("network.host", "security.insecure").UpdateBackendConfig(cfg)
+	require.Equal(t, []string{"security.insecure", "network.host"}, cfg.Entitlements)
+
+	ec, err := entitlementsConfig(cfg.Entitlements)
+	require.NoError(t, err)
+	out, err := mergeConfig("", []string{ec})
+	require.NoError(t, err)
+	tree, err := toml.Load(out)
+	require.NoError(t, err)
+	require.Equal(t, []interface{}{"security.insecure", "network.host"}, tree.Get("insecure-entitlements"))
+
+	_, err = entitlementsConfig([]string{"device"})
+	require.Error(t, err)
+}
@@ -0,0 +1,62 @@
+package integration
+
+import (
+	"sort"
+	"strings"
+)
+
+// WithDaemonEnv returns a SandboxOpt that sets environment variables of the
+// daemon process. Variables with an empty value are removed from the
+// environment the daemon inherits.
+func WithDaemonEnv(env map[string]string) SandboxOpt {
+	return daemonEnv(env)
+}
+
+type daemonEnv map[string]string
+
+func (e daemonEnv) UpdateBackendConfig(cfg *BackendConfig) {
+	keys := make([]string, 0, len(e))
+	for k := range e {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if v := e[k]; v != "" {
+			cfg.DaemonEnv = append(cfg.DaemonEnv, k+"="+v)
+		} else {
+			cfg.DaemonEnv = append(cfg.DaemonEnv, k)
+		}
+	}
+}
+
+// applyEnv returns env with the overrides from BackendConfig.DaemonEnv
+// applied. Later entries win.
+func applyEnv(env, overrides []string) []string {
+	out := make([]string, 0, len(env)+len(overrides))
+	idx := map[string]int{}
+	set := func(kv string) {
+		k := kv
+		if i := strings.Index(kv, "="); i >= 0 {
+			k = kv[:i]
+		}
+		if i, ok := idx[k]; ok {
+			out[i] = kv
+		} else {
+			idx[k] = len(out)
+			out = append(out, kv)
+		}
+	}
+	for _, kv := range env {
+		set(kv)
+	}
+	for _, kv := range overrides {
+		set(kv)
+	}
+	filtered := out[:0]
+	for _, kv := range out {
+		if strings.Contains(kv, "=") {
+			filtered = append(filtered, kv)
+		}
+	}
+	return filtered
+}
@@ -0,0 +1,15 @@
+package integration
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestApplyEnv(t *testing.T) {
+	cfg := &BackendConfig{DaemonEnv: []string{"A=override"}}
+	WithDaemonEnv(map[string]string{"B": "", "C": "with spaces and $dollar", "D": "x=y"}).UpdateBackendConfig(cfg)
+
+	env := applyEnv([]string{"A=1", "B=2", "E=3"}, cfg.DaemonEnv)
+	require.Equal(t, []string{"A=override", "E=3", "C=with spaces and $dollar", "D=x=y"}, env)
+}
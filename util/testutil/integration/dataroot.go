@@ -0,0 +1,134 @@
+package integration
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// WithDataRoot returns a SandboxOpt that keeps the state of the daemon in
+// dir instead of a new directory, e.g. for tests verifying that the state
+// survives starting the daemon again in another sandbox. dir is created if
+// needed and is not removed when the sandbox is closed.
+func WithDataRoot(dir string) SandboxOpt {
+	return dataRootOpt(dir)
+}
+
+type dataRootOpt string
+
+func (o dataRootOpt) UpdateBackendConfig(cfg *BackendConfig) {
+	cfg.DataRoot = string(o)
+}
+
+// WithPersistentDataDir returns a SandboxOpt that keeps the state of the
+// daemon in a directory identified by key, so that sandboxes using the same
+// key, e.g. in different runs of the tests, share the build cache. The
+// directories are created under BUILDKIT_TEST_DATA_DIR, or a directory in
+// os.TempDir if it is not set, separately for each worker and are not
+// removed when the sandbox is closed. key must be a valid file name.
+//
+// Sandboxes using the same directory must not run concurrently, as the
+// daemons would corrupt each other's state. This is only detected for the
+// sandboxes of the same test process, and is reported in the log of the
+// test.
+func WithPersistentDataDir(key string) SandboxOpt {
+	return persistentDataDirOpt(key)
+}
+
+type persistentDataDirOpt string
+
+func (o persistentDataDirOpt) UpdateBackendConfig(cfg *BackendConfig) {
+	cfg.persistentDataKey = string(o)
+}
+
+// persistentDataDirBase returns the directory the directories of
+// WithPersistentDataDir are created in.
+func persistentDataDirBase() string {
+	if dir := os.Getenv("BUILDKIT_TEST_DATA_DIR"); dir != "" {
+		return dir
+	}
+	return filepath.Join(os.TempDir(), "buildkit-test-data")
+}
+
+// persistentDataDir returns the directory for key of the worker called
+// worker. Rootless daemons of a worker that is not always rootless use
+// another directory, as the owner of their state differs.
+func persistentDataDir(key, worker string, rootless bool) (string, error) {
+	if key == "." || key == ".." || filepath.Base(key) != key {
+		return "", errors.Errorf("invalid persistent data dir key %q", key)
+	}
+	if rootless {
+		worker += "-rootless"
+	}
+	return filepath.Join(persistentDataDirBase(), key, worker), nil
+}
+
+var persistentDataDirs = struct {
+	sync.Mutex
+	users map[string]int
+}{users: map[string]int{}}
+
+// usePersistentDataDir marks dir as used by a sandbox of this process until
+// the returned function is called. It returns false if dir is already used.
+func usePersistentDataDir(dir string) (func() error, bool) {
+	persistentDataDirs.Lock()
+	defer persistentDataDirs.Unlock()
+	n := persistentDataDirs.users[dir]
+	persistentDataDirs.users[dir] = n + 1
+	return func() error {
+		persistentDataDirs.Lock()
+		defer persistentDataDirs.Unlock()
+		if persistentDataDirs.users[dir]--; persistentDataDirs.users[dir] == 0 {
+			delete(persistentDataDirs.users, dir)
+		}
+		return nil
+	}, n == 0
+}
+
+// dataRoot returns the state directory of the daemon called name. It is
+// tmpdir unless a persistent DataRoot is configured.
+func (cfg *BackendConfig) dataRoot(tmpdir, name string, uid, gid int) (string, error) {
+	if cfg.DataRoot == "" {
+		return tmpdir, nil
+	}
+	dir := filepath.Join(cfg.DataRoot, name)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	if err := os.Chown(dir, uid, gid); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// newDataDir creates a new directory for the state of a daemon like
+// os.MkdirTemp. With BUILDKIT_TEST_TMPFS=1 it is created on tmpfs, if
+// available, for faster tests at the cost of memory.
+func newDataDir(pattern string) (string, error) {
+	base := ""
+	if os.Getenv("BUILDKIT_TEST_TMPFS") == "1" && isTmpfs("/dev/shm") {
+		base = "/dev/shm"
+	}
+	return os.MkdirTemp(base, pattern)
+}
+
+// isTmpfs reports whether dir is the mountpoint of a tmpfs.
+func isTmpfs(dir string) bool {
+	f, err := os.Open("/proc/self/mounts")
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) > 2 && fields[1] == dir && fields[2] == "tmpfs" {
+			return true
+		}
+	}
+	return false
+}
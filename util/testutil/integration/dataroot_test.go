@@ -0,0 +1,72 @@
+package integration
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDataRoot(t *testing.T) {
+	tmpdir := t.TempDir()
+	cfg := &BackendConfig{}
+	dir, err := cfg.dataRoot(tmpdir, "buildkitd", os.Getuid(), os.Getgid())
+	require.NoError(t, err)
+	require.Equal(t, tmpdir, dir)
+
+	persistent := t.TempDir()
+	WithDataRoot(persistent).UpdateBackendConfig(cfg)
+	dir, err = cfg.dataRoot(tmpdir, "buildkitd", os.Getuid(), os.Getgid())
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(persistent, "buildkitd"), dir)
+	fi, err := os.Stat(dir)
+	require.NoError(t, err)
+	require.True(t, fi.IsDir())
+}
+
+func TestNewDataDirTmpfs(t *testing.T) {
+	t.Setenv("BUILDKIT_TEST_TMPFS", "1")
+	dir, err := newDataDir("bktest_datadir")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	if isTmpfs("/dev/shm") {
+		require.Equal(t, "/dev/shm", filepath.Dir(dir))
+	} else {
+		require.Equal(t, os.TempDir(), filepath.Dir(dir))
+	}
+}
+
+func TestPersistentDataDir(t *testing.T) {
+	base := t.TempDir()
+	t.Setenv("BUILDKIT_TEST_DATA_DIR", base)
+
+	cfg := &BackendConfig{}
+	WithPersistentDataDir("warm-cache").UpdateBackendConfig(cfg)
+	dir, err := persistentDataDir(cfg.persistentDataKey, "oci", false)
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(base, "warm-cache", "oci"), dir)
+
+	dir, err = persistentDataDir("warm-cache", "oci", true)
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(base, "warm-cache", "oci-rootless"), dir)
+
+	for _, key := range []string{"", ".", "..", "a/b"} {
+		_, err := persistentDataDir(key, "oci", false)
+		require.Error(t, err, key)
+	}
+}
+
+func TestUsePersistentDataDir(t *testing.T) {
+	dir := t.TempDir()
+	release1, ok := usePersistentDataDir(dir)
+	require.True(t, ok)
+	release2, ok := usePersistentDataDir(dir)
+	require.False(t, ok)
+	require.NoError(t, release2())
+	require.NoError(t, release1())
+
+	release, ok := usePersistentDataDir(dir)
+	require.True(t, ok)
+	require.NoError(t, release())
+}
@@ -0,0 +1,48 @@
+package integration
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// goroutineDumpEnabled reports whether BUILDKIT_INTEGRATION_GOROUTINE_DUMP
+// is set. Daemons are then started with a debug endpoint that is used to
+// print the goroutines of the daemon when a test fails.
+func goroutineDumpEnabled() bool {
+	v, _ := strconv.ParseBool(os.Getenv("BUILDKIT_INTEGRATION_GOROUTINE_DUMP"))
+	return v
+}
+
+// printGoroutines logs the goroutine dump of the sandbox daemon.
+func printGoroutines(t *testing.T, sb Sandbox) {
+	s, ok := sb.(*sandbox)
+	if !ok || s.debugAddress == "" {
+		t.Logf("goroutine dump is not available for %s worker", sb.Name())
+		return
+	}
+	dump, err := fetchGoroutines(s.debugAddress)
+	if err != nil {
+		t.Logf("failed to get goroutine dump: %v", err)
+		return
+	}
+	t.Logf("goroutines of %s daemon:\n%s", sb.Name(), dump)
+}
+
+func fetchGoroutines(addr string) ([]byte, error) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get("http://" + addr + "/debug/pprof/goroutine?debug=2")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("unexpected status %s", resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
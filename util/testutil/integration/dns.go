@@ -0,0 +1,157 @@
+package integration
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// WithHosts returns a SandboxOpt that adds entries mapping host names to IP
+// addresses to the /etc/hosts seen by the daemon, e.g. to make
+// "image.internal" resolve to the local mirror with "127.0.0.1". The build
+// helpers like BuildAndPush pass the entries to the RUN containers with the
+// add-hosts option of the Dockerfile frontend. Only the oci and containerd
+// workers started as root support it.
+func WithHosts(hosts map[string]string) SandboxOpt {
+	return hostsOpt(hosts)
+}
+
+type hostsOpt map[string]string
+
+func (o hostsOpt) UpdateBackendConfig(cfg *BackendConfig) {
+	if cfg.hosts == nil {
+		cfg.hosts = map[string]string{}
+	}
+	for k, v := range o {
+		cfg.hosts[k] = v
+	}
+}
+
+// WithDNS returns a SandboxOpt that makes the daemon and the containers of
+// builds use nameservers instead of the ones configured on the host. Only
+// the oci and containerd workers started as root support it.
+func WithDNS(nameservers ...string) SandboxOpt {
+	return dnsOpt(nameservers)
+}
+
+type dnsOpt []string
+
+func (o dnsOpt) UpdateBackendConfig(cfg *BackendConfig) {
+	cfg.nameservers = append(cfg.nameservers, o...)
+}
+
+func (cfg *BackendConfig) overridesResolver() bool {
+	return len(cfg.hosts) > 0 || len(cfg.nameservers) > 0
+}
+
+// writeResolverFiles writes the hosts file and resolv.conf that are mounted
+// over the ones of the host for the daemon, see resolverArgs. Empty paths
+// are returned for the files that are not overridden.
+func writeResolverFiles(hosts map[string]string, nameservers []string) (hostsFile, resolvConf string, cl func() error, err error) {
+	dir, err := os.MkdirTemp("", "bktest_resolver")
+	if err != nil {
+		return "", "", nil, err
+	}
+	defer func() {
+		if err != nil {
+			os.RemoveAll(dir)
+		}
+	}()
+
+	if len(hosts) > 0 {
+		dt, err := os.ReadFile("/etc/hosts")
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return "", "", nil, err
+		}
+		s := string(dt)
+		if s != "" && !strings.HasSuffix(s, "\n") {
+			s += "\n"
+		}
+		names := make([]string, 0, len(hosts))
+		for name := range hosts {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if net.ParseIP(hosts[name]) == nil {
+				return "", "", nil, errors.Errorf("invalid IP %q for host %s", hosts[name], name)
+			}
+			s += hosts[name] + "\t" + name + "\n"
+		}
+		hostsFile = filepath.Join(dir, "hosts")
+		if err := os.WriteFile(hostsFile, []byte(s), 0644); err != nil {
+			return "", "", nil, err
+		}
+	}
+
+	if len(nameservers) > 0 {
+		var s string
+		for _, ns := range nameservers {
+			if net.ParseIP(ns) == nil {
+				return "", "", nil, errors.Errorf("invalid nameserver %q", ns)
+			}
+			s += "nameserver " + ns + "\n"
+		}
+		resolvConf = filepath.Join(dir, "resolv.conf")
+		if err := os.WriteFile(resolvConf, []byte(s), 0644); err != nil {
+			return "", "", nil, err
+		}
+	}
+	return hostsFile, resolvConf, func() error { return os.RemoveAll(dir) }, nil
+}
+
+// dnsConfig returns the daemon configuration making the containers of
+// builds use nameservers.
+func dnsConfig(nameservers []string) string {
+	quoted := make([]string, 0, len(nameservers))
+	for _, ns := range nameservers {
+		quoted = append(quoted, strconv.Quote(ns))
+	}
+	return "[dns]\nnameservers = [" + strings.Join(quoted, ", ") + "]\n"
+}
+
+// resolverArgs returns args prefixed with a command that runs them in a new
+// mount namespace with the hosts file and resolv.conf of cfg mounted over
+// the ones of the host. args are returned as is if nothing is overridden.
+func (cfg *BackendConfig) resolverArgs(args []string) ([]string, error) {
+	if cfg.hostsFile == "" && cfg.resolvConf == "" {
+		return args, nil
+	}
+	if err := requireRoot(); err != nil {
+		return nil, errors.Wrap(err, "overriding the resolver of the daemon")
+	}
+	if err := lookupBinary("unshare"); err != nil {
+		return nil, err
+	}
+	script := `set -e
+[ -z "$1" ] || mount --bind "$1" /etc/hosts
+[ -z "$2" ] || mount --bind "$2" /etc/resolv.conf
+shift 2
+exec "$@"`
+	return append([]string{"unshare", "--mount", "--propagation", "private", "sh", "-c", script, "sh", cfg.hostsFile, cfg.resolvConf}, args...), nil
+}
+
+// addHostsOpt returns the add-hosts option of the Dockerfile frontend for
+// the hosts of the sandbox, if any.
+func addHostsOpt(sb Sandbox) []string {
+	s, ok := sb.(*sandbox)
+	if !ok || len(s.hosts) == 0 {
+		return nil
+	}
+	names := make([]string, 0, len(s.hosts))
+	for name := range s.hosts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	entries := make([]string, 0, len(names))
+	for _, name := range names {
+		entries = append(entries, fmt.Sprintf("%s=%s", name, s.hosts[name]))
+	}
+	return []string{"--opt=add-hosts=" + strings.Join(entries, ",")}
+}
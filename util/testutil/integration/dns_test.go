@@ -0,0 +1,50 @@
+package integration
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteResolverFiles(t *testing.T) {
+	hostsFile, resolvConf, cl, err := writeResolverFiles(map[string]string{
+		"mirror.internal": "127.0.0.2",
+		"image.internal":  "127.0.0.1",
+	}, []string{"10.0.0.53"})
+	require.NoError(t, err)
+	defer cl()
+
+	dt, err := os.ReadFile(hostsFile)
+	require.NoError(t, err)
+	require.True(t, strings.HasSuffix(string(dt), "127.0.0.1\timage.internal\n127.0.0.2\tmirror.internal\n"), string(dt))
+
+	dt, err = os.ReadFile(resolvConf)
+	require.NoError(t, err)
+	require.Equal(t, "nameserver 10.0.0.53\n", string(dt))
+
+	require.NoError(t, cl())
+	_, err = os.Stat(hostsFile)
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	_, _, _, err = writeResolverFiles(map[string]string{"image.internal": "localhost"}, nil)
+	require.Error(t, err)
+
+	hostsFile, resolvConf, cl, err = writeResolverFiles(nil, []string{"10.0.0.53"})
+	require.NoError(t, err)
+	defer cl()
+	require.Empty(t, hostsFile)
+	require.NotEmpty(t, resolvConf)
+}
+
+func TestDNSConfig(t *testing.T) {
+	require.Equal(t, "[dns]\nnameservers = [\"10.0.0.53\", \"10.0.0.54\"]\n", dnsConfig([]string{"10.0.0.53", "10.0.0.54"}))
+}
+
+func TestAddHostsOpt(t *testing.T) {
+	require.Empty(t, addHostsOpt(newTestSandbox(t)))
+	sb := newTestSandbox(t)
+	sb.hosts = map[string]string{"b.internal": "10.0.0.2", "a.internal": "10.0.0.1"}
+	require.Equal(t, []string{"--opt=add-hosts=a.internal=10.0.0.1,b.internal=10.0.0.2"}, addHostsOpt(sb))
+}
@@ -0,0 +1,213 @@
+package integration
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/moby/buildkit/identity"
+	"github.com/pkg/errors"
+)
+
+const (
+	dockerBinary         = "docker"
+	defaultBuildkitImage = "moby/buildkit:latest"
+)
+
+// InitDockerContainerWorker registers a worker that runs buildkitd from a
+// released image in a Docker container. The image defaults to
+// moby/buildkit:latest and can be overridden with BUILDKIT_TEST_IMAGE. The
+// worker is only registered if the Docker daemon is reachable.
+func InitDockerContainerWorker() {
+	if dockerReachable() != nil {
+		return
+	}
+	image := os.Getenv("BUILDKIT_TEST_IMAGE")
+	if image == "" {
+		image = defaultBuildkitImage
+	}
+	Register(&dockerContainer{image: image})
+}
+
+type dockerContainer struct {
+	image string
+}
+
+func (c *dockerContainer) Name() string {
+	return "docker-container"
+}
+
+func (c *dockerContainer) Rootless() bool {
+	return false
+}
+
+func (c *dockerContainer) New(ctx context.Context, cfg *BackendConfig) (b Backend, cl func() error, err error) {
+	if err := dockerReachable(); err != nil {
+		return nil, nil, err
+	}
+	if cfg.Rootless {
+		return nil, nil, RequirementErrorf(SkipUnsupportedWorker, "docker-container worker does not support rootless mode")
+	}
+	if _, err := rootlessNet(cfg, false); err != nil {
+		return nil, nil, err
+	}
+	if cfg.overridesResolver() {
+		return nil, nil, RequirementErrorf(SkipUnsupportedWorker, "docker-container worker does not support overriding the resolver")
+	}
+	if cfg.resourceLimits != nil {
+		return nil, nil, RequirementErrorf(SkipUnsupportedWorker, "docker-container worker does not support resource limits")
+	}
+
+	deferF := &multiCloser{}
+	cl = deferF.F()
+
+	defer func() {
+		if err != nil {
+			deferF.F()()
+			cl = nil
+		}
+	}()
+
+	// the container shares the host network so that the daemon can reach
+	// the mirror and the registries started by tests on localhost
+	port, err := freePort()
+	if err != nil {
+		return nil, nil, err
+	}
+	address := "tcp://127.0.0.1:" + strconv.Itoa(port)
+	name := "buildkit-integration-" + identity.NewID()[:shortLen]
+
+	args := []string{"run", "-d", "--privileged", "--network=host", "--name", name}
+	if cfg.ConfigFile != "" {
+		args = append(args, "-v", cfg.ConfigFile+":/etc/buildkit/buildkitd.toml:ro")
+	}
+	if cfg.DataRoot != "" {
+		root, err := cfg.dataRoot("", "buildkitd", 0, 0)
+		if err != nil {
+			return nil, nil, err
+		}
+		args = append(args, "-v", root+":/var/lib/buildkit")
+	}
+	if cfg.caBundle != "" {
+		// mounted at the same path so that SSL_CERT_FILE from DaemonEnv
+		// applies in the container
+		args = append(args, "-v", cfg.caBundle+":"+cfg.caBundle+":ro")
+	}
+	args = append(args, "-e", "BUILDKIT_DEBUG_EXEC_OUTPUT=1", "-e", "BUILDKIT_DEBUG_PANIC_ON_ERROR=1")
+	// the container doesn't inherit the environment so unset variables
+	// are dropped
+	for _, env := range applyEnv(nil, cfg.DaemonEnv) {
+		args = append(args, "-e", env)
+	}
+	args = append(args, c.image, "--addr", address, "--debug", "--oci-worker-labels=org.mobyproject.buildkit.worker.sandbox=true")
+	if cfg.debugAddress != "" {
+		args = append(args, "--debugaddr", cfg.debugAddress)
+	}
+	if cfg.Snapshotter != "" {
+		args = append(args, "--oci-worker-snapshotter="+cfg.Snapshotter)
+	}
+
+	recordContainer(name)
+	if out, err := exec.CommandContext(ctx, dockerBinary, args...).CombinedOutput(); err != nil {
+		return nil, nil, errors.Wrapf(err, "failed to start %s: %s", c.image, out)
+	}
+	deferF.append(func() error {
+		return stopContainer(name, cfg.stopOpts())
+	})
+
+	logsCmd := exec.Command(dockerBinary, "logs", "-f", name)
+	streamLogs(logsCmd, cfg)
+	stopLogs, err := startCmd(logsCmd, cfg.Logs)
+	if err != nil {
+		return nil, nil, err
+	}
+	deferF.append(stopLogs)
+
+	if err := waitTCP(address, 15*time.Second); err != nil {
+		return nil, nil, classifyStartError(errors.Wrapf(err, "buildkitd in %s did not start: %s", name, formatLogs(cfg.Logs)), cfg.Logs)
+	}
+
+	return backend{
+		address:         address,
+		buildctlAddress: "docker-container://" + name,
+		snapshotter:     cfg.Snapshotter,
+	}, cl, nil
+}
+
+// stopContainer stops and removes the container following the shutdown
+// settings of the backend config.
+func stopContainer(name string, opts stopOpts) error {
+	defer exec.Command(dockerBinary, "rm", "-f", "-v", name).Run()
+
+	if opts.force {
+		if out, err := exec.Command(dockerBinary, "kill", name).CombinedOutput(); err != nil {
+			return errors.Wrapf(err, "failed to kill %s: %s", name, out)
+		}
+		return nil
+	}
+
+	timeout := opts.timeout
+	if timeout == 0 {
+		timeout = 20 * time.Second
+	}
+	secs := strconv.Itoa(int(timeout.Round(time.Second) / time.Second))
+	if out, err := exec.Command(dockerBinary, "stop", "-t", secs, name).CombinedOutput(); err != nil {
+		return errors.Wrapf(err, "failed to stop %s: %s", name, out)
+	}
+	if !opts.checkExit {
+		return nil
+	}
+	out, err := exec.Command(dockerBinary, "inspect", "-f", "{{.State.ExitCode}}", name).Output()
+	if err != nil {
+		return errors.Wrapf(err, "failed to inspect %s", name)
+	}
+	if code := strings.TrimSpace(string(out)); code != "0" {
+		return errors.Wrapf(errUncleanShutdown, "%s exited with code %s", name, code)
+	}
+	return nil
+}
+
+func dockerReachable() error {
+	if err := lookupBinary(dockerBinary); err != nil {
+		return err
+	}
+	var stderr bytes.Buffer
+	cmd := exec.Command(dockerBinary, "version", "--format", "{{.Server.Version}}")
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return RequirementErrorf(SkipMissingBinary, "docker daemon is not reachable: %s", strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+func freePort() (int, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
+
+func waitTCP(address string, d time.Duration) error {
+	address = strings.TrimPrefix(address, "tcp://")
+	step := 50 * time.Millisecond
+	i := 0
+	for {
+		if conn, err := net.Dial("tcp", address); err == nil {
+			conn.Close()
+			break
+		}
+		i++
+		if time.Duration(i)*step > d {
+			return errors.Errorf("failed dialing: %s", address)
+		}
+		time.Sleep(step)
+	}
+	return nil
+}
@@ -43,6 +43,27 @@ func (c dockerd) New(ctx context.Context, cfg *BackendConfig) (b Backend, cl fun
 	if err := requireRoot(); err != nil {
 		return nil, nil, err
 	}
+	if cfg.Rootless {
+		return nil, nil, RequirementErrorf(SkipUnsupportedWorker, "dockerd worker does not support rootless mode")
+	}
+	if _, err := rootlessNet(cfg, false); err != nil {
+		return nil, nil, err
+	}
+	if cfg.Snapshotter != "" {
+		return nil, nil, RequirementErrorf(SkipUnsupportedWorker, "dockerd worker does not support selecting the %s snapshotter", cfg.Snapshotter)
+	}
+	if len(cfg.Entitlements) > 0 {
+		return nil, nil, RequirementErrorf(SkipUnsupportedWorker, "dockerd worker does not support entitlements %v", cfg.Entitlements)
+	}
+	if comp := Compression(cfg.Compression); comp == CompressionZstd || comp == CompressionEStargz {
+		return nil, nil, RequirementErrorf(SkipUnsupportedWorker, "dockerd worker does not support exporting %s layers", comp)
+	}
+	if cfg.overridesResolver() {
+		return nil, nil, RequirementErrorf(SkipUnsupportedWorker, "dockerd worker does not support overriding the resolver")
+	}
+	if cfg.resourceLimits != nil {
+		return nil, nil, RequirementErrorf(SkipUnsupportedWorker, "dockerd worker does not support resource limits")
+	}
 
 	deferF := &multiCloser{}
 	cl = deferF.F()
@@ -57,10 +78,11 @@ func (c dockerd) New(ctx context.Context, cfg *BackendConfig) (b Backend, cl fun
 	var proxyGroup errgroup.Group
 	deferF.append(proxyGroup.Wait)
 
-	workDir, err := os.MkdirTemp("", "integration")
+	workDir, err := newDataDir("integration")
 	if err != nil {
 		return nil, nil, err
 	}
+	deferF.append(func() error { return os.RemoveAll(workDir) })
 
 	dockerdBinaryPath, err := exec.LookPath(dockerdBinary)
 	if err != nil {
@@ -77,6 +99,10 @@ func (c dockerd) New(ctx context.Context, cfg *BackendConfig) (b Backend, cl fun
 	if err := os.MkdirAll(daemonRoot, 0755); err != nil {
 		return nil, nil, errors.Wrapf(err, "failed to create daemon root %q", daemonRoot)
 	}
+	daemonRoot, err = cfg.dataRoot(daemonRoot, "dockerd", 0, 0)
+	if err != nil {
+		return nil, nil, err
+	}
 	execRoot := filepath.Join(os.TempDir(), "dxr", id)
 	daemonSocket := "unix://" + filepath.Join(daemonFolder, "docker.sock")
 
@@ -93,9 +119,11 @@ func (c dockerd) New(ctx context.Context, cfg *BackendConfig) (b Backend, cl fun
 		"--debug",
 	}...)
 	cmd.Env = append(os.Environ(), "DOCKER_SERVICE_PREFER_OFFLINE_IMAGE=1", "BUILDKIT_DEBUG_EXEC_OUTPUT=1", "BUILDKIT_DEBUG_PANIC_ON_ERROR=1")
+	cmd.Env = applyEnv(cmd.Env, cfg.DaemonEnv)
+	streamLogs(cmd, cfg)
 	cmd.SysProcAttr = getSysProcAttr()
 
-	dockerdStop, err := startCmd(cmd, cfg.Logs)
+	dockerdStop, err := startCmdWithOpts(cmd, cfg.Logs, cfg.stopOpts())
 	if err != nil {
 		return nil, nil, errors.Wrapf(err, "dockerd startcmd error: %s", formatLogs(cfg.Logs))
 	}
@@ -175,9 +203,11 @@ func (c dockerd) New(ctx context.Context, cfg *BackendConfig) (b Backend, cl fun
 	})
 
 	return backend{
-		address:   "unix://" + listener.Addr().String(),
-		rootless:  false,
-		isDockerd: true,
+		address:       "unix://" + listener.Addr().String(),
+		rootless:      false,
+		isDockerd:     true,
+		daemon:        &daemonProcess{cmd: cmd},
+		dockerAddress: daemonSocket,
 	}, cl, nil
 }
 
@@ -0,0 +1,57 @@
+package integration
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// deadlineMargin is left before the deadline of the test binary so that a
+// failing condition is reported by Eventually instead of the test timing
+// out with a panic.
+const deadlineMargin = 5 * time.Second
+
+// Eventually calls cond every interval until it returns true and fails the
+// test if that doesn't happen within timeout. Errors returned by cond don't
+// stop the polling, the last one is reported on failure. The timeout is
+// shortened if the test would otherwise reach the deadline set with
+// -timeout.
+func Eventually(t testing.TB, cond func() (bool, error), timeout, interval time.Duration) {
+	t.Helper()
+	if err := eventually(t, cond, timeout, interval); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func eventually(t testing.TB, cond func() (bool, error), timeout, interval time.Duration) error {
+	start := time.Now()
+	deadline := start.Add(timeout)
+	if d, ok := t.(interface{ Deadline() (time.Time, bool) }); ok {
+		if td, ok := d.Deadline(); ok && td.Add(-deadlineMargin).Before(deadline) {
+			deadline = td.Add(-deadlineMargin)
+		}
+	}
+
+	var lastErr error
+	for i := 0; ; i++ {
+		ok, err := cond()
+		if ok && err == nil {
+			return nil
+		}
+		if err != nil {
+			lastErr = err
+		}
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			if lastErr != nil {
+				return errors.Wrapf(lastErr, "condition not met after %d attempts in %v", i+1, time.Since(start).Round(time.Millisecond))
+			}
+			return errors.Errorf("condition not met after %d attempts in %v", i+1, time.Since(start).Round(time.Millisecond))
+		}
+		if interval < remaining {
+			remaining = interval
+		}
+		time.Sleep(remaining)
+	}
+}
@@ -0,0 +1,42 @@
+package integration
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEventually(t *testing.T) {
+	calls := 0
+	start := time.Now()
+	Eventually(t, func() (bool, error) {
+		calls++
+		if calls < 3 {
+			return false, errors.New("not yet")
+		}
+		return true, nil
+	}, 10*time.Second, 10*time.Millisecond)
+	require.Equal(t, 3, calls)
+	require.Less(t, time.Since(start), 5*time.Second)
+
+	calls = 0
+	err := eventually(t, func() (bool, error) {
+		calls++
+		if calls == 1 {
+			return false, errors.Errorf("attempt %d failed", calls)
+		}
+		return false, nil
+	}, 50*time.Millisecond, 10*time.Millisecond)
+	require.Error(t, err)
+	// the last error is kept when later attempts only return false
+	require.Contains(t, err.Error(), "attempt 1 failed")
+	require.Greater(t, calls, 1)
+
+	err = eventually(t, func() (bool, error) {
+		return false, nil
+	}, 0, time.Second)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "condition not met after 1 attempts")
+}
@@ -0,0 +1,92 @@
+package integration
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// InitExternalWorker registers a worker that runs the tests against the
+// daemon at BUILDKIT_HOST instead of starting one, e.g. buildkitd running as
+// a CI sidecar. The worker is only registered if BUILDKIT_HOST is set.
+func InitExternalWorker() {
+	if addr := os.Getenv("BUILDKIT_HOST"); addr != "" {
+		Register(&external{address: addr})
+	}
+}
+
+// external is a worker for a daemon managed outside of the test. The daemon
+// can't be configured by the sandbox, so options that depend on it make the
+// tests skip. The generated buildkitd.toml doesn't apply either, the daemon
+// pulls without the mirror and MirrorHost returns an empty string.
+type external struct {
+	address string
+}
+
+func (e *external) Name() string {
+	return "external"
+}
+
+func (e *external) Rootless() bool {
+	return false
+}
+
+func (e *external) New(ctx context.Context, cfg *BackendConfig) (Backend, func() error, error) {
+	if err := e.supports(cfg); err != nil {
+		return nil, nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, cfg.buildctlBinary(), "--addr", e.address, "debug", "workers")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return nil, nil, errors.Wrapf(err, "failed to connect to external daemon at %s: %s", e.address, bytes.TrimSpace(out))
+	}
+
+	cfg.ignoresConfigFile = true
+	// goroutine dumps are not available, the daemon has no debug endpoint
+	// the sandbox knows of
+	cfg.debugAddress = ""
+
+	if cfg.Logs != nil {
+		logsMu.Lock()
+		cfg.Logs["external"] = bytes.NewBufferString(fmt.Sprintf("daemon at %s is managed externally, its logs are not captured\n", e.address))
+		logsMu.Unlock()
+	}
+	// the daemon keeps running after the test
+	return backend{address: e.address}, func() error { return nil }, nil
+}
+
+// supports returns an error wrapping ErrRequirements if cfg requires
+// configuring the daemon.
+func (e *external) supports(cfg *BackendConfig) error {
+	switch {
+	case cfg.Rootless:
+		return RequirementErrorf(SkipUnsupportedWorker, "external worker does not support selecting rootless mode")
+	case cfg.Snapshotter != "":
+		return RequirementErrorf(SkipUnsupportedWorker, "external worker does not support selecting the %s snapshotter", cfg.Snapshotter)
+	case cfg.overridesResolver():
+		return RequirementErrorf(SkipUnsupportedWorker, "external worker does not support overriding the resolver")
+	case cfg.resourceLimits != nil:
+		return RequirementErrorf(SkipUnsupportedWorker, "external worker does not support resource limits")
+	case cfg.traceCollector:
+		return RequirementErrorf(SkipUnsupportedWorker, "external worker does not support collecting traces")
+	case len(cfg.DaemonConfig) > 0:
+		return RequirementErrorf(SkipUnsupportedWorker, "external worker does not support daemon config")
+	case len(cfg.DaemonEnv) > 0:
+		return RequirementErrorf(SkipUnsupportedWorker, "external worker does not support daemon environment")
+	case len(cfg.caCerts) > 0:
+		return RequirementErrorf(SkipUnsupportedWorker, "external worker does not support CA certificates")
+	case cfg.DataRoot != "":
+		return RequirementErrorf(SkipUnsupportedWorker, "external worker does not support selecting the data root")
+	case cfg.DaemonPath != "":
+		return RequirementErrorf(SkipUnsupportedWorker, "external worker does not support selecting the daemon binary")
+	}
+	_, err := rootlessNet(cfg, false)
+	return err
+}
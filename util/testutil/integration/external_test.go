@@ -0,0 +1,53 @@
+package integration
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestExternalWorkerSupports(t *testing.T) {
+	w := &external{address: "tcp://127.0.0.1:1234"}
+	require.NoError(t, w.supports(&BackendConfig{ConfigFile: "/etc/buildkit/buildkitd.toml"}))
+
+	for _, cfg := range []*BackendConfig{
+		{Rootless: true},
+		{Snapshotter: "native"},
+		{DaemonConfig: []string{"debug = true"}},
+		{DaemonEnv: []string{"FOO=bar"}},
+		{RootlessNet: "slirp4netns"},
+		{DataRoot: "/var/lib/buildkit-test"},
+		{hosts: map[string]string{"image.internal": "127.0.0.1"}},
+		{nameservers: []string{"127.0.0.53"}},
+		{resourceLimits: &ResourceLimits{Memory: 64 << 20}},
+		{traceCollector: true},
+	} {
+		require.ErrorIs(t, w.supports(cfg), ErrRequirements)
+	}
+}
+
+func TestExternalWorkerUnreachable(t *testing.T) {
+	w := &external{address: "unix:///nonexistent/buildkitd.sock"}
+	logs := map[string]*bytes.Buffer{}
+	_, _, err := w.New(context.TODO(), &BackendConfig{Logs: logs, BuildctlPath: "false"})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "failed to connect to external daemon at unix:///nonexistent/buildkitd.sock")
+	require.Empty(t, logs)
+}
+
+func TestExternalWorkerMirror(t *testing.T) {
+	// the mirror and the debug endpoint are configured for the sandbox but
+	// the daemon doesn't know of them
+	t.Setenv("BUILDKIT_INTEGRATION_GOROUTINE_DUMP", "1")
+	w := &external{address: "unix:///nonexistent/buildkitd.sock"}
+	sb, cl, err := newSandbox(context.TODO(), t, w, "127.0.0.1:5000", matrixValue{}, []SandboxOpt{WithBuildctlPath("true")})
+	require.NoError(t, err)
+	defer cl()
+	require.Empty(t, sb.MirrorHost())
+	s := sb.(*sandbox)
+	require.Empty(t, s.configFile)
+	require.Empty(t, s.debugAddress)
+	require.Equal(t, "unix:///nonexistent/buildkitd.sock", sb.Address())
+}
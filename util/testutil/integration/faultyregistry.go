@@ -0,0 +1,140 @@
+package integration
+
+import (
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// RegistryFault describes how the registry started by NewFaultyRegistry
+// misbehaves for requests matching a path pattern.
+type RegistryFault struct {
+	// Delay is waited before the request is handled.
+	Delay time.Duration
+	// Status is returned instead of proxying the request if non-zero, e.g.
+	// http.StatusTooManyRequests.
+	Status int
+	// Count limits how many requests the fault applies to. Zero applies it
+	// to all matching requests.
+	Count int
+}
+
+// FaultyRegistry is a registry that injects faults into the responses of a
+// regular registry. Faults can be changed while the registry is in use.
+type FaultyRegistry struct {
+	// Host is the address of the registry, like the one returned by
+	// NewRegistry.
+	Host string
+
+	target *url.URL
+	mu     sync.Mutex
+	faults []*registryFault
+}
+
+type registryFault struct {
+	re *regexp.Regexp
+	RegistryFault
+	hits int
+}
+
+// NewFaultyRegistry starts a registry with NewRegistry and a proxy in front
+// of it that injects the faults configured with SetFault.
+func NewFaultyRegistry(dir string) (r *FaultyRegistry, cl func() error, err error) {
+	host, stop, err := NewRegistry(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	r, closeProxy, err := newFaultyRegistry("http://" + host)
+	if err != nil {
+		stop()
+		return nil, nil, err
+	}
+	return r, func() error {
+		err := closeProxy()
+		if err1 := stop(); err == nil {
+			err = err1
+		}
+		return err
+	}, nil
+}
+
+func newFaultyRegistry(target string) (*FaultyRegistry, func() error, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, nil, err
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, nil, err
+	}
+	r := &FaultyRegistry{
+		Host:   "localhost:" + portOf(l.Addr()),
+		target: u,
+	}
+	srv := &http.Server{Handler: r}
+	go srv.Serve(l)
+	return r, srv.Close, nil
+}
+
+func portOf(addr net.Addr) string {
+	_, port, _ := net.SplitHostPort(addr.String())
+	return port
+}
+
+// SetFault injects f into the responses for requests whose path matches the
+// regular expression pattern, e.g. `/v2/.*/blobs/`. Faults are checked in the
+// order they were set and the first matching one is applied.
+func (r *FaultyRegistry) SetFault(pattern string, f RegistryFault) error {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.faults = append(r.faults, &registryFault{re: re, RegistryFault: f})
+	return nil
+}
+
+// ClearFaults removes all faults so that requests are proxied unchanged.
+func (r *FaultyRegistry) ClearFaults() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.faults = nil
+}
+
+func (r *FaultyRegistry) fault(path string) (RegistryFault, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, f := range r.faults {
+		if !f.re.MatchString(path) {
+			continue
+		}
+		if f.Count > 0 && f.hits >= f.Count {
+			continue
+		}
+		f.hits++
+		return f.RegistryFault, true
+	}
+	return RegistryFault{}, false
+}
+
+func (r *FaultyRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if f, ok := r.fault(req.URL.Path); ok {
+		if f.Delay > 0 {
+			select {
+			case <-time.After(f.Delay):
+			case <-req.Context().Done():
+				return
+			}
+		}
+		if f.Status != 0 {
+			http.Error(w, http.StatusText(f.Status), f.Status)
+			return
+		}
+	}
+	httputil.NewSingleHostReverseProxy(r.target).ServeHTTP(w, req)
+}
@@ -0,0 +1,51 @@
+package integration
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFaultyRegistry(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok "+r.URL.Path)
+	}))
+	defer backend.Close()
+
+	r, cl, err := newFaultyRegistry(backend.URL)
+	require.NoError(t, err)
+	defer cl()
+
+	get := func(path string) (int, string) {
+		resp, err := http.Get("http://" + r.Host + path)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		dt, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, string(dt)
+	}
+
+	code, body := get("/v2/")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, "ok /v2/", body)
+
+	require.NoError(t, r.SetFault(`/blobs/`, RegistryFault{Status: http.StatusTooManyRequests, Count: 2}))
+	code, _ = get("/v2/foo/blobs/sha256:abc")
+	require.Equal(t, http.StatusTooManyRequests, code)
+	code, _ = get("/v2/foo/manifests/latest")
+	require.Equal(t, http.StatusOK, code)
+	code, _ = get("/v2/foo/blobs/sha256:abc")
+	require.Equal(t, http.StatusTooManyRequests, code)
+	code, _ = get("/v2/foo/blobs/sha256:abc")
+	require.Equal(t, http.StatusOK, code)
+
+	require.NoError(t, r.SetFault(`.*`, RegistryFault{Status: http.StatusInternalServerError}))
+	code, _ = get("/v2/")
+	require.Equal(t, http.StatusInternalServerError, code)
+	r.ClearFaults()
+	code, _ = get("/v2/")
+	require.Equal(t, http.StatusOK, code)
+}
@@ -0,0 +1,54 @@
+package integration
+
+// Frontend selects how the build helpers like BuildAndPush run the
+// Dockerfile frontend. The values can be used in a matrix dimension, see
+// WithFrontendMatrix, because some bugs only appear with one of them.
+type Frontend string
+
+const (
+	// FrontendBuiltin uses the Dockerfile frontend built into the daemon.
+	FrontendBuiltin Frontend = "builtin"
+	// FrontendGateway runs DockerfileFrontendImage with the gateway
+	// frontend.
+	FrontendGateway Frontend = "gateway"
+)
+
+// DockerfileFrontendImage is the image of the Dockerfile frontend run by
+// FrontendGateway.
+const DockerfileFrontendImage = "docker/dockerfile:1"
+
+// WithFrontendMatrix adds the "frontend" matrix dimension over
+// FrontendBuiltin and FrontendGateway and copies DockerfileFrontendImage to
+// the mirror so that the gateway variant works offline.
+func WithFrontendMatrix() TestOpt {
+	matrix := WithMatrix("frontend", map[string]interface{}{
+		string(FrontendBuiltin): FrontendBuiltin,
+		string(FrontendGateway): FrontendGateway,
+	})
+	mirrored := WithMirroredImages(map[string]string{
+		DockerfileFrontendImage: "docker.io/" + DockerfileFrontendImage,
+	})
+	return func(tc *testConf) {
+		matrix(tc)
+		mirrored(tc)
+	}
+}
+
+// FrontendOf returns the frontend selected through the matrix of sb, or
+// FrontendBuiltin.
+func FrontendOf(sb Sandbox) Frontend {
+	for _, v := range sb.Values() {
+		if f, ok := v.(Frontend); ok {
+			return f
+		}
+	}
+	return FrontendBuiltin
+}
+
+// Args returns the buildctl build flags that select the frontend.
+func (f Frontend) Args() []string {
+	if f == FrontendGateway {
+		return []string{"--frontend=gateway.v0", "--opt=source=" + DockerfileFrontendImage}
+	}
+	return []string{"--frontend=dockerfile.v0"}
+}
@@ -0,0 +1,22 @@
+package integration
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFrontendMatrix(t *testing.T) {
+	var tc testConf
+	WithFrontendMatrix()(&tc)
+	require.Len(t, tc.matrix["frontend"], 2)
+	require.Equal(t, "docker.io/docker/dockerfile:1", tc.mirroredImages[DockerfileFrontendImage])
+
+	sb := newTestSandbox(t)
+	sb.mv = newMatrixValue("frontend", "gateway", FrontendGateway)
+	require.Equal(t, FrontendGateway, FrontendOf(sb))
+	require.Equal(t, []string{"--frontend=gateway.v0", "--opt=source=docker/dockerfile:1"}, FrontendOf(sb).Args())
+
+	require.Equal(t, FrontendBuiltin, FrontendOf(newTestSandbox(t)))
+	require.Equal(t, []string{"--frontend=dockerfile.v0"}, FrontendBuiltin.Args())
+}
@@ -0,0 +1,182 @@
+package integration
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"net/http/cgi"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// GitRepo is a git repository served over the smart HTTP protocol, e.g. for
+// builds with a git context. Commits are made on a work tree and pushed to
+// the served bare repository.
+type GitRepo struct {
+	// URL is the address of the repository without a ref.
+	URL string
+
+	workTree string
+	bare     string
+}
+
+// NewGitRepo creates a repository with a commit of the files of bc and
+// dockerfile on the branch "main", that is also the default branch, and
+// serves it until the end of the test. It requires the git binary.
+func NewGitRepo(sb Sandbox, bc BuildContext, dockerfile string) (*GitRepo, error) {
+	git, err := exec.LookPath("git")
+	if err != nil {
+		return nil, RequirementErrorf(SkipMissingBinary, "failed to lookup git binary")
+	}
+	dir, err := os.MkdirTemp(sb.TempDir(), "git")
+	if err != nil {
+		return nil, err
+	}
+	r := &GitRepo{
+		workTree: filepath.Join(dir, "work"),
+		bare:     filepath.Join(dir, "repo.git"),
+	}
+	for _, d := range []string{r.workTree, r.bare} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := r.git(r.bare, "init", "--bare", "-q"); err != nil {
+		return nil, err
+	}
+	for _, args := range [][]string{
+		{"symbolic-ref", "HEAD", "refs/heads/main"},
+		// builds can fetch any commit, not only the tip of a ref
+		{"config", "uploadpack.allowAnySHA1InWant", "true"},
+		{"config", "http.receivepack", "false"},
+	} {
+		if _, err := r.git(r.bare, args...); err != nil {
+			return nil, err
+		}
+	}
+	for _, args := range [][]string{
+		{"init", "-q"},
+		{"symbolic-ref", "HEAD", "refs/heads/main"},
+		{"config", "user.name", "buildkit"},
+		{"config", "user.email", "buildkit@example.com"},
+		{"remote", "add", "origin", r.bare},
+	} {
+		if _, err := r.git(r.workTree, args...); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := r.Commit(bc, dockerfile, "initial"); err != nil {
+		return nil, err
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	srv := &http.Server{Handler: &cgi.Handler{
+		Path: git,
+		Args: []string{"http-backend"},
+		Env:  []string{"GIT_PROJECT_ROOT=" + dir, "GIT_HTTP_EXPORT_ALL=1"},
+	}}
+	go srv.Serve(l)
+	sb.Cleanup(srv.Close)
+
+	r.URL = "http://" + l.Addr().String() + "/repo.git"
+	return r, nil
+}
+
+// Commit replaces the files of the current branch with bc and dockerfile and
+// returns the hash of the new commit.
+func (r *GitRepo) Commit(bc BuildContext, dockerfile, message string) (string, error) {
+	entries, err := os.ReadDir(r.workTree)
+	if err != nil {
+		return "", err
+	}
+	for _, e := range entries {
+		if e.Name() == ".git" {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(r.workTree, e.Name())); err != nil {
+			return "", err
+		}
+	}
+	if err := (buildOpts{context: &bc}).writeContext(r.workTree, dockerfile); err != nil {
+		return "", err
+	}
+	if _, err := r.git(r.workTree, "add", "-A"); err != nil {
+		return "", err
+	}
+	if _, err := r.git(r.workTree, "commit", "-q", "--allow-empty", "-m", message); err != nil {
+		return "", err
+	}
+	if err := r.push(); err != nil {
+		return "", err
+	}
+	return r.git(r.workTree, "rev-parse", "HEAD")
+}
+
+// Branch creates the branch name at the current commit and switches to it,
+// so that following commits are made on it. An existing branch is switched
+// to without changing it.
+func (r *GitRepo) Branch(name string) error {
+	if _, err := r.git(r.workTree, "rev-parse", "-q", "--verify", "refs/heads/"+name); err == nil {
+		_, err := r.git(r.workTree, "checkout", "-q", name)
+		return err
+	}
+	if _, err := r.git(r.workTree, "checkout", "-q", "-b", name); err != nil {
+		return err
+	}
+	return r.push()
+}
+
+// Tag tags the current commit with name. The tag is annotated with message
+// unless it is empty.
+func (r *GitRepo) Tag(name, message string) error {
+	args := []string{"tag", name}
+	if message != "" {
+		args = []string{"tag", "-a", "-m", message, name}
+	}
+	if _, err := r.git(r.workTree, args...); err != nil {
+		return err
+	}
+	return r.push()
+}
+
+// ContextURL returns the URL of the repository at ref, that is a branch, a
+// tag or a commit, for the context option of the Dockerfile frontend. The
+// default branch is used if ref is empty.
+func (r *GitRepo) ContextURL(ref string) string {
+	if ref == "" {
+		return r.URL
+	}
+	return r.URL + "#" + ref
+}
+
+// ContextArgs returns the buildctl flags that build the Dockerfile of the
+// repository at ref, see ContextURL.
+func (r *GitRepo) ContextArgs(ref string) []string {
+	return []string{"--opt=context=" + r.ContextURL(ref)}
+}
+
+func (r *GitRepo) push() error {
+	_, err := r.git(r.workTree, "push", "-q", "--force", "origin", "refs/heads/*:refs/heads/*", "refs/tags/*:refs/tags/*")
+	return err
+}
+
+func (r *GitRepo) git(dir string, args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	// isolated from the configuration of the user running the tests
+	cmd.Env = append(os.Environ(), "GIT_CONFIG_NOSYSTEM=1", "HOME="+dir)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", errors.Wrapf(err, "git %s failed: %s", strings.Join(args, " "), bytes.TrimSpace(stderr.Bytes()))
+	}
+	return strings.TrimSpace(string(out)), nil
+}
@@ -0,0 +1,58 @@
+package integration
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGitRepo(t *testing.T) {
+	if err := lookupBinary("git"); err != nil {
+		t.Skip(err)
+	}
+	sb := newTestSandbox(t)
+
+	r, err := NewGitRepo(sb, BuildContext{Files: map[string][]byte{"foo": []byte("v1")}}, "FROM scratch\nCOPY foo /\n")
+	require.NoError(t, err)
+	require.True(t, strings.HasSuffix(r.URL, ".git"))
+	require.NoError(t, r.Tag("v1", "first release"))
+	require.NoError(t, r.Branch("feature"))
+	sha, err := r.Commit(BuildContext{Files: map[string][]byte{"bar": []byte("v2")}}, "FROM scratch\n", "second")
+	require.NoError(t, err)
+
+	clone := func(ref string) string {
+		dir := t.TempDir()
+		for _, args := range [][]string{
+			{"init", "-q"},
+			{"fetch", "-q", r.URL, ref},
+			{"checkout", "-q", "FETCH_HEAD"},
+		} {
+			cmd := exec.Command("git", args...)
+			cmd.Dir = dir
+			out, err := cmd.CombinedOutput()
+			require.NoError(t, err, string(out))
+		}
+		return dir
+	}
+
+	dir := clone("main")
+	require.FileExists(t, filepath.Join(dir, "foo"))
+	require.FileExists(t, filepath.Join(dir, "Dockerfile"))
+	require.NoFileExists(t, filepath.Join(dir, "bar"))
+
+	dir = clone("refs/tags/v1")
+	require.FileExists(t, filepath.Join(dir, "foo"))
+
+	dir = clone(sha)
+	require.NoFileExists(t, filepath.Join(dir, "foo"))
+	dt, err := os.ReadFile(filepath.Join(dir, "bar"))
+	require.NoError(t, err)
+	require.Equal(t, "v2", string(dt))
+
+	require.Equal(t, r.URL+"#feature", r.ContextURL("feature"))
+	require.Equal(t, []string{"--opt=context=" + r.URL}, r.ContextArgs(""))
+}
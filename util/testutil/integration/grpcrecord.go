@@ -0,0 +1,315 @@
+package integration
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// GRPCCall is a call to the daemon recorded with WithGRPCRecording. The
+// messages are kept in their wire encoding, so that they can be decoded
+// with the types of any version of the API. The messages of session streams
+// are not recorded, they carry the files of the build contexts.
+type GRPCCall struct {
+	// Method is the full name of the method, e.g.
+	// "/moby.buildkit.v1.Control/ListWorkers".
+	Method    string
+	Requests  [][]byte
+	Responses [][]byte
+	// Error is the status message of a failed call.
+	Error string `json:",omitempty"`
+}
+
+// sessionMethod is the bidirectional stream of the session of a solve, that
+// depends on the state of the client and can't be replayed.
+const sessionMethod = "/moby.buildkit.v1.Control/Session"
+
+// grpcMaxMsgSize is the limit of the size of messages passing through the
+// recording proxy.
+const grpcMaxMsgSize = 64 << 20
+
+// WithGRPCRecording returns a SandboxOpt that records the gRPC calls made to
+// the daemon into file, one JSON encoded GRPCCall per line, e.g. to replay
+// them against another version of the daemon with ReplayGRPC. Sandbox.Address
+// returns the address of the recording proxy, so that calls of the typed
+// client of clientutil are recorded together with those of buildctl invoked
+// through Sandbox.Cmd. Calls made while the daemon starts are not recorded.
+// Only daemons listening on a unix or tcp address are supported.
+func WithGRPCRecording(file string) SandboxOpt {
+	return grpcRecordingOpt(file)
+}
+
+type grpcRecordingOpt string
+
+func (o grpcRecordingOpt) UpdateBackendConfig(cfg *BackendConfig) {
+	cfg.grpcRecording = string(o)
+}
+
+// rawCodec passes messages through without decoding them.
+type rawCodec struct{}
+
+func (rawCodec) Marshal(v interface{}) ([]byte, error) {
+	p, ok := v.(*[]byte)
+	if !ok {
+		return nil, errors.Errorf("unexpected message type %T", v)
+	}
+	return *p, nil
+}
+
+func (rawCodec) Unmarshal(data []byte, v interface{}) error {
+	p, ok := v.(*[]byte)
+	if !ok {
+		return errors.Errorf("unexpected message type %T", v)
+	}
+	*p = append([]byte(nil), data...)
+	return nil
+}
+
+// Name is the name of the default codec so that the content type of the
+// calls is not changed by the proxy.
+func (rawCodec) Name() string {
+	return "proto"
+}
+
+// dialDaemon connects to the daemon at address, e.g. "unix:///run/buildkit/
+// buildkitd.sock", with the raw codec.
+func dialDaemon(address string) (*grpc.ClientConn, error) {
+	target := address
+	switch {
+	case strings.HasPrefix(address, "unix://"):
+	case strings.HasPrefix(address, "tcp://"):
+		target = strings.TrimPrefix(address, "tcp://")
+	default:
+		return nil, RequirementErrorf(SkipUnsupportedWorker, "recording gRPC calls is not supported for daemon address %s", address)
+	}
+	return grpc.Dial(target,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithDefaultCallOptions(
+			grpc.ForceCodec(rawCodec{}),
+			grpc.MaxCallRecvMsgSize(grpcMaxMsgSize),
+			grpc.MaxCallSendMsgSize(grpcMaxMsgSize),
+		),
+	)
+}
+
+// grpcRecorder is a proxy to the daemon that records the calls passing
+// through it.
+type grpcRecorder struct {
+	conn *grpc.ClientConn
+	mu   sync.Mutex
+	enc  *json.Encoder
+	err  error // first error writing the recording
+}
+
+// startGRPCRecorder starts a proxy to the daemon at address on a unix socket
+// in dir that records the calls into file. The address of the proxy is
+// returned.
+func startGRPCRecorder(address, dir, file string) (string, func() error, error) {
+	conn, err := dialDaemon(address)
+	if err != nil {
+		return "", nil, err
+	}
+	f, err := os.Create(file)
+	if err != nil {
+		conn.Close()
+		return "", nil, err
+	}
+	socket := filepath.Join(dir, "grpc-recorder.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		conn.Close()
+		f.Close()
+		return "", nil, err
+	}
+
+	r := &grpcRecorder{conn: conn, enc: json.NewEncoder(f)}
+	srv := grpc.NewServer(
+		grpc.ForceServerCodec(rawCodec{}),
+		grpc.UnknownServiceHandler(r.handle),
+		grpc.MaxRecvMsgSize(grpcMaxMsgSize),
+		grpc.MaxSendMsgSize(grpcMaxMsgSize),
+	)
+	go srv.Serve(l)
+
+	return "unix://" + socket, func() error {
+		srv.Stop()
+		conn.Close()
+		if err := f.Close(); err != nil {
+			return err
+		}
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		return errors.Wrapf(r.err, "failed to record gRPC calls to %s", file)
+	}, nil
+}
+
+func (r *grpcRecorder) handle(_ interface{}, ss grpc.ServerStream) error {
+	method, ok := grpc.MethodFromServerStream(ss)
+	if !ok {
+		return errors.New("unknown method")
+	}
+	call := &GRPCCall{Method: method}
+
+	ctx, cancel := context.WithCancel(ss.Context())
+	defer cancel()
+	md, _ := metadata.FromIncomingContext(ctx)
+	ctx = metadata.NewOutgoingContext(ctx, md.Copy())
+	cs, err := r.conn.NewStream(ctx, &grpc.StreamDesc{ServerStreams: true, ClientStreams: true}, method)
+	if err != nil {
+		call.Error = status.Convert(err).Message()
+		r.record(call)
+		return err
+	}
+
+	// the messages of the session are not kept in memory, they can be as
+	// large as the build context and the session can't be replayed anyway
+	keep := method != sessionMethod
+
+	// the stream of the client must not be used once handle returns, so the
+	// requests are forwarded until the client closes its side or cancels
+	// the call, which also ends the calls of the buildkit clients that wait
+	// for the response
+	sent := make(chan struct{})
+	go func() {
+		defer close(sent)
+		forward := true
+		for {
+			var m []byte
+			if err := ss.RecvMsg(&m); err != nil {
+				cs.CloseSend()
+				return
+			}
+			if !forward {
+				// the daemon ended the call, drain the client
+				continue
+			}
+			if keep {
+				call.Requests = append(call.Requests, m)
+			}
+			if err := cs.SendMsg(&m); err != nil {
+				forward = false
+			}
+		}
+	}()
+
+	hdr, err := cs.Header()
+	if err == nil {
+		err = ss.SendHeader(hdr)
+	}
+	for err == nil {
+		var m []byte
+		if err = cs.RecvMsg(&m); err != nil {
+			break
+		}
+		if keep {
+			call.Responses = append(call.Responses, m)
+		}
+		err = ss.SendMsg(&m)
+	}
+	ss.SetTrailer(cs.Trailer())
+	if err == io.EOF {
+		err = nil
+	} else {
+		call.Error = status.Convert(err).Message()
+	}
+	<-sent
+	r.record(call)
+	return err
+}
+
+func (r *grpcRecorder) record(call *GRPCCall) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.enc.Encode(call); err != nil && r.err == nil {
+		r.err = err
+	}
+}
+
+// ReadGRPCRecording reads the calls recorded with WithGRPCRecording.
+func ReadGRPCRecording(file string) ([]GRPCCall, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var calls []GRPCCall
+	dec := json.NewDecoder(bufio.NewReader(f))
+	for dec.More() {
+		var c GRPCCall
+		if err := dec.Decode(&c); err != nil {
+			return nil, errors.Wrapf(err, "invalid gRPC recording %s", file)
+		}
+		calls = append(calls, c)
+	}
+	return calls, nil
+}
+
+// ReplayGRPC sends the requests of the calls recorded in file to the daemon
+// at address, e.g. Sandbox.Address of a sandbox for another version, and
+// returns the calls with the responses of that daemon. Session streams are
+// skipped, so that solves depending on them fail. A call that fails is not
+// an error, its Error is set instead.
+func ReplayGRPC(ctx context.Context, address, file string) ([]GRPCCall, error) {
+	recorded, err := ReadGRPCRecording(file)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := dialDaemon(address)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	var out []GRPCCall
+	for _, c := range recorded {
+		if c.Method == sessionMethod {
+			continue
+		}
+		out = append(out, replayCall(ctx, conn, c))
+	}
+	return out, nil
+}
+
+func replayCall(ctx context.Context, conn *grpc.ClientConn, c GRPCCall) GRPCCall {
+	res := GRPCCall{Method: c.Method, Requests: c.Requests}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	cs, err := conn.NewStream(ctx, &grpc.StreamDesc{ServerStreams: true, ClientStreams: true}, c.Method)
+	if err == nil {
+		for _, m := range c.Requests {
+			m := m
+			if err = cs.SendMsg(&m); err != nil {
+				break
+			}
+		}
+		// the status of a failed call is returned by RecvMsg
+		if err == io.EOF {
+			err = nil
+		}
+		if err == nil {
+			err = cs.CloseSend()
+		}
+	}
+	for err == nil {
+		var m []byte
+		if err = cs.RecvMsg(&m); err == nil {
+			res.Responses = append(res.Responses, m)
+		}
+	}
+	if err != io.EOF {
+		res.Error = status.Convert(err).Message()
+	}
+	return res
+}
@@ -0,0 +1,166 @@
+package integration
+
+import (
+	"context"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	controlapi "github.com/moby/buildkit/api/services/control"
+	apitypes "github.com/moby/buildkit/api/types"
+	"github.com/moby/buildkit/client"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+func TestGRPCRecording(t *testing.T) {
+	dir := t.TempDir()
+
+	// health service standing in for the daemon
+	l, err := net.Listen("unix", filepath.Join(dir, "daemon.sock"))
+	require.NoError(t, err)
+	srv := grpc.NewServer()
+	hs := health.NewServer()
+	hs.SetServingStatus("buildkit", healthpb.HealthCheckResponse_SERVING)
+	healthpb.RegisterHealthServer(srv, hs)
+	go srv.Serve(l)
+	defer srv.Stop()
+	daemon := "unix://" + l.Addr().String()
+
+	file := filepath.Join(dir, "calls.json")
+	addr, cl, err := startGRPCRecorder(daemon, dir, file)
+	require.NoError(t, err)
+
+	conn, err := grpc.Dial(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	c := healthpb.NewHealthClient(conn)
+	resp, err := c.Check(context.TODO(), &healthpb.HealthCheckRequest{Service: "buildkit"})
+	require.NoError(t, err)
+	require.Equal(t, healthpb.HealthCheckResponse_SERVING, resp.Status)
+	_, err = c.Check(context.TODO(), &healthpb.HealthCheckRequest{Service: "unknown"})
+	require.Error(t, err)
+	conn.Close()
+	require.NoError(t, cl())
+
+	calls, err := ReadGRPCRecording(file)
+	require.NoError(t, err)
+	require.Len(t, calls, 2)
+	require.Equal(t, "/grpc.health.v1.Health/Check", calls[0].Method)
+	require.Len(t, calls[0].Requests, 1)
+	var req healthpb.HealthCheckRequest
+	require.NoError(t, proto.Unmarshal(calls[0].Requests[0], &req))
+	require.Equal(t, "buildkit", req.Service)
+	require.Len(t, calls[0].Responses, 1)
+	require.Empty(t, calls[0].Error)
+	require.Equal(t, "unknown service", calls[1].Error)
+
+	hs.SetServingStatus("buildkit", healthpb.HealthCheckResponse_NOT_SERVING)
+	replayed, err := ReplayGRPC(context.TODO(), daemon, file)
+	require.NoError(t, err)
+	require.Len(t, replayed, 2)
+	require.Len(t, replayed[0].Responses, 1)
+	var replayedResp healthpb.HealthCheckResponse
+	require.NoError(t, proto.Unmarshal(replayed[0].Responses[0], &replayedResp))
+	require.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, replayedResp.Status)
+	require.Equal(t, "unknown service", replayed[1].Error)
+}
+
+type fakeControl struct {
+	controlapi.UnimplementedControlServer
+}
+
+func (*fakeControl) ListWorkers(context.Context, *controlapi.ListWorkersRequest) (*controlapi.ListWorkersResponse, error) {
+	return &controlapi.ListWorkersResponse{Record: []*apitypes.WorkerRecord{{ID: "fake"}}}, nil
+}
+
+// Session echoes the messages of the client.
+func (*fakeControl) Session(s controlapi.Control_SessionServer) error {
+	for {
+		m, err := s.Recv()
+		if err != nil {
+			return nil
+		}
+		if err := s.Send(m); err != nil {
+			return err
+		}
+	}
+}
+
+func TestGRPCRecordingSession(t *testing.T) {
+	dir := t.TempDir()
+
+	l, err := net.Listen("unix", filepath.Join(dir, "daemon.sock"))
+	require.NoError(t, err)
+	srv := grpc.NewServer()
+	controlapi.RegisterControlServer(srv, &fakeControl{})
+	go srv.Serve(l)
+	defer srv.Stop()
+
+	file := filepath.Join(dir, "calls.json")
+	addr, cl, err := startGRPCRecorder("unix://"+l.Addr().String(), dir, file)
+	require.NoError(t, err)
+
+	conn, err := grpc.Dial(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	s, err := controlapi.NewControlClient(conn).Session(context.TODO())
+	require.NoError(t, err)
+	require.NoError(t, s.Send(&controlapi.BytesMessage{Data: []byte("context")}))
+	m, err := s.Recv()
+	require.NoError(t, err)
+	require.Equal(t, "context", string(m.Data))
+	require.NoError(t, s.CloseSend())
+	_, err = s.Recv()
+	require.Equal(t, io.EOF, err)
+	conn.Close()
+	require.NoError(t, cl())
+
+	// the call is recorded without the files sent over the session
+	calls, err := ReadGRPCRecording(file)
+	require.NoError(t, err)
+	require.Len(t, calls, 1)
+	require.Equal(t, sessionMethod, calls[0].Method)
+	require.Empty(t, calls[0].Requests)
+	require.Empty(t, calls[0].Responses)
+	require.Empty(t, calls[0].Error)
+}
+
+func TestGRPCRecordingTypedClient(t *testing.T) {
+	dir := t.TempDir()
+
+	l, err := net.Listen("unix", filepath.Join(dir, "daemon.sock"))
+	require.NoError(t, err)
+	srv := grpc.NewServer()
+	controlapi.RegisterControlServer(srv, &fakeControl{})
+	go srv.Serve(l)
+	defer srv.Stop()
+
+	file := filepath.Join(dir, "calls.json")
+	addr, cl, err := startGRPCRecorder("unix://"+l.Addr().String(), dir, file)
+	require.NoError(t, err)
+	sb := newTestSandbox(t)
+	sb.Backend = backend{address: "unix://" + l.Addr().String()}
+	sb.grpcRecorder = addr
+	require.Equal(t, addr, sb.Address())
+
+	c, err := client.New(context.TODO(), sb.Address())
+	require.NoError(t, err)
+	workers, err := c.ListWorkers(context.TODO())
+	require.NoError(t, err)
+	require.Len(t, workers, 1)
+	require.Equal(t, "fake", workers[0].ID)
+	require.NoError(t, c.Close())
+	require.NoError(t, cl())
+
+	calls, err := ReadGRPCRecording(file)
+	require.NoError(t, err)
+	require.Len(t, calls, 1)
+	require.Equal(t, "/moby.buildkit.v1.Control/ListWorkers", calls[0].Method)
+	var resp controlapi.ListWorkersResponse
+	require.NoError(t, proto.Unmarshal(calls[0].Responses[0], &resp))
+	require.Equal(t, "fake", resp.Record[0].ID)
+}
@@ -0,0 +1,71 @@
+package integration
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// CopyHeredoc returns a COPY instruction creating dst with the lines of
+// body in a heredoc terminated by delim, e.g. to test custom delimiters.
+// The content of the file is body followed by a newline.
+func CopyHeredoc(dst, delim, body string) string {
+	return fmt.Sprintf("COPY <<%s %s\n%s\n%s\n", delim, dst, body, delim)
+}
+
+// RunHeredoc returns a RUN instruction running script in a heredoc
+// terminated by delim. The script can contain heredocs itself as long as
+// they use other delimiters.
+func RunHeredoc(delim, script string) string {
+	return fmt.Sprintf("RUN <<%s\n%s\n%s\n", delim, script, delim)
+}
+
+// WithCRLF returns dockerfile with CRLF line endings, as written by editors
+// on Windows. The CRs are kept in the content of heredocs.
+func WithCRLF(dockerfile string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(dockerfile, "\r\n", "\n"), "\n", "\r\n")
+}
+
+// CheckFiles builds the last stage of dockerfile with BuildStage and
+// returns an error describing the differences if the files in files, by
+// path relative to the root of the stage, don't have the expected content.
+// Other files are ignored. The frontend is selected through the matrix, see
+// WithFrontendMatrix.
+func CheckFiles(sb Sandbox, dockerfile string, files map[string]string, opts ...BuildOpt) error {
+	dir, err := BuildStage(sb, dockerfile, "", opts...)
+	if err != nil {
+		return err
+	}
+	return compareFiles(dir, files)
+}
+
+func compareFiles(dir string, files map[string]string) error {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var diffs []string
+	for _, name := range names {
+		dt, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(name)))
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				diffs = append(diffs, fmt.Sprintf("%s: missing", name))
+				continue
+			}
+			return err
+		}
+		if string(dt) != files[name] {
+			// quoted so that differences in whitespace like CR are visible
+			diffs = append(diffs, fmt.Sprintf("%s: expected %q, got %q", name, files[name], dt))
+		}
+	}
+	if len(diffs) > 0 {
+		return errors.Errorf("unexpected files:\n%s", strings.Join(diffs, "\n"))
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package integration
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/moby/buildkit/frontend/dockerfile/parser"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHeredocInstructions(t *testing.T) {
+	copyFile := CopyHeredoc("/hello", "END_OF_FILE", "hello\nworld")
+	require.Equal(t, "COPY <<END_OF_FILE /hello\nhello\nworld\nEND_OF_FILE\n", copyFile)
+
+	run := RunHeredoc("OUTER", "cat <<INNER > /nested\ninner\nINNER")
+	dockerfile := "FROM busybox\n" + copyFile + run
+
+	for _, crlf := range []bool{false, true} {
+		df, eol := dockerfile, "\n"
+		if crlf {
+			df, eol = WithCRLF(dockerfile), "\r\n"
+		}
+		res, err := parser.Parse(strings.NewReader(df))
+		require.NoError(t, err)
+		nodes := res.AST.Children
+		require.Len(t, nodes, 3)
+
+		require.Len(t, nodes[1].Heredocs, 1)
+		require.Equal(t, "END_OF_FILE", nodes[1].Heredocs[0].Name)
+		require.Equal(t, "hello"+eol+"world"+eol, nodes[1].Heredocs[0].Content)
+
+		require.Len(t, nodes[2].Heredocs, 1)
+		require.Equal(t, "OUTER", nodes[2].Heredocs[0].Name)
+		require.Equal(t, strings.Join([]string{"cat <<INNER > /nested", "inner", "INNER", ""}, eol), nodes[2].Heredocs[0].Content)
+	}
+
+	require.Equal(t, "a\r\nb\r\n", WithCRLF("a\r\nb\n"))
+}
+
+func TestCompareFiles(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "sub"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "sub/a"), []byte("a\n"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "b"), []byte("b\r\n"), 0644))
+
+	require.NoError(t, compareFiles(dir, map[string]string{"sub/a": "a\n", "b": "b\r\n"}))
+
+	err := compareFiles(dir, map[string]string{"sub/a": "a\n", "b": "b\n", "c": ""})
+	require.Error(t, err)
+	require.Equal(t, "unexpected files:\nb: expected \"b\\n\", got \"b\\r\\n\"\nc: missing", err.Error())
+}
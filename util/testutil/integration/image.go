@@ -0,0 +1,268 @@
+package integration
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/platforms"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+	"github.com/moby/buildkit/identity"
+	"github.com/moby/buildkit/util/contentutil"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// BuildAndLoad builds dockerfile with the dockerfile frontend of the sandbox
+// daemon, exports the result with the docker exporter and loads it into the
+// Docker daemon reachable from the sandbox: the daemon itself for the dockerd
+// worker and the one configured through DOCKER_HOST otherwise. The image is
+// removed when the sandbox is closed.
+func BuildAndLoad(sb Sandbox, dockerfile string, opts ...BuildOpt) (imageID string, err error) {
+	ctx := sb.Context()
+
+	var bo buildOpts
+	for _, o := range opts {
+		o(&bo)
+	}
+	if err := bo.check(sb); err != nil {
+		return "", err
+	}
+
+	dockerAPI, err := dockerClient(sb)
+	if err != nil {
+		return "", err
+	}
+	if _, err := dockerAPI.Ping(ctx); err != nil {
+		dockerAPI.Close()
+		return "", RequirementErrorf(SkipMissingBinary, "docker daemon is not reachable: %v", err)
+	}
+	sb.Cleanup(dockerAPI.Close)
+
+	dir, err := os.MkdirTemp("", "buildkit-build-and-load")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(dir)
+	if err := bo.writeContext(dir, dockerfile); err != nil {
+		return "", err
+	}
+
+	name := "buildkit-integration/" + identity.NewID()[:shortLen] + ":latest"
+	tarball := filepath.Join(dir, "image.tar")
+	if err := buildDockerfile(sb, dir, "type=docker,name="+name+",dest="+tarball, bo); err != nil {
+		return "", err
+	}
+
+	f, err := os.Open(tarball)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	resp, err := dockerAPI.ImageLoad(ctx, f, true)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to load image")
+	}
+	resp.Body.Close()
+
+	img, _, err := dockerAPI.ImageInspectWithRaw(ctx, name)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to inspect loaded image %s", name)
+	}
+	sb.Cleanup(func() error {
+		_, err := dockerAPI.ImageRemove(ctx, img.ID, types.ImageRemoveOptions{Force: true, PruneChildren: true})
+		return err
+	})
+	return img.ID, nil
+}
+
+// BuildAndPush builds dockerfile with the dockerfile frontend of the sandbox
+// daemon and pushes the result to a new registry of the sandbox. The layers
+// are compressed as selected through the matrix, see CompressionOf, unless
+// WithCompression is used. The reference and manifest of the pushed image
+// are returned.
+func BuildAndPush(sb Sandbox, dockerfile string, opts ...BuildOpt) (ref string, mfst ocispecs.Manifest, err error) {
+	bo := buildOpts{compression: CompressionOf(sb)}
+	for _, o := range opts {
+		o(&bo)
+	}
+	if err := bo.check(sb); err != nil {
+		return "", ocispecs.Manifest{}, err
+	}
+
+	registry, err := sb.NewRegistry()
+	if err != nil {
+		return "", ocispecs.Manifest{}, err
+	}
+
+	dir, err := os.MkdirTemp("", "buildkit-build-and-push")
+	if err != nil {
+		return "", ocispecs.Manifest{}, err
+	}
+	defer os.RemoveAll(dir)
+	if err := bo.writeContext(dir, dockerfile); err != nil {
+		return "", ocispecs.Manifest{}, err
+	}
+
+	ref = registry + "/buildkit-integration/" + identity.NewID()[:shortLen] + ":latest"
+	if err := buildDockerfile(sb, dir, "type=image,name="+ref+",push=true", bo); err != nil {
+		return "", ocispecs.Manifest{}, err
+	}
+
+	ctx := sb.Context()
+	desc, provider, err := contentutil.ProviderFromRef(ref)
+	if err != nil {
+		return "", ocispecs.Manifest{}, err
+	}
+	mfst, err = images.Manifest(ctx, provider, desc, platforms.Default())
+	if err != nil {
+		return "", ocispecs.Manifest{}, errors.Wrapf(err, "failed to read manifest of %s", ref)
+	}
+	return ref, mfst, nil
+}
+
+// buildDockerfile builds the Dockerfile and context written to dir with
+// writeContext and exports the result with output. The frontend is selected
+// through the matrix, see FrontendOf.
+func buildDockerfile(sb Sandbox, dir, output string, bo buildOpts) error {
+	if bo.compression != "" {
+		output += "," + bo.compression.ExportAttrs()
+	}
+	args := append([]string{"build", "--output=" + output}, dockerfileArgs(sb, dir, bo)...)
+	cmd := sb.Cmd(args...)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return errors.Wrapf(err, "failed to build image: %s", out)
+	}
+	return nil
+}
+
+// dockerfileArgs returns the flags of buildctl build for building the
+// Dockerfile in dir with bo, without an output.
+func dockerfileArgs(sb Sandbox, dir string, bo buildOpts) []string {
+	contextDir, dockerfileDir := bo.dirs(dir)
+	args := append([]string{}, FrontendOf(sb).Args()...)
+	args = append(args,
+		"--local=context="+contextDir,
+		"--local=dockerfile="+dockerfileDir,
+	)
+	if bo.platform != "" {
+		args = append(args, "--opt=platform="+bo.platform)
+	}
+	if bo.target != "" {
+		args = append(args, "--opt=target="+bo.target)
+	}
+	args = append(args, addHostsOpt(sb)...)
+	return append(args, bo.args...)
+}
+
+// BuildOpt configures BuildAndLoad, BuildAndPush, BuildStage and
+// BuildProgress.
+type BuildOpt func(*buildOpts)
+
+type buildOpts struct {
+	platform              string
+	compression           Compression
+	target                string
+	args                  []string // additional flags of buildctl build
+	context               *BuildContext
+	separateDockerfileDir bool
+}
+
+// dirs returns the directories of the build context and the Dockerfile of a
+// build in dir. They are the same unless WithSeparateDockerfileDir is used.
+func (bo buildOpts) dirs(dir string) (contextDir, dockerfileDir string) {
+	if bo.separateDockerfileDir {
+		return filepath.Join(dir, "context"), filepath.Join(dir, "dockerfile")
+	}
+	return dir, dir
+}
+
+// writeContext writes the build context and dockerfile to dir.
+func (bo buildOpts) writeContext(dir, dockerfile string) error {
+	contextDir, dockerfileDir := bo.dirs(dir)
+	if bo.separateDockerfileDir {
+		for _, d := range []string{contextDir, dockerfileDir} {
+			if err := os.Mkdir(d, 0755); err != nil {
+				return err
+			}
+		}
+	}
+	if bo.context != nil {
+		// the Dockerfile of the context is not the one that is built
+		if _, ok := bo.context.Files["Dockerfile"]; ok && !bo.separateDockerfileDir {
+			return errors.New("build context must not contain a Dockerfile")
+		}
+		if err := bo.context.WriteTo(contextDir); err != nil {
+			return err
+		}
+	}
+	return os.WriteFile(filepath.Join(dockerfileDir, "Dockerfile"), []byte(dockerfile), 0600)
+}
+
+func (bo buildOpts) check(sb Sandbox) error {
+	if bo.platform != "" {
+		if err := RequirePlatforms(bo.platform)(sb); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WithCompression compresses the layers of the exported image with c.
+func WithCompression(c Compression) BuildOpt {
+	return func(bo *buildOpts) {
+		bo.compression = c
+	}
+}
+
+// WithContext builds with the files of bc in the build context. The
+// Dockerfile is added to the context by the build helpers.
+func WithContext(bc BuildContext) BuildOpt {
+	return func(bo *buildOpts) {
+		bo.context = &bc
+	}
+}
+
+// WithSeparateDockerfileDir passes the Dockerfile to the frontend in a
+// directory of its own instead of the directory of the build context. The
+// context may then contain a file called Dockerfile that is not built.
+//
+// It stands in for "docker build -f - <dir>". buildctl only reads an LLB
+// definition from stdin, not a Dockerfile for a frontend, so the Dockerfile
+// is written to a temporary directory and sent as the dockerfile local
+// source, which is what buildx does with a Dockerfile read from stdin.
+func WithSeparateDockerfileDir() BuildOpt {
+	return func(bo *buildOpts) {
+		bo.separateDockerfileDir = true
+	}
+}
+
+// WithTarget builds the stage target of the Dockerfile instead of the last
+// one.
+func WithTarget(target string) BuildOpt {
+	return func(bo *buildOpts) {
+		bo.target = target
+	}
+}
+
+// WithBuildPlatform builds the image for platform, e.g. "linux/arm64".
+// BuildAndLoad returns an error wrapping ErrRequirements if the platform
+// can't be built natively or through emulation, see RequirePlatforms.
+func WithBuildPlatform(platform string) BuildOpt {
+	return func(bo *buildOpts) {
+		bo.platform = platform
+	}
+}
+
+// dockerClient returns a client for the Docker daemon that is reachable
+// from the sandbox.
+func dockerClient(sb Sandbox) (*client.Client, error) {
+	opts := []client.Opt{client.FromEnv, client.WithAPIVersionNegotiation()}
+	if s, ok := sb.(*sandbox); ok {
+		if b, ok := s.Backend.(backend); ok && b.dockerAddress != "" {
+			opts = append(opts, client.WithHost(b.dockerAddress))
+		}
+	}
+	return client.NewClientWithOpts(opts...)
+}
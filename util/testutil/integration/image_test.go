@@ -0,0 +1,30 @@
+package integration
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteContextSeparateDockerfileDir(t *testing.T) {
+	dir := t.TempDir()
+	var bo buildOpts
+	WithSeparateDockerfileDir()(&bo)
+	WithContext(BuildContext{Files: map[string][]byte{"Dockerfile": []byte("FROM busybox")}})(&bo)
+	require.NoError(t, bo.writeContext(dir, "FROM scratch"))
+
+	contextDir, dockerfileDir := bo.dirs(dir)
+	require.NotEqual(t, contextDir, dockerfileDir)
+	dt, err := os.ReadFile(filepath.Join(contextDir, "Dockerfile"))
+	require.NoError(t, err)
+	require.Equal(t, "FROM busybox", string(dt))
+	dt, err = os.ReadFile(filepath.Join(dockerfileDir, "Dockerfile"))
+	require.NoError(t, err)
+	require.Equal(t, "FROM scratch", string(dt))
+
+	args := dockerfileArgs(newTestSandbox(t), dir, bo)
+	require.Contains(t, args, "--local=context="+contextDir)
+	require.Contains(t, args, "--local=dockerfile="+dockerfileDir)
+}
@@ -0,0 +1,53 @@
+package integration
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/platforms"
+	"github.com/moby/buildkit/util/contentutil"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// ImageConfig returns the config of the image ref for the platform of the
+// host, e.g. pushed to a registry of the sandbox with BuildAndPush, to check
+// the effect of instructions like ENV, ENTRYPOINT and LABEL.
+func ImageConfig(ctx context.Context, ref string) (ocispecs.Image, error) {
+	desc, provider, err := contentutil.ProviderFromRef(ref)
+	if err != nil {
+		return ocispecs.Image{}, err
+	}
+	mfst, err := images.Manifest(ctx, provider, desc, platforms.Default())
+	if err != nil {
+		return ocispecs.Image{}, errors.Wrapf(err, "failed to read manifest of %s", ref)
+	}
+	dt, err := content.ReadBlob(ctx, provider, mfst.Config)
+	if err != nil {
+		return ocispecs.Image{}, errors.Wrapf(err, "failed to read config of %s", ref)
+	}
+	var img ocispecs.Image
+	if err := json.Unmarshal(dt, &img); err != nil {
+		return ocispecs.Image{}, errors.Wrapf(err, "invalid config of %s", ref)
+	}
+	return img, nil
+}
+
+// ConfigEnv returns the environment of the image config img by name. Values
+// keep newlines and later duplicates override earlier ones like in a
+// container.
+func ConfigEnv(img ocispecs.Image) map[string]string {
+	env := map[string]string{}
+	for _, kv := range img.Config.Env {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) == 1 {
+			env[parts[0]] = ""
+			continue
+		}
+		env[parts[0]] = parts[1]
+	}
+	return env
+}
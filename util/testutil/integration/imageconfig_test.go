@@ -0,0 +1,27 @@
+package integration
+
+import (
+	"testing"
+
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfigEnv(t *testing.T) {
+	var img ocispecs.Image
+	img.Config.Env = []string{
+		"PATH=/usr/local/bin:/usr/bin",
+		"MULTI=line1\nline2",
+		"EMPTY=",
+		"NOVALUE",
+		"A=b=c",
+		"A=d",
+	}
+	require.Equal(t, map[string]string{
+		"PATH":    "/usr/local/bin:/usr/bin",
+		"MULTI":   "line1\nline2",
+		"EMPTY":   "",
+		"NOVALUE": "",
+		"A":       "d",
+	}, ConfigEnv(img))
+}
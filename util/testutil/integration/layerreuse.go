@@ -0,0 +1,89 @@
+package integration
+
+import (
+	"fmt"
+	"strings"
+
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// LayerReuse compares the layers of an image built before and after a
+// change, see BuildLayerReuse.
+type LayerReuse struct {
+	Before ocispecs.Manifest
+	After  ocispecs.Manifest
+	// Reused are the indexes of the layers of After that have the same
+	// digest as the layer at the same index of Before.
+	Reused []int
+	// FirstChanged is the index of the first layer of After that differs
+	// from Before, or -1 if the layers are the same.
+	FirstChanged int
+}
+
+// BuildLayerReuse pushes dockerfile built with the context before, then
+// again with the context after, with BuildAndPush and compares the layers
+// of the two images. The context of both builds should differ only in the
+// files that a test expects to invalidate a layer.
+func BuildLayerReuse(sb Sandbox, dockerfile string, before, after BuildContext, opts ...BuildOpt) (LayerReuse, error) {
+	_, mfstBefore, err := BuildAndPush(sb, dockerfile, append(opts, WithContext(before))...)
+	if err != nil {
+		return LayerReuse{}, errors.Wrap(err, "failed to build before the change")
+	}
+	_, mfstAfter, err := BuildAndPush(sb, dockerfile, append(opts, WithContext(after))...)
+	if err != nil {
+		return LayerReuse{}, errors.Wrap(err, "failed to build after the change")
+	}
+	return DiffLayers(mfstBefore, mfstAfter), nil
+}
+
+// DiffLayers compares the layers of the manifests before and after by
+// index.
+func DiffLayers(before, after ocispecs.Manifest) LayerReuse {
+	r := LayerReuse{Before: before, After: after, FirstChanged: -1}
+	for i, l := range after.Layers {
+		if i < len(before.Layers) && before.Layers[i].Digest == l.Digest {
+			r.Reused = append(r.Reused, i)
+		} else if r.FirstChanged == -1 {
+			r.FirstChanged = i
+		}
+	}
+	if r.FirstChanged == -1 && len(before.Layers) > len(after.Layers) {
+		r.FirstChanged = len(after.Layers)
+	}
+	return r
+}
+
+// CheckFirstChanged returns an error listing the layers of both images if
+// the first changed layer is not at index i. Layers before i are expected
+// to be reused. Use -1 if no layer is expected to change.
+func (r LayerReuse) CheckFirstChanged(i int) error {
+	if r.FirstChanged == i {
+		return nil
+	}
+	return errors.Errorf("expected first changed layer %d, got %d\n%s", i, r.FirstChanged, r)
+}
+
+// String returns the digests of the layers of both images side by side.
+func (r LayerReuse) String() string {
+	n := len(r.Before.Layers)
+	if len(r.After.Layers) > n {
+		n = len(r.After.Layers)
+	}
+	var buf strings.Builder
+	for i := 0; i < n; i++ {
+		var before, after string
+		if i < len(r.Before.Layers) {
+			before = r.Before.Layers[i].Digest.String()
+		}
+		if i < len(r.After.Layers) {
+			after = r.After.Layers[i].Digest.String()
+		}
+		mark := " "
+		if before != after {
+			mark = "*"
+		}
+		fmt.Fprintf(&buf, "%s %d: %s %s\n", mark, i, before, after)
+	}
+	return buf.String()
+}
@@ -0,0 +1,38 @@
+package integration
+
+import (
+	"testing"
+
+	digest "github.com/opencontainers/go-digest"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiffLayers(t *testing.T) {
+	mfst := func(layers ...string) ocispecs.Manifest {
+		var m ocispecs.Manifest
+		for _, l := range layers {
+			m.Layers = append(m.Layers, ocispecs.Descriptor{Digest: digest.FromString(l)})
+		}
+		return m
+	}
+
+	r := DiffLayers(mfst("a", "b", "c"), mfst("a", "b", "c"))
+	require.Equal(t, []int{0, 1, 2}, r.Reused)
+	require.NoError(t, r.CheckFirstChanged(-1))
+
+	r = DiffLayers(mfst("a", "b", "c"), mfst("a", "x", "c"))
+	require.Equal(t, []int{0, 2}, r.Reused)
+	require.NoError(t, r.CheckFirstChanged(1))
+	err := r.CheckFirstChanged(2)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "expected first changed layer 2, got 1")
+	require.Contains(t, err.Error(), "* 1: "+digest.FromString("b").String()+" "+digest.FromString("x").String())
+
+	r = DiffLayers(mfst("a", "b"), mfst("a"))
+	require.Equal(t, []int{0}, r.Reused)
+	require.Equal(t, 1, r.FirstChanged)
+
+	r = DiffLayers(mfst("a"), mfst("a", "b"))
+	require.Equal(t, 1, r.FirstChanged)
+}
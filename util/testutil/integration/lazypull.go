@@ -0,0 +1,135 @@
+package integration
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/platforms"
+	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/docker/distribution/reference"
+	"github.com/moby/buildkit/util/contentutil"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+// LazyPullOpt configures CheckLazyPull.
+type LazyPullOpt func(*lazyPullOpts)
+
+type lazyPullOpts struct {
+	file string
+}
+
+// WithLazyFile makes CheckLazyPull fetch the file at path, e.g. "etc/foo",
+// from the topmost layer containing it with HTTP range requests. The check
+// fails if the whole blob of the layer has to be transferred to read it.
+func WithLazyFile(path string) LazyPullOpt {
+	return func(o *lazyPullOpts) {
+		o.file = path
+	}
+}
+
+// CheckLazyPull returns an error if the image ref, e.g. in the mirror or in
+// a registry started with Sandbox.NewRegistry, can't be pulled lazily. All
+// layers must have the media type and TOC annotation of estargz, see
+// CompressionEStargz, and the TOC of every layer must match its annotation.
+// The registry is accessed with plain HTTP.
+func CheckLazyPull(ctx context.Context, ref string, opts ...LazyPullOpt) error {
+	var o lazyPullOpts
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	named, err := reference.ParseNormalizedNamed(ref)
+	if err != nil {
+		return errors.Wrapf(err, "invalid reference %s", ref)
+	}
+
+	desc, provider, err := contentutil.ProviderFromRef(ref)
+	if err != nil {
+		return err
+	}
+	mfst, err := images.Manifest(ctx, provider, desc, platforms.Default())
+	if err != nil {
+		return errors.Wrapf(err, "failed to read manifest of %s", ref)
+	}
+	if err := CompressionEStargz.CheckLayers(mfst); err != nil {
+		return errors.Wrapf(err, "%s can't be pulled lazily", ref)
+	}
+
+	blobURL := fmt.Sprintf("http://%s/v2/%s/blobs/", reference.Domain(named), reference.Path(named))
+	found := false
+	// the topmost layer wins, like in the rootfs of a container
+	for i := len(mfst.Layers) - 1; i >= 0; i-- {
+		l := mfst.Layers[i]
+		ra := &rangeReaderAt{ctx: ctx, url: blobURL + l.Digest.String()}
+		r, err := estargz.Open(io.NewSectionReader(ra, 0, l.Size))
+		if err != nil {
+			return errors.Wrapf(err, "failed to read TOC of layer %d", i)
+		}
+		if expected := l.Annotations[estargz.TOCJSONDigestAnnotation]; r.TOCDigest() != digest.Digest(expected) {
+			return errors.Errorf("layer %d has TOC digest %s, annotation is %s", i, r.TOCDigest(), expected)
+		}
+		if o.file == "" || found {
+			continue
+		}
+		if _, ok := r.Lookup(o.file); !ok {
+			continue
+		}
+		found = true
+		sr, err := r.OpenFile(o.file)
+		if err != nil {
+			return errors.Wrapf(err, "failed to open %s in layer %d", o.file, i)
+		}
+		if _, err := io.Copy(io.Discard, io.NewSectionReader(sr, 0, sr.Size())); err != nil {
+			return errors.Wrapf(err, "failed to read %s from layer %d", o.file, i)
+		}
+		if n := ra.fetched(); n >= l.Size {
+			return errors.Errorf("reading %s fetched %d bytes of layer %d, the whole blob is %d bytes", o.file, n, i, l.Size)
+		}
+	}
+	if o.file != "" && !found {
+		return errors.Errorf("%s not found in %s", o.file, ref)
+	}
+	return nil
+}
+
+// rangeReaderAt reads a blob with a range request for every call to ReadAt.
+// Registries that ignore the Range header cause an error.
+type rangeReaderAt struct {
+	ctx context.Context
+	url string
+	n   int64 // bytes received
+}
+
+func (r *rangeReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	req, err := http.NewRequestWithContext(r.ctx, http.MethodGet, r.url, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", off, off+int64(len(p))-1))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent {
+		return 0, errors.Errorf("range request for %s returned %s", r.url, resp.Status)
+	}
+	n, err := io.ReadFull(resp.Body, p)
+	atomic.AddInt64(&r.n, int64(n))
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (r *rangeReaderAt) fetched() int64 {
+	return atomic.LoadInt64(&r.n)
+}
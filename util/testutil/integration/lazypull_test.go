@@ -0,0 +1,39 @@
+package integration
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRangeReaderAt(t *testing.T) {
+	blob := bytes.Repeat([]byte("0123456789"), 1000)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(blob))
+	}))
+	defer srv.Close()
+
+	ra := &rangeReaderAt{ctx: context.TODO(), url: srv.URL}
+	dt, err := io.ReadAll(io.NewSectionReader(ra, 5003, 4))
+	require.NoError(t, err)
+	require.Equal(t, "3456", string(dt))
+	require.Equal(t, int64(4), ra.fetched())
+
+	p := make([]byte, 10)
+	n, err := ra.ReadAt(p, int64(len(blob))-5)
+	require.Equal(t, io.EOF, err)
+	require.Equal(t, "56789", string(p[:n]))
+
+	noRange := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(blob)
+	}))
+	defer noRange.Close()
+	_, err = (&rangeReaderAt{ctx: context.TODO(), url: noRange.URL}).ReadAt(make([]byte, 10), 0)
+	require.Error(t, err)
+}
@@ -0,0 +1,155 @@
+package integration
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/moby/buildkit/identity"
+)
+
+// leakCheckEnabled reports whether Run fails if processes or containers
+// started for the sandboxes are still running after all of them were
+// closed. It is enabled with BUILDKIT_TEST_LEAK_CHECK=1.
+func leakCheckEnabled() bool {
+	return os.Getenv("BUILDKIT_TEST_LEAK_CHECK") == "1"
+}
+
+const leakMarkerEnv = "BUILDKIT_INTEGRATION_LEAK_MARKER"
+
+// leakMarker is set in the environment of the processes started by this
+// test binary so that their descendants can be found even if they moved to
+// another process group, as long as they inherited the environment.
+var leakMarker = leakMarkerEnv + "=" + identity.NewID()
+
+// spawned records what was started for the sandboxes of this test binary.
+var spawned = struct {
+	mu         sync.Mutex
+	sessions   map[int]struct{} // pids of started processes, daemons lead their own session
+	containers map[string]struct{}
+}{sessions: map[int]struct{}{}, containers: map[string]struct{}{}}
+
+// markSpawned adds the leak marker to the environment of cmd before it is
+// started.
+func markSpawned(cmd *exec.Cmd) {
+	if !leakCheckEnabled() {
+		return
+	}
+	if cmd.Env == nil {
+		cmd.Env = os.Environ()
+	}
+	cmd.Env = append(cmd.Env, leakMarker)
+}
+
+func recordSpawned(pid int) {
+	if !leakCheckEnabled() {
+		return
+	}
+	spawned.mu.Lock()
+	defer spawned.mu.Unlock()
+	spawned.sessions[pid] = struct{}{}
+}
+
+func recordContainer(name string) {
+	if !leakCheckEnabled() {
+		return
+	}
+	spawned.mu.Lock()
+	defer spawned.mu.Unlock()
+	spawned.containers[name] = struct{}{}
+}
+
+// procInfo describes a running process for the leak check.
+type procInfo struct {
+	session int
+	marked  bool // leakMarker is in the environment
+	cmdline string
+}
+
+// installLeakCheck registers a cleanup on tb that fails it if processes that
+// were not running before, and that were started for the sandboxes or by
+// their daemons, are still running or if containers of the sandboxes still
+// exist. Processes are given some time to exit after the sandboxes were
+// closed. Tests running in parallel with tb in another Run call would be
+// reported as well.
+func installLeakCheck(tb testing.TB) {
+	if !leakCheckEnabled() {
+		return
+	}
+	before, err := listProcesses()
+	if err != nil {
+		tb.Logf("leak check disabled: %v", err)
+		return
+	}
+	tb.Cleanup(func() {
+		var leaks []string
+		err := eventually(tb, func() (bool, error) {
+			var err error
+			leaks, err = findLeaks(before)
+			return len(leaks) == 0, err
+		}, 10*time.Second, 100*time.Millisecond)
+		if err == nil {
+			return
+		}
+		if len(leaks) == 0 {
+			tb.Errorf("leak check failed: %v", err)
+			return
+		}
+		for _, l := range leaks {
+			tb.Errorf("%s was left running after the sandboxes were closed", l)
+		}
+	})
+}
+
+func findLeaks(before map[int]procInfo) ([]string, error) {
+	procs, err := listProcesses()
+	if err != nil {
+		return nil, err
+	}
+	spawned.mu.Lock()
+	sessions := make(map[int]struct{}, len(spawned.sessions))
+	for pid := range spawned.sessions {
+		sessions[pid] = struct{}{}
+	}
+	containers := make([]string, 0, len(spawned.containers))
+	for name := range spawned.containers {
+		containers = append(containers, name)
+	}
+	spawned.mu.Unlock()
+
+	var leaks []string
+	for pid, p := range procs {
+		if _, ok := before[pid]; ok || pid == os.Getpid() {
+			continue
+		}
+		if _, ok := sessions[p.session]; ok || p.marked {
+			leaks = append(leaks, fmt.Sprintf("process %d (%s)", pid, p.cmdline))
+		}
+	}
+	sort.Strings(leaks)
+
+	sort.Strings(containers)
+	for _, name := range containers {
+		// inspect fails once the container was removed
+		if err := exec.Command(dockerBinary, "inspect", "--type=container", name).Run(); err == nil {
+			leaks = append(leaks, "container "+name)
+		}
+	}
+	return leaks, nil
+}
+
+// hasLeakMarker reports whether env, as read from /proc/<pid>/environ,
+// contains leakMarker.
+func hasLeakMarker(env []byte) bool {
+	for _, kv := range strings.Split(string(env), "\x00") {
+		if kv == leakMarker {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,40 @@
+//go:build linux
+// +build linux
+
+package integration
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+func listProcesses() (map[int]procInfo, error) {
+	dirs, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+	procs := map[int]procInfo{}
+	for _, d := range dirs {
+		pid, err := strconv.Atoi(d.Name())
+		if err != nil {
+			continue
+		}
+		st, err := readProcStat(pid)
+		if err != nil || st.state == "Z" {
+			// process exited while scanning or wasn't reaped yet
+			continue
+		}
+		p := procInfo{session: st.session}
+		// the environment of processes of other users can't be read
+		if env, err := os.ReadFile(filepath.Join("/proc", d.Name(), "environ")); err == nil {
+			p.marked = hasLeakMarker(env)
+		}
+		if cmdline, err := os.ReadFile(filepath.Join("/proc", d.Name(), "cmdline")); err == nil {
+			p.cmdline = string(bytes.TrimSpace(bytes.ReplaceAll(cmdline, []byte{0}, []byte{' '})))
+		}
+		procs[pid] = p
+	}
+	return procs, nil
+}
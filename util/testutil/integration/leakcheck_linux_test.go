@@ -0,0 +1,57 @@
+//go:build linux
+// +build linux
+
+package integration
+
+import (
+	"bufio"
+	"io"
+	"os/exec"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFindLeaks(t *testing.T) {
+	t.Setenv("BUILDKIT_TEST_LEAK_CHECK", "1")
+	before, err := listProcesses()
+	require.NoError(t, err)
+
+	// the child of the shell only inherits the marker
+	cmd := exec.Command("sh", "-c", "sleep 60 & echo $!; wait")
+	cmd.SysProcAttr = getSysProcAttr()
+	cmd.Stderr = io.Discard
+	rc, err := cmd.StdoutPipe()
+	require.NoError(t, err)
+	stop, err := startCmdWithOpts(cmd, nil, stopOpts{force: true})
+	require.NoError(t, err)
+
+	line, err := bufio.NewReader(rc).ReadString('\n')
+	require.NoError(t, err)
+	child, err := strconv.Atoi(strings.TrimSpace(line))
+	require.NoError(t, err)
+
+	sleep := "process " + strconv.Itoa(child) + " (sleep 60)"
+	var leaks []string
+	// the child may not have executed sleep yet
+	Eventually(t, func() (bool, error) {
+		leaks, err = findLeaks(before)
+		return contains(leaks, sleep), err
+	}, 10*time.Second, 10*time.Millisecond)
+	require.Contains(t, leaks, "process "+strconv.Itoa(cmd.Process.Pid)+" (sh -c sleep 60 & echo $!; wait)")
+
+	// killing the shell leaves the sleep behind
+	require.NoError(t, stop())
+	leaks, err = findLeaks(before)
+	require.NoError(t, err)
+	require.Equal(t, []string{sleep}, leaks)
+
+	require.NoError(t, exec.Command("kill", strconv.Itoa(child)).Run())
+	Eventually(t, func() (bool, error) {
+		leaks, err := findLeaks(before)
+		return len(leaks) == 0, err
+	}, 10*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package integration
+
+import (
+	"runtime"
+
+	"github.com/pkg/errors"
+)
+
+func listProcesses() (map[int]procInfo, error) {
+	return nil, errors.Errorf("listing processes is not supported on %s", runtime.GOOS)
+}
@@ -0,0 +1,70 @@
+package integration
+
+import (
+	"bytes"
+	"io"
+	"os/exec"
+	"path/filepath"
+	"sync"
+)
+
+// WithLiveLogs returns a SandboxOpt that copies the output of the daemon
+// processes to w while they run, in addition to keeping it for PrintLogs.
+// Every line is prefixed with the process name and stream, e.g.
+// "buildkitd stderr: ". This helps to watch a daemon when a test hangs.
+func WithLiveLogs(w io.Writer) SandboxOpt {
+	return liveLogsOpt{w: &liveLogs{w: w}}
+}
+
+type liveLogsOpt struct {
+	w *liveLogs
+}
+
+func (o liveLogsOpt) UpdateBackendConfig(cfg *BackendConfig) {
+	cfg.liveLogs = o.w
+}
+
+// liveLogs serializes the lines written by several processes.
+type liveLogs struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// streamLogs makes startCmd copy the output of cmd to the live logs of cfg
+// if they are enabled.
+func streamLogs(cmd *exec.Cmd, cfg *BackendConfig) {
+	if cfg.liveLogs == nil {
+		return
+	}
+	name := filepath.Base(cmd.Path)
+	cmd.Stdout = &lineWriter{l: cfg.liveLogs, prefix: name + " stdout: "}
+	cmd.Stderr = &lineWriter{l: cfg.liveLogs, prefix: name + " stderr: "}
+}
+
+// lineWriter writes complete lines to the live logs so that the output of
+// different processes is not interleaved within a line.
+type lineWriter struct {
+	l      *liveLogs
+	prefix string
+	mu     sync.Mutex
+	buf    []byte
+}
+
+func (w *lineWriter) Write(dt []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.buf = append(w.buf, dt...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		// errors are ignored so that the live logs can't break the
+		// process writing them
+		w.l.mu.Lock()
+		io.WriteString(w.l.w, w.prefix+string(w.buf[:i+1]))
+		w.l.mu.Unlock()
+		w.buf = w.buf[i+1:]
+	}
+	return len(dt), nil
+}
@@ -0,0 +1,27 @@
+package integration
+
+import (
+	"bytes"
+	"os/exec"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLiveLogs(t *testing.T) {
+	var out bytes.Buffer
+	cfg := &BackendConfig{}
+	WithLiveLogs(&out).UpdateBackendConfig(cfg)
+
+	cmd := exec.Command("buildkitd")
+	streamLogs(cmd, cfg)
+	cmd.Stderr.Write([]byte("first li"))
+	require.Empty(t, out.String())
+	cmd.Stdout.Write([]byte("out\n"))
+	cmd.Stderr.Write([]byte("ne\nsecond line\n"))
+	require.Equal(t, "buildkitd stdout: out\nbuildkitd stderr: first line\nbuildkitd stderr: second line\n", out.String())
+
+	cmd = exec.Command("buildkitd")
+	streamLogs(cmd, &BackendConfig{})
+	require.Nil(t, cmd.Stdout)
+}
@@ -0,0 +1,60 @@
+package integration
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// LocalCache is a directory used with the local cache exporter and
+// importer.
+type LocalCache struct {
+	Dir string
+}
+
+// NewLocalCache creates an empty cache directory under the temp directory of
+// the sandbox that is removed when the sandbox is closed. If keep is set the
+// directory is created in the system temp directory instead and is not
+// removed, e.g. to inspect it after the test.
+func NewLocalCache(sb Sandbox, keep bool) (*LocalCache, error) {
+	parent := sb.TempDir()
+	if keep {
+		parent = ""
+	}
+	dir, err := os.MkdirTemp(parent, "buildkit-cache")
+	if err != nil {
+		return nil, err
+	}
+	return &LocalCache{Dir: dir}, nil
+}
+
+// ExportArgs returns the buildctl flags exporting the cache to the
+// directory.
+func (c *LocalCache) ExportArgs() []string {
+	return []string{"--export-cache=type=local,mode=max,dest=" + c.Dir}
+}
+
+// ImportArgs returns the buildctl flags importing the cache from the
+// directory. No flags are returned while the cache has not been exported.
+func (c *LocalCache) ImportArgs() []string {
+	if _, err := os.Stat(filepath.Join(c.Dir, "index.json")); err != nil {
+		return nil
+	}
+	return []string{"--import-cache=type=local,src=" + c.Dir}
+}
+
+// Build runs "buildctl build" in the sandbox with args, importing the cache
+// from the directory if it was exported before and exporting it again.
+func (c *LocalCache) Build(sb Sandbox, args ...string) error {
+	args = append(append([]string{"build"}, args...), c.ImportArgs()...)
+	args = append(args, c.ExportArgs()...)
+	_, stderr, code, err := sb.Exec(args...)
+	if err != nil {
+		return err
+	}
+	if code != 0 {
+		return errors.Errorf("buildctl build failed with exit code %d: %s", code, stderr)
+	}
+	return nil
+}
@@ -0,0 +1,23 @@
+package integration
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLocalCache(t *testing.T) {
+	sb := newTestSandbox(t)
+	c, err := NewLocalCache(sb, false)
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(c.Dir, sb.tempDir))
+
+	require.Equal(t, []string{"--export-cache=type=local,mode=max,dest=" + c.Dir}, c.ExportArgs())
+	require.Empty(t, c.ImportArgs())
+
+	require.NoError(t, os.WriteFile(filepath.Join(c.Dir, "index.json"), []byte("{}"), 0600))
+	require.Equal(t, []string{"--import-cache=type=local,src=" + c.Dir}, c.ImportArgs())
+}
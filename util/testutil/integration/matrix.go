@@ -0,0 +1,169 @@
+package integration
+
+import (
+	"math/rand"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// parseMatrixFilter parses a comma-separated list of dimension=value pairs
+// that restrict the matrix to the combinations using these values.
+func parseMatrixFilter(s string) (map[string]string, error) {
+	if s == "" {
+		return nil, nil
+	}
+	m := map[string]string{}
+	for _, kv := range strings.Split(s, ",") {
+		kv = strings.TrimSpace(kv)
+		if kv == "" {
+			continue
+		}
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, errors.Errorf("invalid BUILDKIT_MATRIX entry %q, expected dimension=value", kv)
+		}
+		m[parts[0]] = parts[1]
+	}
+	return m, nil
+}
+
+// sampleMatrix returns n combinations of m selected with seed, keeping their
+// order.
+func sampleMatrix(m []matrixValue, n int, seed int64) []matrixValue {
+	if n <= 0 || n >= len(m) {
+		return m
+	}
+	idx := rand.New(rand.NewSource(seed)).Perm(len(m))[:n]
+	sort.Ints(idx)
+	out := make([]matrixValue, 0, n)
+	for _, i := range idx {
+		out = append(out, m[i])
+	}
+	return out
+}
+
+type matrixValue struct {
+	fn     []string
+	values map[string]matrixValueChoice
+}
+
+func (mv matrixValue) functionSuffix() string {
+	if len(mv.fn) == 0 {
+		return ""
+	}
+	// sorted copy, mv is shared by parallel tests
+	fn := append([]string(nil), mv.fn...)
+	sort.Strings(fn)
+	sb := &strings.Builder{}
+	for _, f := range fn {
+		sb.Write([]byte("/" + f + "=" + mv.values[f].name))
+	}
+	return sb.String()
+}
+
+// valueMap returns the chosen values keyed by the matrix dimension.
+func (mv matrixValue) valueMap() map[string]interface{} {
+	m := make(map[string]interface{}, len(mv.values))
+	for k, v := range mv.values {
+		m[k] = v.value
+	}
+	return m
+}
+
+func (mv matrixValue) rootless() bool {
+	for _, v := range mv.values {
+		if v.value == RootlessEnabled {
+			return true
+		}
+	}
+	return false
+}
+
+type matrixValueChoice struct {
+	name  string
+	value interface{}
+}
+
+func newMatrixValue(key, name string, v interface{}) matrixValue {
+	return matrixValue{
+		fn: []string{key},
+		values: map[string]matrixValueChoice{
+			key: {
+				name:  name,
+				value: v,
+			},
+		},
+	}
+}
+
+func prepareValueMatrix(tc testConf) ([]matrixValue, error) {
+	features := make([]string, 0, len(tc.matrix))
+	for featureName := range tc.matrix {
+		features = append(features, featureName)
+	}
+	sort.Strings(features)
+
+	for k, v := range tc.matrixFilter {
+		values, ok := tc.matrix[k]
+		if !ok {
+			return nil, errors.Errorf("unknown matrix dimension %q in BUILDKIT_MATRIX, available: %s", k, strings.Join(features, ", "))
+		}
+		if _, ok := values[v]; !ok {
+			return nil, errors.Errorf("unknown value %q for matrix dimension %q in BUILDKIT_MATRIX", v, k)
+		}
+	}
+
+	m := []matrixValue{}
+	for _, featureName := range features {
+		values := tc.matrix[featureName]
+		names := make([]string, 0, len(values))
+		for featureValue := range values {
+			if v, ok := tc.matrixFilter[featureName]; ok && v != featureValue {
+				continue
+			}
+			names = append(names, featureValue)
+		}
+		sort.Strings(names)
+
+		current := m
+		m = []matrixValue{}
+		for _, featureValue := range names {
+			v := values[featureValue]
+			if len(current) == 0 {
+				m = append(m, newMatrixValue(featureName, featureValue, v))
+			}
+			for _, c := range current {
+				vv := newMatrixValue(featureName, featureValue, v)
+				vv.fn = append(vv.fn, c.fn...)
+				for k, v := range c.values {
+					vv.values[k] = v
+				}
+				m = append(m, vv)
+			}
+		}
+	}
+	if len(m) == 0 {
+		m = append(m, matrixValue{})
+	}
+
+	if len(tc.matrixExclude) > 0 {
+		filtered := m[:0]
+	loop:
+		for _, mv := range m {
+			values := mv.valueMap()
+			for _, exclude := range tc.matrixExclude {
+				if exclude(values) {
+					continue loop
+				}
+			}
+			filtered = append(filtered, mv)
+		}
+		if len(filtered) == 0 {
+			return nil, errors.Errorf("all %d matrix combinations are excluded", len(m))
+		}
+		m = filtered
+	}
+	return m, nil
+}
@@ -0,0 +1,154 @@
+package integration
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrepareValueMatrixOrder(t *testing.T) {
+	tc := testConf{
+		matrix: map[string]map[string]interface{}{
+			"b": {"y": 1, "x": 2},
+			"a": {"2": 3, "1": 4, "3": 5},
+		},
+	}
+
+	names := matrixNames(t, tc)
+	require.Equal(t, []string{
+		"/a=1/b=x",
+		"/a=2/b=x",
+		"/a=3/b=x",
+		"/a=1/b=y",
+		"/a=2/b=y",
+		"/a=3/b=y",
+	}, names)
+
+	for i := 0; i < 10; i++ {
+		require.Equal(t, names, matrixNames(t, tc))
+	}
+}
+
+func TestPrepareValueMatrixExclude(t *testing.T) {
+	tc := testConf{
+		matrix: map[string]map[string]interface{}{
+			"a": {"1": 1, "2": 2},
+			"b": {"x": "x", "y": "y"},
+		},
+	}
+	WithMatrixExclude(func(m map[string]interface{}) bool {
+		return m["a"] == 2 && m["b"] == "y"
+	})(&tc)
+
+	require.Equal(t, []string{
+		"/a=1/b=x",
+		"/a=2/b=x",
+		"/a=1/b=y",
+	}, matrixNames(t, tc))
+
+	WithMatrixExclude(func(m map[string]interface{}) bool {
+		return true
+	})(&tc)
+	_, err := prepareValueMatrix(tc)
+	require.Error(t, err)
+}
+
+func matrixNames(t *testing.T, tc testConf) []string {
+	m, err := prepareValueMatrix(tc)
+	require.NoError(t, err)
+	var names []string
+	for _, mv := range m {
+		names = append(names, mv.functionSuffix())
+	}
+	return names
+}
+
+func TestSampleMatrix(t *testing.T) {
+	tc := testConf{
+		matrix: map[string]map[string]interface{}{
+			"a": {"1": 1, "2": 2},
+			"b": {"1": 1, "2": 2},
+			"c": {"1": 1, "2": 2},
+		},
+	}
+	m, err := prepareValueMatrix(tc)
+	require.NoError(t, err)
+	require.Len(t, m, 8)
+
+	names := func(m []matrixValue) []string {
+		var out []string
+		for _, mv := range m {
+			out = append(out, mv.functionSuffix())
+		}
+		return out
+	}
+
+	sample := sampleMatrix(m, 3, 42)
+	require.Len(t, sample, 3)
+	require.Equal(t, names(sample), names(sampleMatrix(m, 3, 42)))
+
+	require.Len(t, sampleMatrix(m, 0, 42), 8)
+	require.Len(t, sampleMatrix(m, 10, 42), 8)
+}
+
+func TestFunctionSuffixUnique(t *testing.T) {
+	tc := testConf{
+		matrix: map[string]map[string]interface{}{
+			"b": {"true": true, "false": false},
+			"a": {"true": true, "false": false},
+			"c": {"true": true},
+		},
+	}
+	names := matrixNames(t, tc)
+	require.Equal(t, []string{
+		"/a=false/b=false/c=true",
+		"/a=true/b=false/c=true",
+		"/a=false/b=true/c=true",
+		"/a=true/b=true/c=true",
+	}, names)
+
+	seen := map[string]struct{}{}
+	for _, n := range names {
+		_, ok := seen[n]
+		require.False(t, ok, "duplicate subtest name %s", n)
+		seen[n] = struct{}{}
+	}
+
+	// functionSuffix must not reorder the dimensions of a shared value
+	mv := newMatrixValue("b", "x", 1)
+	mv.fn = append(mv.fn, "a")
+	mv.values["a"] = matrixValueChoice{name: "y", value: 2}
+	require.Equal(t, "/a=y/b=x", mv.functionSuffix())
+	require.Equal(t, []string{"b", "a"}, mv.fn)
+}
+
+func TestMatrixFilter(t *testing.T) {
+	tc := testConf{
+		matrix: map[string]map[string]interface{}{
+			"gc":          {"on": true, "off": false},
+			"compression": {"gzip": "gzip", "zstd": "zstd"},
+		},
+	}
+
+	var err error
+	tc.matrixFilter, err = parseMatrixFilter("gc=on, compression=zstd")
+	require.NoError(t, err)
+	require.Equal(t, []string{"/compression=zstd/gc=on"}, matrixNames(t, tc))
+
+	tc.matrixFilter, err = parseMatrixFilter("gc=off")
+	require.NoError(t, err)
+	require.Equal(t, []string{"/compression=gzip/gc=off", "/compression=zstd/gc=off"}, matrixNames(t, tc))
+
+	tc.matrixFilter, err = parseMatrixFilter("gc=maybe")
+	require.NoError(t, err)
+	_, err = prepareValueMatrix(tc)
+	require.Error(t, err)
+
+	tc.matrixFilter, err = parseMatrixFilter("snapshotter=native")
+	require.NoError(t, err)
+	_, err = prepareValueMatrix(tc)
+	require.Error(t, err)
+
+	_, err = parseMatrixFilter("gc")
+	require.Error(t, err)
+}
@@ -0,0 +1,114 @@
+package integration
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/pkg/errors"
+)
+
+const (
+	minioUser   = "buildkit"
+	minioPass   = "buildkit-secret"
+	minioBucket = "registry"
+	minioRegion = "us-east-1"
+)
+
+// NewMinio starts a minio server with an empty bucket and returns the
+// storage for NewRegistryWithStorage or WithMirrorStorage that keeps the
+// data of a registry in the bucket. The server and its data are removed by
+// cl. ErrRequirements is returned if the minio binary is not in PATH.
+func NewMinio() (storage RegistryStorage, cl func() error, err error) {
+	if err := lookupBinary("minio"); err != nil {
+		return RegistryStorage{}, nil, err
+	}
+
+	deferF := &multiCloser{}
+	cl = deferF.F()
+
+	defer func() {
+		if err != nil {
+			deferF.F()()
+			cl = nil
+		}
+	}()
+
+	dir, err := os.MkdirTemp("", "bktest_minio")
+	if err != nil {
+		return RegistryStorage{}, nil, err
+	}
+	deferF.append(func() error { return os.RemoveAll(dir) })
+
+	port, err := freePort()
+	if err != nil {
+		return RegistryStorage{}, nil, err
+	}
+	address := "127.0.0.1:" + strconv.Itoa(port)
+	endpoint := "http://" + address
+
+	cmd := exec.Command("minio", "server", "--quiet", "--address", address, dir)
+	cmd.Env = append(os.Environ(), "MINIO_ROOT_USER="+minioUser, "MINIO_ROOT_PASSWORD="+minioPass)
+	stop, err := startCmd(cmd, nil)
+	if err != nil {
+		return RegistryStorage{}, nil, err
+	}
+	deferF.append(stop)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	if err := waitMinio(ctx, endpoint); err != nil {
+		return RegistryStorage{}, nil, err
+	}
+
+	client := s3.New(s3.Options{
+		Region:           minioRegion,
+		Credentials:      credentials.NewStaticCredentialsProvider(minioUser, minioPass, ""),
+		EndpointResolver: s3.EndpointResolverFromURL(endpoint),
+		UsePathStyle:     true,
+	})
+	if _, err := client.CreateBucket(ctx, &s3.CreateBucketInput{Bucket: aws.String(minioBucket)}); err != nil {
+		return RegistryStorage{}, nil, errors.Wrap(err, "failed to create minio bucket")
+	}
+
+	return RegistryStorage{
+		Driver: "s3",
+		Params: map[string]string{
+			"accesskey":      minioUser,
+			"secretkey":      minioPass,
+			"region":         minioRegion,
+			"regionendpoint": endpoint,
+			"bucket":         minioBucket,
+			"secure":         "false",
+		},
+	}, cl, nil
+}
+
+// waitMinio polls the liveness endpoint of the minio server at endpoint
+// until it responds or ctx is done.
+func waitMinio(ctx context.Context, endpoint string) error {
+	for {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint+"/minio/health/live", nil)
+		if err != nil {
+			return err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				return nil
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return errors.Wrapf(ctx.Err(), "minio at %s did not start up", endpoint)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package integration
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/containerd/containerd/platforms"
+	"github.com/gofrs/flock"
+	"github.com/moby/buildkit/identity"
+	digest "github.com/opencontainers/go-digest"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+// memRegistry is a minimal in-memory registry that counts uploads.
+type memRegistry struct {
+	mu        sync.Mutex
+	blobs     map[string][]byte // name@digest
+	manifests map[string]memManifest
+	uploads   map[string]int // blob and manifest uploads by repository
+}
+
+type memManifest struct {
+	mediaType string
+	dt        []byte
+}
+
+func newMemRegistry(t *testing.T) (*memRegistry, string) {
+	r := &memRegistry{
+		blobs:     map[string][]byte{},
+		manifests: map[string]memManifest{},
+		uploads:   map[string]int{},
+	}
+	srv := httptest.NewServer(r)
+	t.Cleanup(srv.Close)
+	return r, strings.Replace(srv.Listener.Addr().String(), "127.0.0.1", "localhost", 1)
+}
+
+func (r *memRegistry) uploadCount(name string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.uploads[name]
+}
+
+func (r *memRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	// uploads are streamed so the body is read before locking, the client
+	// may make other requests until it is complete
+	dt, err := io.ReadAll(req.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	p := strings.TrimPrefix(req.URL.Path, "/v2/")
+	if p == "" {
+		return
+	}
+	if i := strings.LastIndex(p, "/manifests/"); i >= 0 {
+		name, ref := p[:i], p[i+len("/manifests/"):]
+		switch req.Method {
+		case http.MethodPut:
+			m := memManifest{mediaType: req.Header.Get("Content-Type"), dt: dt}
+			dgst := digest.FromBytes(dt)
+			r.manifests[name+":"+ref] = m
+			r.manifests[name+"@"+dgst.String()] = m
+			r.uploads[name]++
+			w.Header().Set("Docker-Content-Digest", dgst.String())
+			w.WriteHeader(http.StatusCreated)
+		default:
+			key := name + ":" + ref
+			if strings.HasPrefix(ref, "sha256:") {
+				key = name + "@" + ref
+			}
+			m, ok := r.manifests[key]
+			if !ok {
+				http.NotFound(w, req)
+				return
+			}
+			w.Header().Set("Content-Type", m.mediaType)
+			w.Header().Set("Docker-Content-Digest", digest.FromBytes(m.dt).String())
+			w.Header().Set("Content-Length", strconv.Itoa(len(m.dt)))
+			if req.Method == http.MethodGet {
+				w.Write(m.dt)
+			}
+		}
+		return
+	}
+	if i := strings.LastIndex(p, "/blobs/uploads/"); i >= 0 {
+		name := p[:i]
+		switch req.Method {
+		case http.MethodPost:
+			w.Header().Set("Location", "/v2/"+name+"/blobs/uploads/"+identity.NewID())
+			w.WriteHeader(http.StatusAccepted)
+		case http.MethodPut:
+			dgst := req.URL.Query().Get("digest")
+			r.blobs[name+"@"+dgst] = dt
+			r.uploads[name]++
+			w.Header().Set("Docker-Content-Digest", dgst)
+			w.WriteHeader(http.StatusCreated)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+		return
+	}
+	if i := strings.LastIndex(p, "/blobs/"); i >= 0 {
+		blob, ok := r.blobs[p[:i]+"@"+p[i+len("/blobs/"):]]
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(blob)))
+		if req.Method == http.MethodGet {
+			w.Write(blob)
+		}
+		return
+	}
+	http.NotFound(w, req)
+}
+
+func TestCopyImagesLocalSequentialHolders(t *testing.T) {
+	reg, host := newMemRegistry(t)
+	_, err := SeedRegistry(t, host, "src/a:latest", [][]byte{[]byte("layer1"), []byte("layer2")})
+	require.NoError(t, err)
+	_, err = SeedRegistry(t, host, "src/b:latest", [][]byte{[]byte("layer1"), []byte("layer3")})
+	require.NoError(t, err)
+
+	lockDir := t.TempDir()
+	// every holder runs as if it was another test binary using the same
+	// mirror directory
+	holder := func(images map[string]string) {
+		lock := flock.New(filepath.Join(lockDir, "lock"))
+		require.NoError(t, lock.Lock())
+		defer lock.Unlock()
+
+		localImageCacheMu.Lock()
+		localImageCache = nil
+		localImageCacheMu.Unlock()
+
+		require.NoError(t, copyImagesLocal(t, host, images))
+	}
+
+	holder(map[string]string{"library/a:latest": host + "/src/a:latest"})
+	// config, two layers and the manifest
+	require.Equal(t, 4, reg.uploadCount("library/a"))
+
+	holder(map[string]string{"library/a:latest": host + "/src/a:latest"})
+	require.Equal(t, 4, reg.uploadCount("library/a"), "second holder copied the image again")
+
+	// blobs already in the repository are not uploaded again
+	holder(map[string]string{"library/a:v2": host + "/src/b:latest"})
+	require.Equal(t, 4+3, reg.uploadCount("library/a"))
+}
+
+func TestIndexHasPlatform(t *testing.T) {
+	// platforms of docker.io/library/busybox
+	var idx ocispecs.Index
+	for _, p := range []string{"linux/amd64", "linux/arm/v5", "linux/arm/v6", "linux/arm/v7", "linux/arm64/v8", "linux/386", "linux/ppc64le", "linux/s390x"} {
+		pp := platforms.MustParse(p)
+		idx.Manifests = append(idx.Manifests, ocispecs.Descriptor{Platform: &pp})
+	}
+
+	for _, goarch := range []string{"amd64", "arm", "arm64", "386", "ppc64le", "s390x"} {
+		p := platforms.Normalize(ocispecs.Platform{OS: "linux", Architecture: goarch})
+		require.NoError(t, indexHasPlatform(idx, p, "docker.io/library/busybox:latest"), goarch)
+	}
+
+	p := platforms.Normalize(ocispecs.Platform{OS: "linux", Architecture: "riscv64"})
+	err := indexHasPlatform(idx, p, "docker.io/library/busybox:latest")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "docker.io/library/busybox:latest has no image for linux/riscv64, available platforms: linux/amd64, linux/arm/v5")
+}
+
+func TestRunMirrorReleasesLockOnError(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("BUILDKIT_REGISTRY_MIRROR_DIR", dir)
+
+	_, _, err := runMirror(t, map[string]string{
+		"library/missing": "local:" + filepath.Join(dir, "missing.tar"),
+	}, nil)
+	require.Error(t, err)
+
+	lock := flock.New(filepath.Join(dir, "lock"))
+	locked, err := lock.TryLock()
+	require.NoError(t, err)
+	require.True(t, locked)
+	require.NoError(t, lock.Unlock())
+}
@@ -0,0 +1,126 @@
+package integration
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// WithNoCache builds all stages without using the build cache.
+func WithNoCache() BuildOpt {
+	return func(bo *buildOpts) {
+		bo.args = append(bo.args, "--no-cache")
+	}
+}
+
+// WithNoCacheFilter builds the stages called names without using the build
+// cache. The Dockerfile frontend matches the names case-insensitively
+// against the names of the stages only, a name that is an image reference
+// used by FROM or an unnamed stage doesn't match any stage. Stages depending
+// on the busted ones are rebuilt as their inputs change.
+func WithNoCacheFilter(names ...string) BuildOpt {
+	return func(bo *buildOpts) {
+		bo.args = append(bo.args, "--opt=no-cache="+strings.Join(names, ","))
+	}
+}
+
+// BuildProgress builds dockerfile without exporting the result and returns
+// the progress of the solve, see CaptureProgress. Builds in the same sandbox
+// share the build cache, so that RebuiltStages of the progress shows which
+// stages were not cached.
+func BuildProgress(sb Sandbox, dockerfile string, opts ...BuildOpt) (ProgressOutput, error) {
+	var bo buildOpts
+	for _, o := range opts {
+		o(&bo)
+	}
+	if err := bo.check(sb); err != nil {
+		return ProgressOutput{}, err
+	}
+
+	dir, err := os.MkdirTemp(sb.TempDir(), "progress-context")
+	if err != nil {
+		return ProgressOutput{}, err
+	}
+	defer os.RemoveAll(dir)
+	if err := bo.writeContext(dir, dockerfile); err != nil {
+		return ProgressOutput{}, err
+	}
+	return CaptureProgress(sb, dockerfileArgs(sb, dir, bo)...)
+}
+
+// traceVertex is the JSON encoding of client.Vertex.
+type traceVertex struct {
+	Digest    string
+	Name      string
+	Completed *time.Time
+	Cached    bool
+}
+
+// stepName matches the names the Dockerfile frontend gives to the steps of a
+// stage, e.g. "[build 2/3] RUN make". The name of the stage is missing if
+// the Dockerfile has a single stage, and is preceded by the platform in
+// multi-platform builds.
+var stepName = regexp.MustCompile(`^\[(?:(\S+) )*\d+/\d+\] `)
+
+// RebuiltStages returns the sorted names of the stages that had a step that
+// was executed instead of being loaded from the build cache. Unnamed stages
+// are called "stage-<index>" by the Dockerfile frontend, and the only stage
+// of a Dockerfile with a single stage is called "".
+func (p ProgressOutput) RebuiltStages() ([]string, error) {
+	vertexes := map[string]traceVertex{}
+	var order []string
+	dec := json.NewDecoder(bytes.NewReader(p.JSON))
+	for dec.More() {
+		var st struct {
+			Vertexes []traceVertex
+		}
+		if err := dec.Decode(&st); err != nil {
+			return nil, errors.Wrap(err, "failed to decode progress")
+		}
+		for _, v := range st.Vertexes {
+			if _, ok := vertexes[v.Digest]; !ok {
+				order = append(order, v.Digest)
+			}
+			vertexes[v.Digest] = v
+		}
+	}
+
+	rebuilt := map[string]struct{}{}
+	for _, dgst := range order {
+		v := vertexes[dgst]
+		if v.Completed == nil || v.Cached {
+			continue
+		}
+		name, ok := stageOfStep(v.Name)
+		if !ok {
+			continue
+		}
+		rebuilt[name] = struct{}{}
+	}
+	out := make([]string, 0, len(rebuilt))
+	for name := range rebuilt {
+		out = append(out, name)
+	}
+	sort.Strings(out)
+	return out, nil
+}
+
+// stageOfStep returns the stage of the step called name, or false if name
+// isn't the name of a step of a stage, e.g. "[internal] load .dockerignore".
+func stageOfStep(name string) (string, bool) {
+	m := stepName.FindStringSubmatch(name)
+	if m == nil {
+		return "", false
+	}
+	// stage names can't contain "/" unlike platforms
+	if strings.Contains(m[1], "/") {
+		return "", true
+	}
+	return m[1], true
+}
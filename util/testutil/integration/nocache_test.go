@@ -0,0 +1,54 @@
+package integration
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNoCacheOpts(t *testing.T) {
+	var bo buildOpts
+	WithNoCache()(&bo)
+	WithNoCacheFilter("build", "Test")(&bo)
+	require.Equal(t, []string{"--no-cache", "--opt=no-cache=build,Test"}, bo.args)
+}
+
+func TestStageOfStep(t *testing.T) {
+	for name, exp := range map[string]string{
+		"[build 2/3] RUN make":                                "build",
+		"[stage-0 1/2] FROM docker.io/library/busybox:latest": "stage-0",
+		"[1/2] RUN true":                                      "",
+		"[linux/arm64 build 10/12] COPY . .":                  "build",
+		"[linux/arm64 1/2] RUN true":                          "",
+	} {
+		stage, ok := stageOfStep(name)
+		require.True(t, ok, name)
+		require.Equal(t, exp, stage, name)
+	}
+	for _, name := range []string{
+		"[internal] load build definition from Dockerfile",
+		"exporting to image",
+	} {
+		_, ok := stageOfStep(name)
+		require.False(t, ok, name)
+	}
+}
+
+func TestRebuiltStages(t *testing.T) {
+	p := ProgressOutput{
+		JSON: []byte(`{"Vertexes":[{"Digest":"sha256:1","Name":"[internal] load metadata for docker.io/library/busybox:latest","Completed":"2022-08-01T10:00:00Z"}]}
+{"Vertexes":[{"Digest":"sha256:2","Name":"[base 1/2] FROM docker.io/library/busybox:latest","Completed":"2022-08-01T10:00:00Z","Cached":true}]}
+{"Vertexes":[{"Digest":"sha256:3","Name":"[base 2/2] RUN echo base","Completed":"2022-08-01T10:00:00Z","Cached":true}]}
+{"Vertexes":[{"Digest":"sha256:4","Name":"[test 1/1] RUN echo test","Started":"2022-08-01T10:00:00Z"}]}
+{"Vertexes":[{"Digest":"sha256:4","Name":"[test 1/1] RUN echo test","Started":"2022-08-01T10:00:00Z","Completed":"2022-08-01T10:00:01Z"}]}
+{"Vertexes":[{"Digest":"sha256:5","Name":"[build 1/1] RUN echo build","Started":"2022-08-01T10:00:00Z","Completed":"2022-08-01T10:00:01Z"}]}
+`),
+	}
+	stages, err := p.RebuiltStages()
+	require.NoError(t, err)
+	require.Equal(t, []string{"build", "test"}, stages)
+
+	stages, err = ProgressOutput{}.RebuiltStages()
+	require.NoError(t, err)
+	require.Empty(t, stages)
+}
@@ -22,6 +22,7 @@ func InitOCIWorker() {
 		}
 		if rootlessSupported(uid) {
 			Register(&oci{uid: uid, gid: gid})
+			rootlessIDPair = &[2]int{uid, gid}
 		}
 	}
 
@@ -30,6 +31,10 @@ func InitOCIWorker() {
 	}
 }
 
+// rootlessIDPair is the uid and gid used when rootless mode is selected
+// through the matrix for a worker that is not rootless by itself.
+var rootlessIDPair *[2]int
+
 type oci struct {
 	uid         int
 	gid         int
@@ -51,33 +56,57 @@ func (s *oci) Rootless() bool {
 }
 
 func (s *oci) New(ctx context.Context, cfg *BackendConfig) (Backend, func() error, error) {
-	if err := lookupBinary("buildkitd"); err != nil {
+	if err := lookupBinary(cfg.buildkitdBinary()); err != nil {
 		return nil, nil, err
 	}
 	if err := requireRoot(); err != nil {
 		return nil, nil, err
 	}
 	// Include use of --oci-worker-labels to trigger https://github.com/moby/buildkit/pull/603
-	buildkitdArgs := []string{"buildkitd", "--oci-worker=true", "--containerd-worker=false", "--oci-worker-gc=false", "--oci-worker-labels=org.mobyproject.buildkit.worker.sandbox=true"}
+	uid, gid := s.uid, s.gid
+	if cfg.Rootless && uid == 0 {
+		if rootlessIDPair == nil {
+			return nil, nil, RequirementErrorf(SkipMissingKernelFeature, "rootless mode is not supported on this host")
+		}
+		uid, gid = rootlessIDPair[0], rootlessIDPair[1]
+	}
+	net, err := rootlessNet(cfg, uid != 0)
+	if err != nil {
+		return nil, nil, err
+	}
 
-	if s.snapshotter != "" {
+	snapshotter, err := selectSnapshotter(cfg, s.snapshotter)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	buildkitdArgs := []string{cfg.buildkitdBinary(), "--oci-worker=true", "--containerd-worker=false", "--oci-worker-gc=false", "--oci-worker-labels=org.mobyproject.buildkit.worker.sandbox=true"}
+
+	if snapshotter != "" {
 		buildkitdArgs = append(buildkitdArgs,
-			fmt.Sprintf("--oci-worker-snapshotter=%s", s.snapshotter))
+			fmt.Sprintf("--oci-worker-snapshotter=%s", snapshotter))
 	}
 
-	if s.uid != 0 {
-		if s.gid == 0 {
-			return nil, nil, errors.Errorf("unsupported id pair: uid=%d, gid=%d", s.uid, s.gid)
+	if uid != 0 {
+		if gid == 0 {
+			return nil, nil, errors.Errorf("unsupported id pair: uid=%d, gid=%d", uid, gid)
 		}
 		// TODO: make sure the user exists and subuid/subgid are configured.
-		buildkitdArgs = append([]string{"sudo", "-u", fmt.Sprintf("#%d", s.uid), "-i", "--", "exec", "rootlesskit"}, buildkitdArgs...)
+		rootlesskitArgs := []string{"sudo", "-u", fmt.Sprintf("#%d", uid), "-i", "--", "exec", "rootlesskit"}
+		if net != "" {
+			rootlesskitArgs = append(rootlesskitArgs, "--net="+net)
+			if net != "host" {
+				rootlesskitArgs = append(rootlesskitArgs, "--copy-up=/etc")
+			}
+		}
+		buildkitdArgs = append(rootlesskitArgs, buildkitdArgs...)
 	}
 
 	var extraEnv []string
-	if runtime.GOOS != "windows" && s.snapshotter != "native" {
+	if runtime.GOOS != "windows" && snapshotter != "native" {
 		extraEnv = append(extraEnv, "BUILDKIT_DEBUG_FORCE_OVERLAY_DIFF=true")
 	}
-	buildkitdSock, stop, err := runBuildkitd(ctx, cfg, buildkitdArgs, cfg.Logs, s.uid, s.gid, extraEnv)
+	buildkitdSock, daemon, stop, err := runBuildkitd(ctx, cfg, buildkitdArgs, cfg.Logs, uid, gid, extraEnv)
 	if err != nil {
 		printLogs(cfg.Logs, log.Println)
 		return nil, nil, err
@@ -85,7 +114,8 @@ func (s *oci) New(ctx context.Context, cfg *BackendConfig) (Backend, func() erro
 
 	return backend{
 		address:     buildkitdSock,
-		rootless:    s.uid != 0,
-		snapshotter: s.snapshotter,
+		rootless:    uid != 0,
+		snapshotter: snapshotter,
+		daemon:      daemon,
 	}, stop, nil
 }
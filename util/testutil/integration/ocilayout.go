@@ -0,0 +1,174 @@
+package integration
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/content/local"
+	"github.com/containerd/containerd/images"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// OCILayout is a directory with an OCI image layout, e.g. exported by a
+// build with ExportOCILayout.
+type OCILayout struct {
+	Dir   string
+	Index ocispecs.Index
+}
+
+// ExportOCILayout runs buildctl build with args, e.g. the frontend and
+// --local flags, exports the result with the OCI exporter and unpacks it
+// into a new directory under the temp directory of the sandbox. If keep is
+// set the directory is created in the system temp directory instead and is
+// not removed, e.g. to inspect it after the test. The layout is validated
+// with ReadOCILayout.
+func ExportOCILayout(sb Sandbox, keep bool, args ...string) (*OCILayout, error) {
+	parent := sb.TempDir()
+	if keep {
+		parent = ""
+	}
+	dir, err := os.MkdirTemp(parent, "buildkit-oci")
+	if err != nil {
+		return nil, err
+	}
+
+	tarball := dir + ".tar"
+	defer os.Remove(tarball)
+	args = append([]string{"build", "--output=type=oci,dest=" + tarball}, args...)
+	cmd := sb.Cmd(args...)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return nil, errors.Wrapf(err, "failed to export oci layout: %s", out)
+	}
+
+	f, err := os.Open(tarball)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if err := untar(f, dir); err != nil {
+		return nil, errors.Wrap(err, "failed to unpack oci layout")
+	}
+	return ReadOCILayout(sb.Context(), dir)
+}
+
+// ReadOCILayout reads the OCI image layout in dir. An error is returned if
+// the oci-layout file or index.json are invalid, or if a blob referenced
+// from the index is missing or doesn't match its descriptor.
+func ReadOCILayout(ctx context.Context, dir string) (*OCILayout, error) {
+	dt, err := os.ReadFile(filepath.Join(dir, ocispecs.ImageLayoutFile))
+	if err != nil {
+		return nil, err
+	}
+	var layout ocispecs.ImageLayout
+	if err := json.Unmarshal(dt, &layout); err != nil {
+		return nil, errors.Wrapf(err, "invalid %s", ocispecs.ImageLayoutFile)
+	}
+	if layout.Version != ocispecs.ImageLayoutVersion {
+		return nil, errors.Errorf("unsupported oci layout version %q", layout.Version)
+	}
+
+	dt, err = os.ReadFile(filepath.Join(dir, "index.json"))
+	if err != nil {
+		return nil, err
+	}
+	var idx ocispecs.Index
+	if err := json.Unmarshal(dt, &idx); err != nil {
+		return nil, errors.Wrap(err, "invalid index.json")
+	}
+	if len(idx.Manifests) == 0 {
+		return nil, errors.New("index.json has no manifests")
+	}
+
+	store, err := local.NewStore(dir)
+	if err != nil {
+		return nil, err
+	}
+	verify := images.HandlerFunc(func(ctx context.Context, desc ocispecs.Descriptor) ([]ocispecs.Descriptor, error) {
+		if err := verifyBlob(ctx, store, desc); err != nil {
+			return nil, err
+		}
+		return nil, nil
+	})
+	if err := images.Walk(ctx, images.Handlers(verify, images.ChildrenHandler(store)), idx.Manifests...); err != nil {
+		return nil, err
+	}
+	return &OCILayout{Dir: dir, Index: idx}, nil
+}
+
+// ContextArgs returns the buildctl flags that make the first image of the
+// layout available to the Dockerfile frontend as the named context name,
+// e.g. for FROM name.
+func (l *OCILayout) ContextArgs(name string) []string {
+	return []string{
+		"--oci-layout=" + name + "=" + l.Dir,
+		"--opt=context:" + name + "=oci-layout://" + name + "@" + l.Index.Manifests[0].Digest.String(),
+	}
+}
+
+func verifyBlob(ctx context.Context, p content.Provider, desc ocispecs.Descriptor) error {
+	ra, err := p.ReaderAt(ctx, desc)
+	if err != nil {
+		return errors.Wrapf(err, "missing blob %s", desc.Digest)
+	}
+	defer ra.Close()
+	if ra.Size() != desc.Size {
+		return errors.Errorf("blob %s has size %d, expected %d", desc.Digest, ra.Size(), desc.Size)
+	}
+	dgst, err := desc.Digest.Algorithm().FromReader(content.NewReader(ra))
+	if err != nil {
+		return err
+	}
+	if dgst != desc.Digest {
+		return errors.Errorf("blob %s has digest %s", desc.Digest, dgst)
+	}
+	return nil
+}
+
+// untar extracts the regular files and directories of the archive r into
+// dir.
+func untar(r io.Reader, dir string) error {
+	tr := tar.NewReader(r)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name := path.Clean(h.Name)
+		if path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+			return errors.Errorf("invalid path %q in archive", h.Name)
+		}
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		switch h.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(p, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+				return err
+			}
+			f, err := os.OpenFile(p, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(f, tr)
+			f.Close()
+			if err != nil {
+				return err
+			}
+		default:
+			return errors.Errorf("unsupported type %q of %s in archive", h.Typeflag, h.Name)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package integration
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	digest "github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadOCILayout(t *testing.T) {
+	files := map[string][]byte{}
+	blob := func(mt string, dt []byte) ocispecs.Descriptor {
+		dgst := digest.FromBytes(dt)
+		files["blobs/sha256/"+dgst.Encoded()] = dt
+		return ocispecs.Descriptor{MediaType: mt, Digest: dgst, Size: int64(len(dt))}
+	}
+	mustJSON := func(v interface{}) []byte {
+		dt, err := json.Marshal(v)
+		require.NoError(t, err)
+		return dt
+	}
+	layer := blob(ocispecs.MediaTypeImageLayer, []byte("layer"))
+	config := blob(ocispecs.MediaTypeImageConfig, mustJSON(ocispecs.Image{OS: "linux"}))
+	mfst := blob(ocispecs.MediaTypeImageManifest, mustJSON(ocispecs.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispecs.MediaTypeImageManifest,
+		Config:    config,
+		Layers:    []ocispecs.Descriptor{layer},
+	}))
+	files["index.json"] = mustJSON(ocispecs.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		Manifests: []ocispecs.Descriptor{mfst},
+	})
+	files[ocispecs.ImageLayoutFile] = mustJSON(ocispecs.ImageLayout{Version: ocispecs.ImageLayoutVersion})
+
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	for name, dt := range files {
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(dt)), Typeflag: tar.TypeReg}))
+		_, err := tw.Write(dt)
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+
+	dir := t.TempDir()
+	require.NoError(t, untar(buf, dir))
+	l, err := ReadOCILayout(context.TODO(), dir)
+	require.NoError(t, err)
+	require.Equal(t, mfst.Digest, l.Index.Manifests[0].Digest)
+	require.Equal(t, []string{
+		"--oci-layout=base=" + dir,
+		"--opt=context:base=oci-layout://base@" + mfst.Digest.String(),
+	}, l.ContextArgs("base"))
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "blobs/sha256", layer.Digest.Encoded()), []byte("LAYER"), 0644))
+	_, err = ReadOCILayout(context.TODO(), dir)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "has digest")
+
+	require.NoError(t, os.Remove(filepath.Join(dir, "blobs/sha256", layer.Digest.Encoded())))
+	_, err = ReadOCILayout(context.TODO(), dir)
+	require.Error(t, err)
+}
+
+func TestUntarInvalidPath(t *testing.T) {
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "../escape", Mode: 0644, Typeflag: tar.TypeReg}))
+	require.NoError(t, tw.Close())
+	require.Error(t, untar(buf, t.TempDir()))
+}
@@ -0,0 +1,133 @@
+package integration
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pelletier/go-toml"
+	"github.com/pkg/errors"
+)
+
+// WithMaxParallelism returns a SandboxOpt that limits the number of build
+// steps the daemon runs at the same time to n.
+func WithMaxParallelism(n int) SandboxOpt {
+	return WithDaemonConfig(fmt.Sprintf(`
+[worker.oci]
+  max-parallelism = %d
+
+[worker.containerd]
+  max-parallelism = %d
+`, n, n))
+}
+
+// MaxParallelism returns the max-parallelism configured for the worker of
+// the daemon. Zero means that parallelism is not limited.
+func (sb *sandbox) MaxParallelism() (int, error) {
+	if sb.configFile == "" {
+		return 0, nil
+	}
+	dt, err := os.ReadFile(sb.configFile)
+	if err != nil {
+		return 0, err
+	}
+	return maxParallelism(string(dt), sb.ContainerdAddress() != "")
+}
+
+func maxParallelism(cfg string, containerd bool) (int, error) {
+	tree, err := toml.Load(cfg)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to parse buildkitd config")
+	}
+	worker := "oci"
+	if containerd {
+		worker = "containerd"
+	}
+	switch v := tree.GetPath([]string{"worker", worker, "max-parallelism"}).(type) {
+	case nil:
+		return 0, nil
+	case int64:
+		return int(v), nil
+	default:
+		return 0, errors.Errorf("invalid max-parallelism %v", v)
+	}
+}
+
+// ConcurrencyServer is an HTTP server that records how many requests it
+// handles at the same time. Build steps that request its URL, e.g. with
+// wget, can be used to observe how many steps the daemon runs in parallel.
+// The steps need the host network to reach the server.
+type ConcurrencyServer struct {
+	// URL is the address of the server.
+	URL string
+
+	hold   time.Duration
+	mu     sync.Mutex
+	active int
+	max    int
+	total  int
+}
+
+// NewConcurrencyServer starts a ConcurrencyServer that holds every request
+// for the duration hold before responding, so that concurrent requests
+// overlap.
+func NewConcurrencyServer(hold time.Duration) (*ConcurrencyServer, func() error, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, nil, err
+	}
+	s := &ConcurrencyServer{
+		URL:  "http://" + l.Addr().String(),
+		hold: hold,
+	}
+	srv := &http.Server{Handler: s}
+	go srv.Serve(l)
+	return s, srv.Close, nil
+}
+
+func (s *ConcurrencyServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	s.active++
+	s.total++
+	if s.active > s.max {
+		s.max = s.active
+	}
+	s.mu.Unlock()
+
+	select {
+	case <-time.After(s.hold):
+	case <-req.Context().Done():
+	}
+
+	// the request is done before responding so that the counters are
+	// up to date once the client returns
+	s.mu.Lock()
+	s.active--
+	s.mu.Unlock()
+	w.WriteHeader(http.StatusOK)
+}
+
+// Active returns the number of requests that are being handled.
+func (s *ConcurrencyServer) Active() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.active
+}
+
+// Max returns the highest number of requests that were handled at the same
+// time.
+func (s *ConcurrencyServer) Max() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.max
+}
+
+// Total returns the number of requests received.
+func (s *ConcurrencyServer) Total() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.total
+}
@@ -0,0 +1,51 @@
+package integration
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMaxParallelism(t *testing.T) {
+	cfg := &BackendConfig{}
+	WithMaxParallelism(2).UpdateBackendConfig(cfg)
+	out, err := mergeConfig("", cfg.DaemonConfig)
+	require.NoError(t, err)
+
+	n, err := maxParallelism(out, false)
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+	n, err = maxParallelism(out, true)
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+
+	n, err = maxParallelism("debug = true\n", false)
+	require.NoError(t, err)
+	require.Equal(t, 0, n)
+}
+
+func TestConcurrencyServer(t *testing.T) {
+	s, cl, err := NewConcurrencyServer(200 * time.Millisecond)
+	require.NoError(t, err)
+	defer cl()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := http.Get(s.URL)
+			if err == nil {
+				resp.Body.Close()
+			}
+		}()
+	}
+	wg.Wait()
+
+	require.Equal(t, 3, s.Total())
+	require.Equal(t, 3, s.Max())
+	require.Equal(t, 0, s.Active())
+}
@@ -0,0 +1,80 @@
+package integration
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+
+	"github.com/containerd/containerd/platforms"
+)
+
+// qemuArch maps GOARCH values to the names of the qemu binfmt handlers.
+var qemuArch = map[string]string{
+	"amd64":    "x86_64",
+	"386":      "i386",
+	"arm64":    "aarch64",
+	"arm":      "arm",
+	"ppc64le":  "ppc64le",
+	"s390x":    "s390x",
+	"riscv64":  "riscv64",
+	"mips64":   "mips64",
+	"mips64le": "mips64el",
+}
+
+const binfmtDir = "/proc/sys/fs/binfmt_misc"
+
+// BinfmtAvailable returns an error wrapping ErrRequirements unless binaries
+// for platform, e.g. "linux/arm64", can be run on the host, either natively
+// or through an enabled qemu binfmt_misc handler.
+func BinfmtAvailable(platform string) error {
+	p, err := platforms.Parse(platform)
+	if err != nil {
+		return err
+	}
+	p = platforms.Normalize(p)
+	if platforms.Only(platforms.DefaultSpec()).Match(p) {
+		return nil
+	}
+	if p.OS != "linux" {
+		return RequirementErrorf(SkipUnsupportedPlatform, "can't emulate %s", platform)
+	}
+	arch, ok := qemuArch[p.Architecture]
+	if !ok {
+		return RequirementErrorf(SkipUnsupportedPlatform, "no qemu emulator known for %s", platform)
+	}
+	// handlers are registered as qemu-<arch> by tonistiigi/binfmt and
+	// qemu-user-static, and with a buildkit- prefix by buildkitd
+	for _, name := range []string{"qemu-" + arch, "buildkit-qemu-" + arch} {
+		dt, err := os.ReadFile(filepath.Join(binfmtDir, name))
+		if err == nil && bytes.HasPrefix(dt, []byte("enabled")) {
+			return nil
+		}
+	}
+	return RequirementErrorf(SkipMissingKernelFeature, "no binfmt_misc handler for %s is registered", platform)
+}
+
+// RequirePlatforms requires the daemon to be able to build for all the
+// platforms, either natively or through emulation. The platforms reported
+// by the worker are checked first and the binfmt_misc handlers of the host
+// otherwise.
+func RequirePlatforms(ps ...string) Requirement {
+	return func(sb Sandbox) error {
+		caps, err := sb.Capabilities()
+		if err != nil {
+			return err
+		}
+		for _, p := range ps {
+			parsed, err := platforms.Parse(p)
+			if err != nil {
+				return err
+			}
+			if caps.Has("platform=" + platforms.Format(platforms.Normalize(parsed))) {
+				continue
+			}
+			if err := BinfmtAvailable(p); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
@@ -0,0 +1,20 @@
+package integration
+
+import (
+	"testing"
+
+	"github.com/containerd/containerd/platforms"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBinfmtAvailable(t *testing.T) {
+	require.NoError(t, BinfmtAvailable(platforms.DefaultString()))
+
+	err := BinfmtAvailable("windows/arm64")
+	if platforms.DefaultSpec().OS != "windows" {
+		require.True(t, errors.Is(err, ErrRequirements))
+	}
+
+	require.Error(t, BinfmtAvailable("linux/"))
+}
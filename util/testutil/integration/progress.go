@@ -0,0 +1,111 @@
+package integration
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ProgressOutput is the progress of a solve as written by buildctl.
+type ProgressOutput struct {
+	// Plain is the output of --progress=plain.
+	Plain []byte
+	// JSON is the stream of solve statuses written with --trace, one JSON
+	// document per line.
+	JSON []byte
+}
+
+// CaptureProgress runs buildctl build with args, e.g. the frontend and
+// --local flags, and returns its progress in the plain and JSON formats.
+// Both are captured from the same solve. A build that fails is an error.
+func CaptureProgress(sb Sandbox, args ...string) (ProgressOutput, error) {
+	dir, err := os.MkdirTemp(sb.TempDir(), "progress")
+	if err != nil {
+		return ProgressOutput{}, err
+	}
+	defer os.RemoveAll(dir)
+	trace := filepath.Join(dir, "trace.json")
+
+	args = append([]string{"build", "--progress=plain", "--trace=" + trace}, args...)
+	_, stderr, exitCode, err := sb.Exec(args...)
+	if err != nil {
+		return ProgressOutput{}, err
+	}
+	if exitCode != 0 {
+		return ProgressOutput{}, errors.Errorf("build failed with exit code %d: %s", exitCode, stderr)
+	}
+	dt, err := os.ReadFile(trace)
+	if err != nil {
+		return ProgressOutput{}, err
+	}
+	return ProgressOutput{Plain: stderr, JSON: dt}, nil
+}
+
+var (
+	progressDuration = regexp.MustCompile(`\b\d+\.\d+s\b`)
+	// buildctl logs with logrus to the same stream as the progress
+	progressLogLine = regexp.MustCompile(`^time="[^"]*" level=`)
+)
+
+// progressTimeKeys are the fields of client.SolveStatus holding timestamps.
+var progressTimeKeys = []string{"Started", "Completed", "Timestamp"}
+
+// Normalize returns a copy of p with durations and timestamps replaced by
+// fixed values and log messages of buildctl removed, so that it can be
+// compared with golden files.
+func (p ProgressOutput) Normalize() (ProgressOutput, error) {
+	var out ProgressOutput
+
+	plain := &bytes.Buffer{}
+	s := bufio.NewScanner(bytes.NewReader(p.Plain))
+	for s.Scan() {
+		if progressLogLine.Match(s.Bytes()) {
+			continue
+		}
+		plain.Write(progressDuration.ReplaceAll(s.Bytes(), []byte("0.0s")))
+		plain.WriteByte('\n')
+	}
+	if err := s.Err(); err != nil {
+		return ProgressOutput{}, err
+	}
+	out.Plain = plain.Bytes()
+
+	js := &bytes.Buffer{}
+	enc := json.NewEncoder(js)
+	dec := json.NewDecoder(bytes.NewReader(p.JSON))
+	for dec.More() {
+		var v interface{}
+		if err := dec.Decode(&v); err != nil {
+			return ProgressOutput{}, errors.Wrap(err, "failed to decode progress")
+		}
+		if err := enc.Encode(normalizeTimes(v)); err != nil {
+			return ProgressOutput{}, err
+		}
+	}
+	out.JSON = js.Bytes()
+	return out, nil
+}
+
+func normalizeTimes(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, vv := range v {
+			if vv != nil && contains(progressTimeKeys, k) {
+				v[k] = time.Time{}
+				continue
+			}
+			v[k] = normalizeTimes(vv)
+		}
+	case []interface{}:
+		for i, vv := range v {
+			v[i] = normalizeTimes(vv)
+		}
+	}
+	return v
+}
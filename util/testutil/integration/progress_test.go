@@ -0,0 +1,29 @@
+package integration
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestProgressNormalize(t *testing.T) {
+	p := ProgressOutput{
+		Plain: []byte(`time="2022-08-01T10:00:00Z" level=info msg="tracing logs to /tmp/trace.json"
+#1 [internal] load build definition from Dockerfile
+#1 transferring dockerfile: 32B done
+#1 DONE 0.12s
+`),
+		JSON: []byte(`{"Vertexes":[{"Digest":"sha256:abc","Name":"foo","Started":"2022-08-01T10:00:00.1Z","Completed":null}]}
+{"Logs":[{"Vertex":"sha256:abc","Data":"aGk=","Timestamp":"2022-08-01T10:00:00.5Z"}]}
+`),
+	}
+	n, err := p.Normalize()
+	require.NoError(t, err)
+	require.Equal(t, `#1 [internal] load build definition from Dockerfile
+#1 transferring dockerfile: 32B done
+#1 DONE 0.0s
+`, string(n.Plain))
+	require.Equal(t, `{"Vertexes":[{"Completed":null,"Digest":"sha256:abc","Name":"foo","Started":"0001-01-01T00:00:00Z"}]}
+{"Logs":[{"Data":"aGk=","Timestamp":"0001-01-01T00:00:00Z","Vertex":"sha256:abc"}]}
+`, string(n.JSON))
+}
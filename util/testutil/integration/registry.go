@@ -2,19 +2,141 @@ package integration
 
 import (
 	"bufio"
+	"bytes"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
 	"fmt"
 	"io"
+	"math/big"
+	"net"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"regexp"
+	"runtime"
+	"sort"
+	"sync"
+	"testing"
 	"time"
 
+	"github.com/containerd/containerd/content"
+	"github.com/moby/buildkit/util/contentutil"
+	digest "github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
+	"golang.org/x/crypto/bcrypt"
 )
 
+// RegistryFactory starts registries for Sandbox.NewRegistry. The registry
+// must be reachable from the daemon over plain HTTP on the returned host.
+type RegistryFactory interface {
+	NewRegistry(dir string) (url string, cl func() error, err error)
+}
+
+// RegistryFactoryFunc adapts a function to RegistryFactory.
+type RegistryFactoryFunc func(dir string) (url string, cl func() error, err error)
+
+func (f RegistryFactoryFunc) NewRegistry(dir string) (string, func() error, error) {
+	return f(dir)
+}
+
+// DefaultRegistry starts the distribution registry binary from PATH. It is
+// used by sandboxes that don't select another factory with
+// WithRegistryFactory. The registries it starts support RegistryGC.
+var DefaultRegistry RegistryFactory = localRegistry{}
+
+type localRegistry struct{}
+
+func (localRegistry) NewRegistry(dir string) (string, func() error, error) {
+	return newRegistry(dir, &registryOpt{gc: true})
+}
+
+// WithRegistryFactory returns a SandboxOpt that makes Sandbox.NewRegistry
+// start registries with f instead of DefaultRegistry. Registries with TLS,
+// selected with RegistryTLS, and with authentication, started with
+// Sandbox.NewRegistryWithAuth, can't be started by f. Both fail with an
+// error wrapping ErrRequirements.
+func WithRegistryFactory(f RegistryFactory) SandboxOpt {
+	return registryFactoryOpt{f}
+}
+
+type registryFactoryOpt struct {
+	f RegistryFactory
+}
+
+func (o registryFactoryOpt) UpdateBackendConfig(cfg *BackendConfig) {
+	cfg.RegistryFactory = o.f
+}
+
 func NewRegistry(dir string) (url string, cl func() error, err error) {
+	return newRegistry(dir, &registryOpt{})
+}
+
+// NewRegistryWithAuth starts a registry that requires basic authentication
+// with the given credentials.
+func NewRegistryWithAuth(dir, user, pass string) (url string, cl func() error, err error) {
+	if user == "" {
+		return "", nil, errors.Errorf("user is required for registry with auth")
+	}
+	return newRegistry(dir, &registryOpt{user: user, pass: pass})
+}
+
+// NewRegistryWithTLS starts a registry serving HTTPS with a self-signed
+// certificate. The returned ca is the path of the PEM encoded certificate
+// that clients need to trust.
+func NewRegistryWithTLS(dir string) (url, ca string, cl func() error, err error) {
+	opt := registryOpt{tls: true}
+	url, cl, err = newRegistry(dir, &opt)
+	if err != nil {
+		return "", "", nil, err
+	}
+	return url, opt.ca, cl, nil
+}
+
+// RegistryStorage configures the storage driver of a registry, e.g. "s3",
+// with the parameters documented for the driver by the distribution
+// registry. See NewMinio for an S3 storage that is started locally.
+type RegistryStorage struct {
+	Driver string
+	Params map[string]string
+}
+
+// NewRegistryWithStorage starts a registry that keeps its data in storage
+// instead of the filesystem under dir.
+func NewRegistryWithStorage(dir string, storage RegistryStorage) (url string, cl func() error, err error) {
+	if storage.Driver == "" {
+		return "", nil, errors.Errorf("storage driver is required")
+	}
+	return newRegistry(dir, &registryOpt{storage: &storage})
+}
+
+type registryOpt struct {
+	user    string
+	pass    string
+	tls     bool
+	storage *RegistryStorage // nil for the filesystem under dir
+
+	// token configures the registry to require bearer tokens issued by a
+	// token server
+	token *tokenAuthConfig
+
+	// gc makes the registry available to RegistryGC
+	gc bool
+
+	ca string // set by newRegistry when tls is enabled
+	// issuer signs the certificate of a TLS registry, nil for a self-signed
+	// certificate
+	issuer *registryCA
+}
+
+func newRegistry(dir string, opt *registryOpt) (url string, cl func() error, err error) {
 	if err := lookupBinary("registry"); err != nil {
 		return "", nil, err
 	}
@@ -38,43 +160,197 @@ func NewRegistry(dir string) (url string, cl func() error, err error) {
 		dir = tmpdir
 	}
 
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if opt.tls {
+		opt.ca = certFile
+	}
+
 	if _, err := os.Stat(filepath.Join(dir, "config.yaml")); err != nil {
 		if !errors.Is(err, os.ErrNotExist) {
 			return "", nil, err
 		}
-		template := fmt.Sprintf(`version: 0.1
+		storage := opt.storage
+		if storage == nil {
+			storage = &RegistryStorage{
+				Driver: "filesystem",
+				Params: map[string]string{"rootdirectory": filepath.Join(dir, "data")},
+			}
+		}
+		template := `version: 0.1
 loglevel: debug
-storage:
-    filesystem:
-        rootdirectory: %s
-http:
+` + storage.config() + `http:
     addr: 127.0.0.1:0
-`, filepath.Join(dir, "data"))
+`
+
+		if opt.tls {
+			if err := writeRegistryCert(certFile, keyFile, opt.issuer); err != nil {
+				return "", nil, err
+			}
+			template += fmt.Sprintf(`    tls:
+        certificate: %s
+        key: %s
+`, certFile, keyFile)
+		}
+
+		if opt.user != "" {
+			htpasswd, err := bcrypt.GenerateFromPassword([]byte(opt.pass), bcrypt.DefaultCost)
+			if err != nil {
+				return "", nil, err
+			}
+			htpasswdFile := filepath.Join(dir, "htpasswd")
+			if err := os.WriteFile(htpasswdFile, []byte(opt.user+":"+string(htpasswd)+"\n"), 0600); err != nil {
+				return "", nil, err
+			}
+			template += fmt.Sprintf(`auth:
+    htpasswd:
+        realm: basic-realm
+        path: %s
+`, htpasswdFile)
+		} else if opt.token != nil {
+			template += fmt.Sprintf(`auth:
+    token:
+        realm: %s
+        service: %s
+        issuer: %s
+        rootcertbundle: %s
+`, opt.token.realm, tokenService, tokenIssuer, opt.token.certFile)
+		}
 
 		if err := os.WriteFile(filepath.Join(dir, "config.yaml"), []byte(template), 0600); err != nil {
 			return "", nil, err
 		}
 	}
 
-	cmd := exec.Command("registry", "serve", filepath.Join(dir, "config.yaml"))
+	configFile := filepath.Join(dir, "config.yaml")
+	// config.yaml is kept in persistent directories like the mirror dir and
+	// could have been written with a fixed address, so an ephemeral port is
+	// always requested. The assigned port is read from the logs.
+	url, stop, err := serveRegistry(configFile, "127.0.0.1:0")
+	if err != nil {
+		return "", nil, err
+	}
+	if !opt.gc {
+		deferF.append(stop)
+		return url, cl, nil
+	}
+
+	// garbage collection may only run while the registry is stopped, so the
+	// registry is restarted on the same port after every collection
+	var mu sync.Mutex
+	deferF.append(func() error {
+		mu.Lock()
+		defer mu.Unlock()
+		if stop == nil {
+			return nil
+		}
+		return stop()
+	})
+	deferF.append(registerRegistryGC(url, func() error {
+		mu.Lock()
+		defer mu.Unlock()
+		if stop == nil {
+			return errors.Errorf("registry %s is not running", url)
+		}
+		err := stop()
+		stop = nil
+		if err != nil {
+			return err
+		}
+		out, err := exec.Command("registry", "garbage-collect", "--delete-untagged", configFile).CombinedOutput()
+		if err != nil {
+			return errors.Wrapf(err, "registry garbage-collect failed: %s", out)
+		}
+		_, port, err := net.SplitHostPort(url)
+		if err != nil {
+			return err
+		}
+		_, stop, err = serveRegistry(configFile, "127.0.0.1:"+port)
+		return errors.Wrapf(err, "failed to restart registry %s", url)
+	}))
+
+	return url, cl, nil
+}
+
+// serveRegistry starts a registry with configFile listening on addr and
+// returns the host it is reachable at.
+func serveRegistry(configFile, addr string) (url string, stop func() error, err error) {
+	cmd := exec.Command("registry", "serve", configFile)
+	cmd.Env = append(os.Environ(), "REGISTRY_HTTP_ADDR="+addr)
 	rc, err := cmd.StderrPipe()
 	if err != nil {
 		return "", nil, err
 	}
-	stop, err := startCmd(cmd, nil)
+	stop, err = startCmd(cmd, nil)
 	if err != nil {
 		return "", nil, err
 	}
-	deferF.append(stop)
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 	url, err = detectPort(ctx, rc)
 	if err != nil {
+		stop()
 		return "", nil, err
 	}
+	return url, stop, nil
+}
 
-	return
+// config returns the storage section of the registry configuration.
+func (s RegistryStorage) config() string {
+	keys := make([]string, 0, len(s.Params))
+	for k := range s.Params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	out := "storage:\n    " + s.Driver + ":\n"
+	for _, k := range keys {
+		out += fmt.Sprintf("        %s: %q\n", k, s.Params[k])
+	}
+	return out
+}
+
+// RegistryGarbageCollector can be implemented by a RegistryFactory to
+// support RegistryGC for the registries it starts. GarbageCollect must not
+// run while the registry accepts writes, e.g. by stopping it or switching
+// it to read-only mode for the duration of the collection.
+type RegistryGarbageCollector interface {
+	GarbageCollect(host string) error
+}
+
+var registryGCs = struct {
+	mu sync.Mutex
+	m  map[string]func() error
+}{m: map[string]func() error{}}
+
+// registerRegistryGC makes gc available to RegistryGC for host until the
+// returned function is called.
+func registerRegistryGC(host string, gc func() error) func() error {
+	registryGCs.mu.Lock()
+	registryGCs.m[host] = gc
+	registryGCs.mu.Unlock()
+	return func() error {
+		registryGCs.mu.Lock()
+		delete(registryGCs.m, host)
+		registryGCs.mu.Unlock()
+		return nil
+	}
+}
+
+// RegistryGC removes the blobs that are not referenced by any manifest from
+// the registry at host, including the manifests that are not tagged. The
+// registry must have been started by Sandbox.NewRegistry with the default
+// factory or with a factory implementing RegistryGarbageCollector. The
+// default registry is stopped while the garbage is collected and started
+// again on the same port, so it must not be used concurrently. The mirror
+// registry started by Run is never collected.
+func RegistryGC(host string) error {
+	registryGCs.mu.Lock()
+	gc, ok := registryGCs.m[host]
+	registryGCs.mu.Unlock()
+	if !ok {
+		return errors.Errorf("garbage collection is not supported for registry %s", host)
+	}
+	return gc()
 }
 
 func detectPort(ctx context.Context, rc io.ReadCloser) (string, error) {
@@ -107,3 +383,157 @@ func detectPort(ctx context.Context, rc io.ReadCloser) (string, error) {
 	}
 	return "", errors.Errorf("no listening address found")
 }
+
+// registryCA is a certificate authority for TLS registries. The daemon of a
+// sandbox trusts it so that it can use any number of TLS registries.
+type registryCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte // the PEM encoded certificate
+}
+
+func newRegistryCA() (*registryCA, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	tmpl, err := certTemplate()
+	if err != nil {
+		return nil, err
+	}
+	tmpl.Subject = pkix.Name{CommonName: "buildkit test registry CA"}
+	tmpl.KeyUsage = x509.KeyUsageCertSign
+	tmpl.IsCA = true
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &registryCA{
+		cert: cert,
+		key:  key,
+		pem:  pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+	}, nil
+}
+
+// certTemplate returns a certificate template for a registry listening on
+// localhost.
+func certTemplate() (*x509.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	return &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "localhost"},
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}, nil
+}
+
+// writeRegistryCert writes a certificate for a registry and its key. The
+// certificate is signed by issuer. If issuer is nil it is self-signed and is
+// its own CA so that it can be configured as the trusted root by the client.
+func writeRegistryCert(certFile, keyFile string, issuer *registryCA) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	tmpl, err := certTemplate()
+	if err != nil {
+		return err
+	}
+	parent, signer := tmpl, key
+	if issuer != nil {
+		tmpl.KeyUsage = x509.KeyUsageDigitalSignature
+		tmpl.IsCA = false
+		parent, signer = issuer.cert, issuer.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, signer)
+	if err != nil {
+		return err
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		return err
+	}
+	return os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+}
+
+// SeedRegistry pushes an image made of the given layers to host/ref. Layers
+// are pushed as uncompressed tar blobs exactly as passed, so they can be used
+// to construct edge cases such as empty layers. The descriptor of the pushed
+// manifest is returned.
+func SeedRegistry(t *testing.T, host, ref string, layers [][]byte) (ocispecs.Descriptor, error) {
+	ctx := context.TODO()
+	ingester, err := contentutil.IngesterFromRef(host + "/" + ref)
+	if err != nil {
+		return ocispecs.Descriptor{}, err
+	}
+
+	push := func(mediaType string, dt []byte) (ocispecs.Descriptor, error) {
+		desc := ocispecs.Descriptor{
+			MediaType: mediaType,
+			Digest:    digest.FromBytes(dt),
+			Size:      int64(len(dt)),
+		}
+		if err := content.WriteBlob(ctx, ingester, desc.Digest.String(), bytes.NewReader(dt), desc); err != nil {
+			return ocispecs.Descriptor{}, errors.Wrapf(err, "failed to push %s", desc.Digest)
+		}
+		return desc, nil
+	}
+
+	img := ocispecs.Image{
+		Architecture: runtime.GOARCH,
+		OS:           "linux",
+		RootFS: ocispecs.RootFS{
+			Type:    "layers",
+			DiffIDs: []digest.Digest{},
+		},
+	}
+	mfst := ocispecs.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispecs.MediaTypeImageManifest,
+		Layers:    []ocispecs.Descriptor{},
+	}
+	for _, l := range layers {
+		desc, err := push(ocispecs.MediaTypeImageLayer, l)
+		if err != nil {
+			return ocispecs.Descriptor{}, err
+		}
+		mfst.Layers = append(mfst.Layers, desc)
+		img.RootFS.DiffIDs = append(img.RootFS.DiffIDs, desc.Digest)
+	}
+
+	dt, err := json.Marshal(img)
+	if err != nil {
+		return ocispecs.Descriptor{}, err
+	}
+	mfst.Config, err = push(ocispecs.MediaTypeImageConfig, dt)
+	if err != nil {
+		return ocispecs.Descriptor{}, err
+	}
+
+	dt, err = json.Marshal(mfst)
+	if err != nil {
+		return ocispecs.Descriptor{}, err
+	}
+	desc, err := push(ocispecs.MediaTypeImageManifest, dt)
+	if err != nil {
+		return ocispecs.Descriptor{}, err
+	}
+	t.Logf("seeded %s with %d layers", host+"/"+ref, len(layers))
+	return desc, nil
+}
@@ -0,0 +1,173 @@
+package integration
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistryStorageConfig(t *testing.T) {
+	s := RegistryStorage{
+		Driver: "s3",
+		Params: map[string]string{
+			"secure": "false",
+			"bucket": "registry",
+		},
+	}
+	require.Equal(t, `storage:
+    s3:
+        bucket: "registry"
+        secure: "false"
+`, s.config())
+}
+
+func TestRegistryCert(t *testing.T) {
+	ca, err := newRegistryCA()
+	require.NoError(t, err)
+	roots := x509.NewCertPool()
+	require.True(t, roots.AppendCertsFromPEM(ca.pem))
+
+	dir := t.TempDir()
+	var serials []string
+	for _, name := range []string{"a", "b"} {
+		certFile := filepath.Join(dir, name+".pem")
+		require.NoError(t, writeRegistryCert(certFile, filepath.Join(dir, name+"-key.pem"), ca))
+		cert := readCert(t, certFile)
+		_, err := cert.Verify(x509.VerifyOptions{DNSName: "127.0.0.1", Roots: roots})
+		require.NoError(t, err)
+		require.False(t, cert.IsCA)
+		serials = append(serials, cert.SerialNumber.String())
+	}
+	require.NotEqual(t, serials[0], serials[1])
+
+	// self-signed certificates are not signed by the CA
+	certFile := filepath.Join(dir, "self.pem")
+	require.NoError(t, writeRegistryCert(certFile, filepath.Join(dir, "self-key.pem"), nil))
+	_, err = readCert(t, certFile).Verify(x509.VerifyOptions{DNSName: "127.0.0.1", Roots: roots})
+	require.Error(t, err)
+}
+
+func TestSandboxNewRegistryTLS(t *testing.T) {
+	ca, err := newRegistryCA()
+	require.NoError(t, err)
+	sb := newTestSandbox(t)
+	sb.registryCA = ca
+
+	first, err := sb.NewRegistry()
+	if errors.Is(err, ErrRequirements) {
+		t.Skip(err.Error())
+	}
+	require.NoError(t, err)
+	second, err := sb.NewRegistry()
+	require.NoError(t, err)
+	require.NotEqual(t, first, second)
+}
+
+func readCert(t *testing.T, file string) *x509.Certificate {
+	dt, err := os.ReadFile(file)
+	require.NoError(t, err)
+	b, _ := pem.Decode(dt)
+	require.NotNil(t, b)
+	cert, err := x509.ParseCertificate(b.Bytes)
+	require.NoError(t, err)
+	return cert
+}
+
+func TestRegistryWithAuth(t *testing.T) {
+	url, cl, err := NewRegistryWithAuth("", "user", "secret")
+	if errors.Is(err, ErrRequirements) {
+		t.Skip(err.Error())
+	}
+	require.NoError(t, err)
+	defer cl()
+
+	get := func(user, pass string) int {
+		req, err := http.NewRequest(http.MethodGet, "http://"+url+"/v2/", nil)
+		require.NoError(t, err)
+		if user != "" {
+			req.SetBasicAuth(user, pass)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	require.Equal(t, http.StatusUnauthorized, get("", ""))
+	require.Equal(t, http.StatusUnauthorized, get("user", "wrong"))
+	require.Equal(t, http.StatusOK, get("user", "secret"))
+}
+
+func TestSandboxRegistryAuth(t *testing.T) {
+	sb := newTestSandbox(t)
+	require.NoError(t, sb.addRegistryAuth("localhost:5000", "user", "secret"))
+	require.NoError(t, sb.addRegistryAuth("localhost:5001", "other", "pass"))
+
+	dir := sb.dockerConfigDir
+	require.Contains(t, sb.Cmd().Env, "DOCKER_CONFIG="+dir)
+	dt, err := os.ReadFile(filepath.Join(dir, "config.json"))
+	require.NoError(t, err)
+	require.JSONEq(t, `{"auths":{
+		"localhost:5000":{"auth":"dXNlcjpzZWNyZXQ="},
+		"localhost:5001":{"auth":"b3RoZXI6cGFzcw=="}
+	}}`, string(dt))
+
+	// the credentials don't outlive the test
+	require.NoError(t, sb.runCleanups())
+	require.NotContains(t, strings.Join(sb.Cmd().Env, "\n"), "DOCKER_CONFIG=")
+	_, err = os.Stat(dir)
+	require.True(t, errors.Is(err, os.ErrNotExist))
+}
+
+func TestRegistryGC(t *testing.T) {
+	url, cl, err := DefaultRegistry.NewRegistry("")
+	if errors.Is(err, ErrRequirements) {
+		t.Skip(err.Error())
+	}
+	require.NoError(t, err)
+	defer cl()
+
+	// the registry is stopped for the collection and serves again afterwards
+	// on the same address
+	require.NoError(t, RegistryGC(url))
+	resp, err := http.Get("http://" + url + "/v2/")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// registries started with NewRegistry, like the mirror, are never collected
+	mirror, cl2, err := NewRegistry("")
+	require.NoError(t, err)
+	defer cl2()
+	require.Error(t, RegistryGC(mirror))
+}
+
+func TestSandboxRegistryFactory(t *testing.T) {
+	sb := newTestSandbox(t)
+	var started int
+	sb.registryFactory = RegistryFactoryFunc(func(string) (string, func() error, error) {
+		started++
+		return "localhost:5000", func() error { return nil }, nil
+	})
+	url, err := sb.NewRegistry()
+	require.NoError(t, err)
+	require.Equal(t, "localhost:5000", url)
+
+	// TLS and auth are not silently started without the factory
+	_, err = sb.NewRegistryWithAuth("user", "secret")
+	require.ErrorIs(t, err, ErrRequirements)
+	ca, err := newRegistryCA()
+	require.NoError(t, err)
+	sb.registryCA = ca
+	_, err = sb.NewRegistry()
+	require.ErrorIs(t, err, ErrRequirements)
+	_, err = sb.NewRegistryWithAuth("user", "secret")
+	require.ErrorIs(t, err, ErrRequirements)
+	require.Equal(t, 1, started)
+}
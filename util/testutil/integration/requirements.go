@@ -0,0 +1,108 @@
+package integration
+
+import (
+	"os"
+	"runtime"
+	"sort"
+
+	"github.com/pelletier/go-toml"
+	"github.com/pkg/errors"
+)
+
+// Requirement checks whether a sandbox can run a test. It returns an error
+// wrapping ErrRequirements that describes what is missing.
+type Requirement func(Sandbox) error
+
+// WithRequirements skips the tests on sandboxes that don't meet all reqs.
+func WithRequirements(reqs ...Requirement) TestOpt {
+	return func(tc *testConf) {
+		tc.requirements = append(tc.requirements, reqs...)
+	}
+}
+
+// RequireCPUs requires the host to have at least n CPUs.
+func RequireCPUs(n int) Requirement {
+	return func(Sandbox) error {
+		if c := runtime.NumCPU(); c < n {
+			return RequirementErrorf(SkipInsufficientCPUs, "requires %d CPUs, host has %d", n, c)
+		}
+		return nil
+	}
+}
+
+// RequireNotRootless requires a sandbox that is not running in rootless mode.
+func RequireNotRootless() Requirement {
+	return func(sb Sandbox) error {
+		if sb.Rootless() {
+			return RequirementErrorf(SkipUnsupportedPlatform, "requires non-rootless sandbox")
+		}
+		return nil
+	}
+}
+
+// RequireEntitlements requires the daemon to allow the insecure entitlements.
+func RequireEntitlements(entitlements ...string) Requirement {
+	return func(sb Sandbox) error {
+		sbx, ok := sb.(*sandbox)
+		if !ok {
+			return errors.Errorf("invalid sandbox type %T", sb)
+		}
+		granted, err := sbx.insecureEntitlements()
+		if err != nil {
+			return err
+		}
+		for _, e := range entitlements {
+			if _, ok := granted[e]; !ok {
+				return RequirementErrorf(SkipMissingEntitlement, "requires %s entitlement", e)
+			}
+		}
+		return nil
+	}
+}
+
+func checkRequirements(sb Sandbox, reqs []Requirement) error {
+	for _, req := range reqs {
+		if err := req(sb); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (sb *sandbox) Entitlements() []string {
+	m, err := sb.insecureEntitlements()
+	if err != nil {
+		return nil
+	}
+	out := make([]string, 0, len(m))
+	for e := range m {
+		out = append(out, e)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// insecureEntitlements returns the entitlements the daemon was configured to
+// allow.
+func (sb *sandbox) insecureEntitlements() (map[string]struct{}, error) {
+	m := map[string]struct{}{}
+	if sb.configFile == "" {
+		return m, nil
+	}
+	dt, err := os.ReadFile(sb.configFile)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := toml.LoadBytes(dt)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse %s", sb.configFile)
+	}
+	if v, ok := cfg.Get("insecure-entitlements").([]interface{}); ok {
+		for _, e := range v {
+			if s, ok := e.(string); ok {
+				m[s] = struct{}{}
+			}
+		}
+	}
+	return m, nil
+}
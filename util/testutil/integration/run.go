@@ -3,6 +3,7 @@ package integration
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"math/rand"
 	"os"
@@ -10,12 +11,15 @@ import (
 	"path/filepath"
 	"reflect"
 	"runtime"
-	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/platforms"
 	"github.com/containerd/containerd/remotes/docker"
 	"github.com/gofrs/flock"
 	"github.com/moby/buildkit/util/appcontext"
@@ -23,13 +27,34 @@ import (
 	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
 	"github.com/stretchr/testify/require"
+	tracev1 "go.opentelemetry.io/proto/otlp/trace/v1"
+	"golang.org/x/sync/errgroup"
 	"golang.org/x/sync/semaphore"
 )
 
-var sandboxLimiter *semaphore.Weighted
+var (
+	sandboxLimiter *semaphore.Weighted
+	sandboxLimit   int64 // size of sandboxLimiter
+)
 
 func init() {
-	sandboxLimiter = semaphore.NewWeighted(int64(runtime.GOMAXPROCS(0)))
+	sandboxLimit = int64(runtime.GOMAXPROCS(0))
+	sandboxLimiter = semaphore.NewWeighted(sandboxLimit)
+}
+
+// sandboxesOf returns the number of slots of sandboxLimiter that tc takes
+// while it runs. Tests that start more sandboxes than the one passed by Run,
+// like the tests of RunTwo, implement sandboxes.
+func sandboxesOf(tc Test) int64 {
+	n := int64(1)
+	if st, ok := tc.(interface{ sandboxes() int64 }); ok {
+		n = st.sandboxes()
+	}
+	// more than the limit could never be acquired
+	if n > sandboxLimit {
+		n = sandboxLimit
+	}
+	return n
 }
 
 // Backend is the minimal interface that describes a testing backend.
@@ -45,16 +70,173 @@ type Sandbox interface {
 
 	Context() context.Context
 	Cmd(...string) *exec.Cmd
+	// Exec runs buildctl with args to completion. A non-zero exit code is
+	// not an error; err is only set if the command could not be run.
+	Exec(args ...string) (stdout, stderr []byte, exitCode int, err error)
+	// Restart stops the daemon and starts it again with the same
+	// configuration and state. ErrRequirements is returned if the worker
+	// doesn't support it.
+	Restart() error
+	// WaitReady blocks until the daemon responds to requests or ctx is
+	// done, e.g. after restarting it during a test.
+	WaitReady(ctx context.Context) error
 	PrintLogs(*testing.T)
+	// Logs returns the output captured so far from the processes started
+	// for the sandbox.
+	Logs() SandboxLogs
+	// Entitlements returns the insecure entitlements allowed by the daemon.
+	Entitlements() []string
+	// MaxParallelism returns the max-parallelism configured for the
+	// worker, or zero if it is not limited.
+	MaxParallelism() (int, error)
+	// Capabilities returns the features supported by the daemon.
+	Capabilities() (Capabilities, error)
+	// Stats returns the resource usage of the daemon processes.
+	Stats() (ResourceStats, error)
+	// ResourceLimits returns the limits of the cgroup of the daemon set
+	// with WithResourceLimits. Zero values are unlimited.
+	ResourceLimits() ResourceLimits
 	NewRegistry() (string, error)
+	// NewRegistryWithAuth starts a registry that requires basic auth. The
+	// credentials are made available to buildctl invoked through Cmd. Like
+	// NewRegistry, it serves TLS if RegistryTLS is selected.
+	NewRegistryWithAuth(user, pass string) (string, error)
 	Value(string) interface{} // chosen matrix value
+	// ValueString returns the chosen matrix value for key if it is a
+	// string. False is returned if the key is not set or has another type.
+	ValueString(key string) (string, bool)
+	// ValueBool returns the chosen matrix value for key if it is a bool.
+	ValueBool(key string) (bool, bool)
+	// Values returns all chosen matrix values keyed by dimension. The map is
+	// a copy and can be modified by the caller.
+	Values() map[string]interface{}
 	Name() string
+	// TempDir returns a scratch directory for files used by the test, like
+	// a Dockerfile and its build context. It is removed when the sandbox is
+	// closed. Tests in a shared sandbox share the directory.
+	TempDir() string
+	// MirrorHost returns the address of the registry that mirrors docker.io
+	// for the daemon, or an empty string if no mirror is used.
+	MirrorHost() string
+	// Traces returns the spans exported by the daemon so far. Spans are only
+	// collected for sandboxes created with WithTraceCollector.
+	Traces() []*tracev1.Span
+	// Cleanup registers a function to be called after the test body has
+	// returned, while the daemon is still running. Functions are called in
+	// reverse order of registration and their errors fail the test.
+	Cleanup(func() error)
 }
 
 // BackendConfig is used to configure backends created by a worker.
 type BackendConfig struct {
 	Logs       map[string]*bytes.Buffer
 	ConfigFile string
+	// Rootless is set when rootless mode was selected through the matrix.
+	Rootless bool
+	// RootlessNet is the rootlesskit network driver for rootless workers.
+	RootlessNet string
+	// Snapshotter is the snapshotter selected through the matrix. Empty
+	// uses the default of the worker.
+	Snapshotter string
+	// Compression is the layer compression of exported images selected
+	// through the matrix. Empty uses the default of the exporters.
+	Compression string
+	// DaemonConfig holds TOML documents that are merged into ConfigFile.
+	DaemonConfig []string
+	// ShutdownTimeout is how long the daemon is given to exit after SIGTERM
+	// before it is killed. Zero uses the default.
+	ShutdownTimeout time.Duration
+	// ForceShutdown kills the daemon without sending SIGTERM first.
+	ForceShutdown bool
+	// CheckShutdown makes closing the backend fail if the daemon doesn't
+	// exit cleanly after SIGTERM.
+	CheckShutdown bool
+	// DaemonEnv holds additional environment variables for the daemon in
+	// KEY=VALUE form. An entry without "=" removes the variable.
+	DaemonEnv []string
+	// Entitlements are the insecure entitlements the daemon allows.
+	Entitlements []string
+	// DaemonPath is the buildkitd binary started by the oci and containerd
+	// workers. Empty uses BUILDKIT_DAEMON_PATH or buildkitd from PATH.
+	DaemonPath string
+	// BuildctlPath is the buildctl binary run by Sandbox.Cmd. Empty uses
+	// BUILDKIT_BUILDCTL_PATH or buildctl from PATH.
+	BuildctlPath string
+	// DataRoot is the directory the daemon keeps its state in, see
+	// WithDataRoot. Empty uses a new directory that is removed when the
+	// sandbox is closed.
+	DataRoot string
+	// RegistryFactory starts the registries returned by
+	// Sandbox.NewRegistry. Nil uses DefaultRegistry.
+	RegistryFactory RegistryFactory
+
+	traceCollector     bool
+	debugAddress       string   // daemon debug endpoint, see goroutineDumpEnabled
+	mirroredRegistries []string // registries other than docker.io served by the mirror
+	liveLogs           *liveLogs
+	caCerts            [][]byte          // CAs trusted in addition to the system roots
+	caBundle           string            // bundle written for caCerts, passed as SSL_CERT_FILE
+	hosts              map[string]string // host entries added with WithHosts
+	nameservers        []string          // nameservers set with WithDNS
+	hostsFile          string            // hosts file written for hosts
+	resolvConf         string            // resolv.conf written for nameservers
+	resourceLimits     *ResourceLimits   // limits set with WithResourceLimits
+	cgroup             *daemonCgroup     // cgroup created for resourceLimits
+	grpcRecording      string            // file set with WithGRPCRecording
+	persistentDataKey  string            // key set with WithPersistentDataDir
+	ignoresConfigFile  bool              // set by workers that don't pass ConfigFile to the daemon
+}
+
+func (cfg *BackendConfig) buildkitdBinary() string {
+	return binaryPath(cfg.DaemonPath, "BUILDKIT_DAEMON_PATH", "buildkitd")
+}
+
+func (cfg *BackendConfig) buildctlBinary() string {
+	return binaryPath(cfg.BuildctlPath, "BUILDKIT_BUILDCTL_PATH", "buildctl")
+}
+
+func binaryPath(p, env, name string) string {
+	if p != "" {
+		return p
+	}
+	if p := os.Getenv(env); p != "" {
+		return p
+	}
+	return name
+}
+
+// WithDaemonPath returns a SandboxOpt that starts the buildkitd binary at p
+// instead of the one from PATH.
+func WithDaemonPath(p string) SandboxOpt {
+	return binaryPathOpt{daemon: p}
+}
+
+// WithBuildctlPath returns a SandboxOpt that makes Sandbox.Cmd run the
+// buildctl binary at p instead of the one from PATH.
+func WithBuildctlPath(p string) SandboxOpt {
+	return binaryPathOpt{buildctl: p}
+}
+
+type binaryPathOpt struct {
+	daemon   string
+	buildctl string
+}
+
+func (o binaryPathOpt) UpdateBackendConfig(cfg *BackendConfig) {
+	if o.daemon != "" {
+		cfg.DaemonPath = o.daemon
+	}
+	if o.buildctl != "" {
+		cfg.BuildctlPath = o.buildctl
+	}
+}
+
+func (cfg *BackendConfig) stopOpts() stopOpts {
+	return stopOpts{
+		timeout:   cfg.ShutdownTimeout,
+		force:     cfg.ForceShutdown,
+		checkExit: cfg.CheckShutdown,
+	}
 }
 
 type Worker interface {
@@ -67,6 +249,13 @@ type ConfigUpdater interface {
 	UpdateConfigFile(string) string
 }
 
+// SandboxOpt changes the configuration used by a worker to create a backend.
+// Options can be set for all sandboxes with WithSandboxOpts or be used as
+// matrix values.
+type SandboxOpt interface {
+	UpdateBackendConfig(*BackendConfig)
+}
+
 type Test interface {
 	Name() string
 	Run(t *testing.T, sb Sandbox)
@@ -117,23 +306,221 @@ func WithMatrix(key string, m map[string]interface{}) TestOpt {
 	}
 }
 
+// WithMirroredImages adds images that are copied to the local mirror before
+// the tests run. The map is keyed by the target name in the mirror and can be
+// set multiple times. Mapping the same target to different sources fails the
+// tests.
 func WithMirroredImages(m map[string]string) TestOpt {
 	return func(tc *testConf) {
 		if tc.mirroredImages == nil {
 			tc.mirroredImages = map[string]string{}
 		}
 		for k, v := range m {
+			if prev, ok := tc.mirroredImages[k]; ok && prev != v {
+				tc.errs = append(tc.errs, errors.Errorf("conflicting sources for mirrored image %s: %s and %s", k, prev, v))
+				continue
+			}
 			tc.mirroredImages[k] = v
 		}
 	}
 }
 
+// WithMirrorFor configures the mirror registry started by Run to also serve
+// as a mirror for the registry host and seeds it with images. The keys of
+// images are repository names within host, e.g. "coreos/etcd", and the values
+// are the references the images are copied from.
+func WithMirrorFor(host string, images map[string]string) TestOpt {
+	mirrored := WithMirroredImages(images)
+	return func(tc *testConf) {
+		mirrored(tc)
+		tc.sandboxOpts = append(tc.sandboxOpts, mirroredRegistry(host))
+	}
+}
+
+type mirroredRegistry string
+
+func (r mirroredRegistry) UpdateBackendConfig(cfg *BackendConfig) {
+	for _, h := range cfg.mirroredRegistries {
+		if h == string(r) {
+			return
+		}
+	}
+	cfg.mirroredRegistries = append(cfg.mirroredRegistries, string(r))
+}
+
+// WithSandboxOpts applies opts to every sandbox created by Run.
+func WithSandboxOpts(opts ...SandboxOpt) TestOpt {
+	return func(tc *testConf) {
+		tc.sandboxOpts = append(tc.sandboxOpts, opts...)
+	}
+}
+
+// WithParallel limits the number of sandboxes that are alive at the same
+// time for the tests of a single Run call. The global limit of GOMAXPROCS
+// sandboxes still applies on top of it.
+func WithParallel(n int) TestOpt {
+	return func(tc *testConf) {
+		tc.parallel = n
+	}
+}
+
+// WithTimeout sets a deadline for every test, starting once its sandbox is
+// ready. When the deadline is reached the test fails, the sandbox context is
+// cancelled and the daemon is shut down so that a test blocked on it
+// returns. The test body runs on the test goroutine and is not interrupted
+// otherwise.
+func WithTimeout(d time.Duration) TestOpt {
+	return func(tc *testConf) {
+		tc.timeout = d
+	}
+}
+
+// WithMatrixExclude removes the matrix combinations for which exclude
+// returns true. The function receives the chosen value for every matrix
+// dimension. Excluding every combination is an error and fails the test
+// instead of running nothing.
+func WithMatrixExclude(exclude func(map[string]interface{}) bool) TestOpt {
+	return func(tc *testConf) {
+		tc.matrixExclude = append(tc.matrixExclude, exclude)
+	}
+}
+
+// WithMatrixSample runs each test only with n of the matrix combinations,
+// chosen randomly with seed so that the same combinations are selected on
+// every run. The seed is logged and can be overridden with
+// BUILDKIT_MATRIX_SEED to replay a different sample. All combinations run if
+// n is 0 or not smaller than their number.
+func WithMatrixSample(n int, seed int64) TestOpt {
+	return func(tc *testConf) {
+		tc.matrixSample = n
+		tc.matrixSeed = seed
+	}
+}
+
+// WithSharedSandbox makes all tests of the same worker and matrix combination
+// run one after another in a single sandbox instead of starting a new daemon
+// for every test. Combinations still run in parallel with each other. Tests
+// that are not safe to share a daemon can be excluded with
+// WithoutSharedSandbox.
+func WithSharedSandbox() TestOpt {
+	return func(tc *testConf) {
+		tc.sharedSandbox = true
+	}
+}
+
+// WithoutSharedSandbox gives tests a fresh sandbox even if WithSharedSandbox
+// is used, e.g. tests that prune or inspect the whole build cache, count
+// cache misses of common steps, change daemon state with Restart or depend
+// on a clean content store. Tests are matched by name.
+func WithoutSharedSandbox(tests ...Test) TestOpt {
+	return func(tc *testConf) {
+		if tc.unshared == nil {
+			tc.unshared = map[string]struct{}{}
+		}
+		for _, t := range tests {
+			tc.unshared[t.Name()] = struct{}{}
+		}
+	}
+}
+
+// WithBeforeWorker registers a hook that is called once per worker before
+// the first test of that worker runs. If the hook fails, the tests of the
+// worker are skipped.
+func WithBeforeWorker(fn func(worker string) error) TestOpt {
+	return func(tc *testConf) {
+		tc.beforeWorker = append(tc.beforeWorker, fn)
+	}
+}
+
+// WithAfterWorker registers a hook that is called once per worker after all
+// tests of Run have completed. It is only called for workers whose
+// WithBeforeWorker hooks ran successfully.
+func WithAfterWorker(fn func(worker string) error) TestOpt {
+	return func(tc *testConf) {
+		tc.afterWorker = append(tc.afterWorker, fn)
+	}
+}
+
+// workerSetup runs the WithBeforeWorker hooks of a worker once.
+type workerSetup struct {
+	once sync.Once
+	ran  bool
+	err  error
+}
+
+func (ws *workerSetup) do(name string, hooks []func(string) error) error {
+	ws.once.Do(func() {
+		ws.ran = true
+		for _, fn := range hooks {
+			if err := fn(name); err != nil {
+				ws.err = err
+				return
+			}
+		}
+	})
+	return ws.err
+}
+
+// WithDefaultSignalHandling disables the handler that Run installs to stop
+// the daemons and registries it started when the process receives SIGINT or
+// SIGTERM.
+func WithDefaultSignalHandling() TestOpt {
+	return func(tc *testConf) {
+		tc.noSignalHandler = true
+	}
+}
+
+// WithoutMirror runs the tests without the local registry mirror, so that
+// the daemon pulls from docker.io directly. It is meant for tests of the
+// behavior of the real registry such as token auth and rate limits and
+// can't be combined with WithMirroredImages or WithMirrorFor.
+func WithoutMirror() TestOpt {
+	return func(tc *testConf) {
+		tc.noMirror = true
+	}
+}
+
+// WithMirrorStorage makes the mirror registry started by Run keep its data
+// in storage, e.g. an S3 bucket started with NewMinio. The persistent
+// mirror directory set with BUILDKIT_REGISTRY_MIRROR_DIR is not used.
+func WithMirrorStorage(storage RegistryStorage) TestOpt {
+	return func(tc *testConf) {
+		tc.mirrorStorage = &storage
+	}
+}
+
 type testConf struct {
 	matrix         map[string]map[string]interface{}
+	matrixExclude  []func(map[string]interface{}) bool
+	matrixFilter   map[string]string // from BUILDKIT_MATRIX
+	matrixSample   int
+	matrixSeed     int64
 	mirroredImages map[string]string
+	noMirror       bool
+	mirrorStorage  *RegistryStorage
+	sandboxOpts    []SandboxOpt
+	requirements   []Requirement
+	parallel       int
+	timeout        time.Duration
+	sharedSandbox  bool
+	unshared       map[string]struct{} // test names, see WithoutSharedSandbox
+
+	noSignalHandler bool
+	beforeWorker    []func(string) error
+	afterWorker     []func(string) error
+
+	errs []error // invalid options, reported by Run
 }
 
 func Run(t *testing.T, testCases []Test, opt ...TestOpt) {
+	RunContext(context.Background(), t, testCases, opt...)
+}
+
+// RunContext is like Run but stops when ctx is done. The sandbox contexts of
+// the tests are cancelled, running tests fail as if they exceeded the
+// timeout set with WithTimeout and the remaining combinations are skipped.
+// Sandboxes are still closed and cleanups run as usual.
+func RunContext(ctx context.Context, t *testing.T, testCases []Test, opt ...TestOpt) {
 	if testing.Short() {
 		t.Skip("skipping in short mode")
 	}
@@ -142,182 +529,671 @@ func Run(t *testing.T, testCases []Test, opt ...TestOpt) {
 		t.Skip("skipping integration tests")
 	}
 
-	var tc testConf
-	for _, o := range opt {
-		o(&tc)
+	// registered first so that it runs after all other cleanups
+	installLeakCheck(t)
+	tc, mirror := prepareRun(t, opt)
+
+	matrix := runMatrix(t, tc)
+
+	var limiter *semaphore.Weighted
+	if tc.parallel > 0 {
+		limiter = semaphore.NewWeighted(int64(tc.parallel))
 	}
+	timeout := tc.timeout
+	sandboxOpts := tc.sandboxOpts
+	requirements := tc.requirements
+	unshared := tc.unshared
+
+	list := runWorkers(t)
 
-	mirror, cleanup, err := runMirror(t, tc.mirroredImages)
-	require.NoError(t, err)
+	var sharedSandboxes map[string]*sharedSandbox
+	if tc.sharedSandbox {
+		sharedSandboxes = map[string]*sharedSandbox{}
+		// sandboxes whose tests were filtered out with -run are never
+		// released by done
+		t.Cleanup(func() {
+			for _, ss := range sharedSandboxes {
+				ss.mu.Lock()
+				_ = ss.reset()
+				ss.mu.Unlock()
+			}
+		})
+	}
 
-	t.Cleanup(func() { _ = cleanup() })
+	beforeWorker := tc.beforeWorker
+	afterWorker := tc.afterWorker
+	setups := map[string]*workerSetup{}
+	if len(beforeWorker) > 0 || len(afterWorker) > 0 {
+		for _, br := range list {
+			setups[br.Name()] = &workerSetup{}
+		}
+		t.Cleanup(func() {
+			for _, br := range list {
+				ws := setups[br.Name()]
+				if !ws.ran || ws.err != nil {
+					continue
+				}
+				for _, fn := range afterWorker {
+					if err := fn(br.Name()); err != nil {
+						t.Errorf("after worker hook for %s failed: %v", br.Name(), err)
+					}
+				}
+			}
+		})
+	}
 
-	matrix := prepareValueMatrix(tc)
+	t.Cleanup(func() { timings.report(t) })
+	t.Cleanup(func() { skips.report(t) })
 
-	list := List()
-	if os.Getenv("BUILDKIT_WORKER_RANDOM") == "1" && len(list) > 0 {
-		rand.Seed(time.Now().UnixNano())
-		list = []Worker{list[rand.Intn(len(list))]}
+	baseCtx := appcontext.Context()
+	cancellable := ctx.Done() != nil
+	if cancellable {
+		var cancel context.CancelFunc
+		baseCtx, cancel = withCancelFrom(baseCtx, ctx)
+		t.Cleanup(cancel)
 	}
 
 	for _, br := range list {
+		setup := setups[br.Name()]
 		for _, tc := range testCases {
 			for _, mv := range matrix {
 				fn := tc.Name()
 				name := fn + "/worker=" + br.Name() + mv.functionSuffix()
-				func(fn, testName string, br Worker, tc Test, mv matrixValue) {
+				var ss *sharedSandbox
+				if sharedSandboxes != nil {
+					key := br.Name() + mv.functionSuffix()
+					ss = sharedSandboxes[key]
+					if ss == nil {
+						ss = &sharedSandbox{pending: len(testCases)}
+						sharedSandboxes[key] = ss
+					}
+				}
+				func(fn, testName string, br Worker, tc Test, mv matrixValue, ss *sharedSandbox) {
 					ok := t.Run(testName, func(t *testing.T) {
-						if strings.Contains(fn, "NoRootless") && br.Rootless() {
+						if ss != nil {
+							defer ss.done()
+						}
+						start := time.Now()
+						defer func() {
+							timings.record(t, br.Name(), time.Since(start))
+						}()
+						if strings.Contains(fn, "NoRootless") && (br.Rootless() || mv.rootless()) {
 							// skip sandbox setup
 							t.Skip("rootless")
 						}
-						ctx := appcontext.Context()
+						ctx := baseCtx
+						if err := ctx.Err(); err != nil {
+							t.Skipf("run cancelled: %v", err)
+						}
 						if !strings.HasSuffix(fn, "NoParallel") {
 							t.Parallel()
 						}
-						require.NoError(t, sandboxLimiter.Acquire(context.TODO(), 1))
-						defer sandboxLimiter.Release(1)
+						if setup != nil {
+							if err := setup.do(br.Name(), beforeWorker); err != nil {
+								t.Skipf("before worker hook for %s failed: %v", br.Name(), err)
+							}
+						}
+						_, noShare := unshared[fn]
+						shared := ss != nil && !noShare
+						if shared {
+							// taken before the limiters so that tests
+							// waiting for their turn on the sandbox don't
+							// hold slots other combinations could use
+							ss.mu.Lock()
+							defer ss.mu.Unlock()
+						}
+						if limiter != nil {
+							if err := limiter.Acquire(ctx, 1); err != nil {
+								t.Skipf("run cancelled: %v", err)
+							}
+							defer limiter.Release(1)
+						}
+						slots := sandboxesOf(tc)
+						if err := sandboxLimiter.Acquire(ctx, slots); err != nil {
+							t.Skipf("run cancelled: %v", err)
+						}
+						defer sandboxLimiter.Release(slots)
+						start = time.Now()
+
+						// cancelled with the sandbox when the test times out
+						watched := timeout > 0 || cancellable
+						cancelSandbox := func() {}
+						if watched {
+							ctx, cancelSandbox = context.WithCancel(ctx)
+							defer cancelSandbox()
+						}
 
-						sb, closer, err := newSandbox(ctx, br, mirror, mv)
+						var sb Sandbox
+						var closer func() error
+						var err error
+						if shared {
+							sb, err = ss.get(func() (Sandbox, func() error, error) {
+								// not bound to the test creating it
+								return newSandboxWithRetry(baseCtx, t, br, mirror, mv, sandboxOpts)
+							})
+							closer = ss.reset
+						} else {
+							sb, closer, err = newSandboxWithRetry(ctx, t, br, mirror, mv, sandboxOpts)
+						}
+						if errors.Is(err, ErrRequirements) {
+							skipRequirement(t, br.Name(), err)
+						}
 						require.NoError(t, err)
-						t.Cleanup(func() { _ = closer() })
+						if !shared {
+							t.Cleanup(func() {
+								if err := closer(); errors.Is(err, errUncleanShutdown) {
+									t.Error(err)
+								}
+							})
+						}
+						if err := checkRequirements(sb, requirements); err != nil {
+							if errors.Is(err, ErrRequirements) {
+								skipRequirement(t, br.Name(), err)
+							}
+							require.NoError(t, err)
+						}
 						defer func() {
 							if t.Failed() {
 								sb.PrintLogs(t)
+								if goroutineDumpEnabled() {
+									printGoroutines(t, sb)
+								}
 							}
 						}()
+						if s, ok := sb.(*sandbox); ok {
+							defer func() {
+								if err := s.runCleanups(); err != nil {
+									t.Errorf("sandbox cleanup failed: %v", err)
+								}
+							}()
+						}
+						if watched {
+							// started once the sandbox is ready so that the
+							// daemon startup doesn't count against the timeout
+							stop := startWatchdog(baseCtx, timeout, t.Errorf, func() {
+								cancelSandbox()
+								// stopping the daemon unblocks any requests
+								// the test is waiting on. A shared sandbox is
+								// reset while the test still holds its lock.
+								_ = closer()
+							})
+							defer stop()
+						}
 						tc.Run(t, sb)
 					})
 					require.True(t, ok)
-				}(fn, name, br, tc, mv)
+				}(fn, name, br, tc, mv, ss)
 			}
 		}
 	}
 }
 
-func getFunctionName(i interface{}) string {
-	fullname := runtime.FuncForPC(reflect.ValueOf(i).Pointer()).Name()
-	dot := strings.LastIndex(fullname, ".") + 1
-	return strings.Title(fullname[dot:]) //nolint:staticcheck // ignoring "SA1019: strings.Title is deprecated", as for our use we don't need full unicode support
+// prepareRun applies opt and starts the mirror used by all the sandboxes of
+// a Run or RunBenchmark call. The mirror is stopped when tb completes.
+func prepareRun(tb testing.TB, opt []TestOpt) (testConf, string) {
+	var tc testConf
+	for _, o := range opt {
+		o(&tc)
+	}
+	if tc.noMirror && len(tc.mirroredImages) > 0 {
+		tc.errs = append(tc.errs, errors.New("mirrored images can't be used without the mirror"))
+	}
+	for _, err := range tc.errs {
+		require.NoError(tb, err)
+	}
+
+	if !tc.noSignalHandler {
+		installSignalHandler()
+	}
+
+	matrixFilter, err := parseMatrixFilter(os.Getenv("BUILDKIT_MATRIX"))
+	require.NoError(tb, err)
+	tc.matrixFilter = matrixFilter
+
+	var mirror string
+	if !tc.noMirror {
+		var cleanup func() error
+		mirror, cleanup, err = runMirror(tb, tc.mirroredImages, tc.mirrorStorage)
+		require.NoError(tb, err)
+
+		cleanup = trackedCloser(cleanup)
+		tb.Cleanup(func() { _ = cleanup() })
+	}
+
+	return tc, mirror
+}
+
+// runMatrix returns the matrix combinations to run for tc, sampled if
+// WithMatrixSample was used.
+func runMatrix(tb testing.TB, tc testConf) []matrixValue {
+	matrix, err := prepareValueMatrix(tc)
+	require.NoError(tb, err)
+	if tc.matrixSample > 0 && tc.matrixSample < len(matrix) {
+		seed := tc.matrixSeed
+		if v := os.Getenv("BUILDKIT_MATRIX_SEED"); v != "" {
+			seed, err = strconv.ParseInt(v, 10, 64)
+			require.NoError(tb, err, "invalid BUILDKIT_MATRIX_SEED")
+		}
+		tb.Logf("running %d of %d matrix combinations selected with seed %d", tc.matrixSample, len(matrix), seed)
+		matrix = sampleMatrix(matrix, tc.matrixSample, seed)
+	}
+	return matrix
 }
 
-var localImageCache map[string]map[string]struct{}
+// runWorkers returns the workers selected with BUILDKIT_INTEGRATION_WORKERS
+// and BUILDKIT_WORKER_RANDOM.
+func runWorkers(tb testing.TB) []Worker {
+	list, err := filterWorkers(List(), os.Getenv("BUILDKIT_INTEGRATION_WORKERS"))
+	require.NoError(tb, err)
+	if os.Getenv("BUILDKIT_WORKER_RANDOM") == "1" && len(list) > 0 {
+		rand.Seed(time.Now().UnixNano())
+		list = []Worker{list[rand.Intn(len(list))]}
+	}
+	return list
+}
 
-func copyImagesLocal(t *testing.T, host string, images map[string]string) error {
-	for to, from := range images {
-		if localImageCache == nil {
-			localImageCache = map[string]map[string]struct{}{}
+// filterWorkers returns the workers named in the comma-separated names list.
+// All workers are returned if names is empty.
+func filterWorkers(list []Worker, names string) ([]Worker, error) {
+	if names == "" {
+		return list, nil
+	}
+	byName := map[string]Worker{}
+	var available []string
+	for _, w := range list {
+		byName[w.Name()] = w
+		available = append(available, w.Name())
+	}
+	var out []Worker
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		w, ok := byName[name]
+		if !ok {
+			return nil, errors.Errorf("unknown worker %q in BUILDKIT_INTEGRATION_WORKERS, available workers: %s", name, strings.Join(available, ", "))
+		}
+		out = append(out, w)
+	}
+	return out, nil
+}
+
+// sharedSandbox is a sandbox used by all tests of a worker and matrix
+// combination with WithSharedSandbox. mu is held by the test that is using
+// the sandbox.
+type sharedSandbox struct {
+	mu      sync.Mutex
+	sb      Sandbox
+	closer  func() error
+	pending int // tests of the combination that have not finished
+}
+
+// get returns the sandbox, creating it if needed. Must be called with mu held.
+func (ss *sharedSandbox) get(create func() (Sandbox, func() error, error)) (Sandbox, error) {
+	if ss.sb == nil {
+		sb, closer, err := create()
+		if err != nil {
+			return nil, err
+		}
+		ss.sb, ss.closer = sb, closer
+	}
+	return ss.sb, nil
+}
+
+// reset closes the sandbox so that the next test creates a new one. Must be
+// called with mu held.
+func (ss *sharedSandbox) reset() error {
+	if ss.sb == nil {
+		return nil
+	}
+	err := ss.closer()
+	ss.sb, ss.closer = nil, nil
+	return err
+}
+
+// done is called when a test of the combination has finished and closes the
+// sandbox after the last one.
+func (ss *sharedSandbox) done() {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	ss.pending--
+	if ss.pending == 0 {
+		_ = ss.reset()
+	}
+}
+
+// withCancelFrom returns a copy of ctx that is also cancelled when parent
+// is done.
+func withCancelFrom(ctx, parent context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		select {
+		case <-parent.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// startWatchdog reports an error with errorf and calls abort when timeout,
+// if it is not zero, expires or ctx is done before the returned function is
+// called. The test body keeps running on the test goroutine, so abort has to
+// unblock it. The returned function waits for abort to return.
+func startWatchdog(ctx context.Context, timeout time.Duration, errorf func(format string, args ...interface{}), abort func()) (stop func()) {
+	stopped := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		var expired <-chan time.Time
+		if timeout > 0 {
+			timer := time.NewTimer(timeout)
+			defer timer.Stop()
+			expired = timer.C
 		}
-		if _, ok := localImageCache[host]; !ok {
-			localImageCache[host] = map[string]struct{}{}
+		select {
+		case <-stopped:
+			return
+		case <-expired:
+			errorf("test exceeded timeout of %v", timeout)
+		case <-ctx.Done():
+			errorf("run cancelled: %v", ctx.Err())
 		}
-		if _, ok := localImageCache[host][to]; ok {
+		abort()
+	}()
+	return func() {
+		close(stopped)
+		<-done
+	}
+}
+
+func getFunctionName(i interface{}) string {
+	return functionName(runtime.FuncForPC(reflect.ValueOf(i).Pointer()).Name())
+}
+
+// functionName turns a qualified function name like
+// "github.com/moby/buildkit/client.(*suite).testFoo-fm" into a test name.
+// The package path is removed but receivers and enclosing functions of
+// closures are kept so that names stay unique.
+func functionName(fullname string) string {
+	name := fullname[strings.LastIndex(fullname, "/")+1:]
+	if dot := strings.Index(name, "."); dot >= 0 {
+		name = name[dot+1:]
+	}
+	name = strings.TrimSuffix(name, "-fm")
+	name = strings.NewReplacer("(*", "", ")", "", "..", ".").Replace(name)
+	return strings.Title(name) //nolint:staticcheck // ignoring "SA1019: strings.Title is deprecated", as for our use we don't need full unicode support
+}
+
+var (
+	localImageCacheMu sync.Mutex
+	localImageCache   map[string]map[string]struct{}
+)
+
+// markImageCopied records that image to is copied to the mirror at host and
+// reports whether it was recorded before. Top level tests calling Run may
+// run in parallel.
+func markImageCopied(host, to string) bool {
+	localImageCacheMu.Lock()
+	defer localImageCacheMu.Unlock()
+	if localImageCache == nil {
+		localImageCache = map[string]map[string]struct{}{}
+	}
+	if _, ok := localImageCache[host]; !ok {
+		localImageCache[host] = map[string]struct{}{}
+	}
+	if _, ok := localImageCache[host][to]; ok {
+		return true
+	}
+	localImageCache[host][to] = struct{}{}
+	return false
+}
+
+// copyImagesLocal copies images to the mirror at host. The copies run in
+// parallel, bounded by GOMAXPROCS, because the mirror lock is held meanwhile.
+func copyImagesLocal(t testing.TB, host string, images map[string]string) error {
+	eg, ctx := errgroup.WithContext(context.TODO())
+	sem := semaphore.NewWeighted(int64(runtime.GOMAXPROCS(0)))
+	for to, from := range images {
+		if markImageCopied(host, to) {
 			continue
 		}
-		localImageCache[host][to] = struct{}{}
-
-		var desc ocispecs.Descriptor
-		var provider content.Provider
-		var err error
-		if strings.HasPrefix(from, "local:") {
-			var closer func()
-			desc, provider, closer, err = providerFromBinary(strings.TrimPrefix(from, "local:"))
-			if err != nil {
+		to, from := to, from
+		eg.Go(func() error {
+			if err := sem.Acquire(ctx, 1); err != nil {
 				return err
 			}
-			if closer != nil {
-				defer closer()
-			}
-		} else {
-			desc, provider, err = contentutil.ProviderFromRef(from)
+			defer sem.Release(1)
+			copied, err := copyImageLocal(ctx, host, to, from)
 			if err != nil {
-				return err
+				return errors.Wrapf(err, "failed to copy %s to local mirror", from)
 			}
-		}
+			if copied {
+				t.Logf("copied %s to local mirror %s", from, host+"/"+to)
+			}
+			return nil
+		})
+	}
+	return eg.Wait()
+}
 
-		// already exists check
-		_, _, err = docker.NewResolver(docker.ResolverOptions{}).Resolve(context.TODO(), host+"/"+to)
-		if err == nil {
-			continue
-		}
+// copyImageLocal copies from to host/to and reports whether anything was
+// copied.
+func copyImageLocal(ctx context.Context, host, to, from string) (bool, error) {
+	// images already in a persistent mirror are reused without resolving
+	// the source again
+	_, existing, err := docker.NewResolver(docker.ResolverOptions{}).Resolve(ctx, host+"/"+to)
+	if err == nil && !strings.HasPrefix(from, "local:") {
+		return false, nil
+	}
 
-		ingester, err := contentutil.IngesterFromRef(host + "/" + to)
+	var desc ocispecs.Descriptor
+	var provider content.Provider
+	if strings.HasPrefix(from, "local:") {
+		var closer func()
+		desc, provider, closer, err = providerFromBinary(strings.TrimPrefix(from, "local:"))
+		if err != nil {
+			return false, err
+		}
+		if closer != nil {
+			defer closer()
+		}
+	} else {
+		desc, provider, err = contentutil.ProviderFromRef(from)
 		if err != nil {
-			return err
+			return false, err
 		}
-		if err := contentutil.CopyChain(context.TODO(), ingester, provider, desc); err != nil {
-			return err
+		if strings.HasPrefix(from, "docker.io/library/") {
+			if err := checkOfficialImagePlatform(ctx, provider, desc, from); err != nil {
+				return false, err
+			}
 		}
-		t.Logf("copied %s to local mirror %s", from, host+"/"+to)
 	}
-	return nil
+
+	if existing.Digest == desc.Digest {
+		return false, nil
+	}
+
+	// blobs that are already in the mirror, e.g. layers shared with
+	// other images, are skipped by the pusher without fetching them
+	ingester, err := contentutil.IngesterFromRef(host + "/" + to)
+	if err != nil {
+		return false, err
+	}
+	if err := contentutil.CopyChain(ctx, ingester, provider, desc); err != nil {
+		return false, err
+	}
+	return true, nil
 }
 
+// OfficialImages returns the mirror configuration for official images from
+// docker.io. The full manifest list is copied to the mirror so the daemon
+// selects the platform it needs, which works on any architecture and allows
+// testing multi-platform behavior.
 func OfficialImages(names ...string) map[string]string {
-	ns := runtime.GOARCH
-	if ns == "arm64" {
-		ns = "arm64v8"
-	} else if ns != "amd64" && ns != "armhf" {
-		ns = "library"
-	}
 	m := map[string]string{}
 	for _, name := range names {
-		m["library/"+name] = "docker.io/" + ns + "/" + name
+		m["library/"+name] = "docker.io/library/" + name
 	}
 	return m
 }
 
-func withMirrorConfig(mirror string) ConfigUpdater {
-	return mirrorConfig(mirror)
+// checkOfficialImagePlatform returns an error if the manifest list desc of
+// the official image ref has no image for the platform of the host, so that
+// tests on architectures like riscv64 fail with a clear error instead of
+// failing to pull it from the mirror.
+func checkOfficialImagePlatform(ctx context.Context, provider content.Provider, desc ocispecs.Descriptor, ref string) error {
+	if !images.IsIndexType(desc.MediaType) {
+		return nil
+	}
+	dt, err := content.ReadBlob(ctx, provider, desc)
+	if err != nil {
+		return err
+	}
+	var idx ocispecs.Index
+	if err := json.Unmarshal(dt, &idx); err != nil {
+		return errors.Wrapf(err, "invalid manifest list of %s", ref)
+	}
+	return indexHasPlatform(idx, platforms.DefaultSpec(), ref)
+}
+
+// indexHasPlatform returns an error listing the platforms of idx if none of
+// its manifests matches p.
+func indexHasPlatform(idx ocispecs.Index, p ocispecs.Platform, ref string) error {
+	m := platforms.Only(p)
+	var available []string
+	for _, d := range idx.Manifests {
+		if d.Platform == nil {
+			continue
+		}
+		if m.Match(*d.Platform) {
+			return nil
+		}
+		available = append(available, platforms.Format(*d.Platform))
+	}
+	return errors.Errorf("%s has no image for %s, available platforms: %s", ref, platforms.Format(p), strings.Join(available, ", "))
+}
+
+func withMirrorConfig(mirror string, registries ...string) ConfigUpdater {
+	return mirrorConfig{mirror: mirror, registries: append([]string{"docker.io"}, registries...)}
 }
 
-type mirrorConfig string
+type mirrorConfig struct {
+	mirror     string
+	registries []string
+}
 
 func (mc mirrorConfig) UpdateConfigFile(in string) string {
-	return fmt.Sprintf(`%s
+	for _, r := range mc.registries {
+		in = fmt.Sprintf(`%s
 
-[registry."docker.io"]
+[registry."%s"]
 mirrors=["%s"]
-`, in, mc)
+`, in, r, mc.mirror)
+	}
+	return in
 }
 
-func writeConfig(updaters []ConfigUpdater) (string, error) {
-	tmpdir, err := os.MkdirTemp("", "bktest_config")
-	if err != nil {
-		return "", err
-	}
-	if err := os.Chmod(tmpdir, 0711); err != nil {
-		return "", err
-	}
+// RegistryPlain and RegistryTLS can be used as values of a matrix dimension
+// to run a test against both a plaintext and a TLS-enabled registry. With
+// RegistryTLS, every call to Sandbox.NewRegistry starts a registry with a
+// certificate signed by a CA of the sandbox. The daemon trusts the CA through
+// its CA bundle, see WithCACert.
+var (
+	RegistryPlain = registryMode("plain")
+	RegistryTLS   = registryMode("tls")
+)
 
-	s := ""
-	for _, upt := range updaters {
-		s = upt.UpdateConfigFile(s)
-	}
+type registryMode string
+
+// RootlessEnabled and RootlessDisabled can be used as values of a matrix
+// dimension to run the tests of a worker both with and without rootless mode
+// instead of registering a separate rootless worker. Workers that can't run
+// in the selected mode are skipped.
+var (
+	RootlessEnabled  = rootlessMode(true)
+	RootlessDisabled = rootlessMode(false)
+)
+
+type rootlessMode bool
+
+// WithGracefulShutdown returns a SandboxOpt that gives the daemon grace time
+// to exit after SIGTERM when the sandbox is closed. The test fails if the
+// daemon has to be killed or exits with a non-zero code.
+func WithGracefulShutdown(grace time.Duration) SandboxOpt {
+	return shutdownOpt{timeout: grace, check: true}
+}
+
+// WithForcedShutdown returns a SandboxOpt that kills the daemon with SIGKILL
+// when the sandbox is closed.
+func WithForcedShutdown() SandboxOpt {
+	return shutdownOpt{force: true}
+}
+
+type shutdownOpt struct {
+	timeout time.Duration
+	force   bool
+	check   bool
+}
 
-	if err := os.WriteFile(filepath.Join(tmpdir, buildkitdConfigFile), []byte(s), 0644); err != nil {
-		return "", err
+func (o shutdownOpt) UpdateBackendConfig(cfg *BackendConfig) {
+	cfg.ShutdownTimeout = o.timeout
+	cfg.ForceShutdown = o.force
+	cfg.CheckShutdown = o.check
+}
+
+// RootlessNet selects the rootlesskit network driver, e.g. "host" or
+// "slirp4netns", for rootless workers. Used as a matrix value the chosen
+// driver is available to tests through Sandbox.Value. Sandboxes that are not
+// rootless are skipped. Note that the local mirror is only reachable with
+// host networking.
+type RootlessNet string
+
+func (n RootlessNet) UpdateBackendConfig(cfg *BackendConfig) {
+	cfg.RootlessNet = string(n)
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
 	}
-	return tmpdir, nil
+	return false
 }
 
-func runMirror(t *testing.T, mirroredImages map[string]string) (host string, _ func() error, err error) {
+func runMirror(t testing.TB, mirroredImages map[string]string, storage *RegistryStorage) (host string, _ func() error, err error) {
 	mirrorDir := os.Getenv("BUILDKIT_REGISTRY_MIRROR_DIR")
+	if storage != nil {
+		// the config in a persistent directory would select its storage
+		mirrorDir = ""
+	}
 
-	var lock *flock.Flock
 	if mirrorDir != "" {
-		lock = flock.New(filepath.Join(mirrorDir, "lock"))
+		if err := os.MkdirAll(mirrorDir, 0700); err != nil {
+			return "", nil, err
+		}
+		// the lock is only needed while the shared mirror directory is being
+		// populated and is released on every return path
+		lock := flock.New(filepath.Join(mirrorDir, "lock"))
 		if err := lock.Lock(); err != nil {
 			return "", nil, err
 		}
 		defer func() {
-			if err != nil {
-				lock.Unlock()
+			if err := lock.Unlock(); err != nil {
+				t.Logf("failed to unlock %s: %v", lock.Path(), err)
 			}
 		}()
 	}
 
-	mirror, cleanup, err := NewRegistry(mirrorDir)
+	var mirror string
+	var cleanup func() error
+	if storage != nil {
+		mirror, cleanup, err = NewRegistryWithStorage(mirrorDir, *storage)
+	} else {
+		mirror, cleanup, err = NewRegistry(mirrorDir)
+	}
 	if err != nil {
 		return "", nil, err
 	}
@@ -331,74 +1207,9 @@ func runMirror(t *testing.T, mirroredImages map[string]string) (host string, _ f
 		return "", nil, err
 	}
 
-	if mirrorDir != "" {
-		if err := lock.Unlock(); err != nil {
-			return "", nil, err
-		}
-	}
-
 	return mirror, cleanup, err
 }
 
-type matrixValue struct {
-	fn     []string
-	values map[string]matrixValueChoice
-}
-
-func (mv matrixValue) functionSuffix() string {
-	if len(mv.fn) == 0 {
-		return ""
-	}
-	sort.Strings(mv.fn)
-	sb := &strings.Builder{}
-	for _, f := range mv.fn {
-		sb.Write([]byte("/" + f + "=" + mv.values[f].name))
-	}
-	return sb.String()
-}
-
-type matrixValueChoice struct {
-	name  string
-	value interface{}
-}
-
-func newMatrixValue(key, name string, v interface{}) matrixValue {
-	return matrixValue{
-		fn: []string{key},
-		values: map[string]matrixValueChoice{
-			key: {
-				name:  name,
-				value: v,
-			},
-		},
-	}
-}
-
-func prepareValueMatrix(tc testConf) []matrixValue {
-	m := []matrixValue{}
-	for featureName, values := range tc.matrix {
-		current := m
-		m = []matrixValue{}
-		for featureValue, v := range values {
-			if len(current) == 0 {
-				m = append(m, newMatrixValue(featureName, featureValue, v))
-			}
-			for _, c := range current {
-				vv := newMatrixValue(featureName, featureValue, v)
-				vv.fn = append(vv.fn, c.fn...)
-				for k, v := range c.values {
-					vv.values[k] = v
-				}
-				m = append(m, vv)
-			}
-		}
-	}
-	if len(m) == 0 {
-		m = append(m, matrixValue{})
-	}
-	return m
-}
-
 func runStargzSnapshotter(cfg *BackendConfig) (address string, cl func() error, err error) {
 	binary := "containerd-stargz-grpc"
 	if err := lookupBinary(binary); err != nil {
@@ -0,0 +1,245 @@
+package integration
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sync/semaphore"
+)
+
+type functionNameSuite struct{}
+
+func (functionNameSuite) testValue(t *testing.T, sb Sandbox)    {}
+func (*functionNameSuite) testPointer(t *testing.T, sb Sandbox) {}
+
+func testFunctionNameFree(t *testing.T, sb Sandbox) {}
+
+func TestGetFunctionName(t *testing.T) {
+	s := &functionNameSuite{}
+	closure := func(t *testing.T, sb Sandbox) {}
+
+	require.Equal(t, "TestFunctionNameFree", getFunctionName(testFunctionNameFree))
+	require.Equal(t, "FunctionNameSuite.TestValue", getFunctionName(functionNameSuite{}.testValue))
+	require.Equal(t, "FunctionNameSuite.TestPointer", getFunctionName(s.testPointer))
+	require.Equal(t, "TestGetFunctionName.Func1", getFunctionName(closure))
+
+	names := map[string]struct{}{}
+	for _, tc := range TestFuncs(testFunctionNameFree, functionNameSuite{}.testValue, s.testPointer, closure) {
+		names[tc.Name()] = struct{}{}
+	}
+	require.Len(t, names, 4)
+}
+
+func TestWithCancelFrom(t *testing.T) {
+	parent, cancelParent := context.WithCancel(context.Background())
+	ctx, cancel := withCancelFrom(context.Background(), parent)
+	defer cancel()
+	require.NoError(t, ctx.Err())
+	cancelParent()
+	<-ctx.Done()
+	require.ErrorIs(t, ctx.Err(), context.Canceled)
+
+	ctx, cancel = withCancelFrom(context.Background(), context.Background())
+	cancel()
+	require.ErrorIs(t, ctx.Err(), context.Canceled)
+}
+
+func TestWatchdogStuckBody(t *testing.T) {
+	var errs []string
+	errorf := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Sprintf(format, args...))
+	}
+	unblock := make(chan struct{})
+	stop := startWatchdog(context.Background(), 50*time.Millisecond, errorf, func() {
+		close(unblock)
+	})
+	// a body stuck until the sandbox is closed, running on the test goroutine
+	<-unblock
+	stop()
+	require.Equal(t, []string{"test exceeded timeout of 50ms"}, errs)
+
+	errs = nil
+	stop = startWatchdog(context.Background(), time.Hour, errorf, func() {
+		t.Error("unexpected abort")
+	})
+	stop()
+	require.Empty(t, errs)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	aborted := make(chan struct{})
+	stop = startWatchdog(ctx, 0, errorf, func() { close(aborted) })
+	cancel()
+	<-aborted
+	stop()
+	require.Equal(t, []string{"run cancelled: context canceled"}, errs)
+}
+
+// fakeWorker is a worker without a daemon for testing Run itself. It is used
+// with a buildctl that always succeeds, so the sandboxes are ready at once.
+type fakeWorker struct{}
+
+func (fakeWorker) New(context.Context, *BackendConfig) (Backend, func() error, error) {
+	return backend{address: "unix:///nonexistent.sock"}, func() error { return nil }, nil
+}
+
+func (fakeWorker) Name() string {
+	return "fake"
+}
+
+func (fakeWorker) Rootless() bool {
+	return false
+}
+
+// testParallelism returns the number of parallel tests allowed by -parallel.
+func testParallelism() int {
+	n, _ := strconv.Atoi(flag.Lookup("test.parallel").Value.String())
+	return n
+}
+
+// setSandboxLimit replaces the limit of sandboxes alive at the same time in
+// all Run calls, GOMAXPROCS by default, until t completes.
+func setSandboxLimit(t *testing.T, n int) {
+	prev, prevLimit := sandboxLimiter, sandboxLimit
+	sandboxLimiter, sandboxLimit = semaphore.NewWeighted(int64(n)), int64(n)
+	t.Cleanup(func() { sandboxLimiter, sandboxLimit = prev, prevLimit })
+}
+
+// runFake runs tests with Run on fakeWorker and returns once all of them
+// have completed.
+func runFake(t *testing.T, tests []Test, opts ...TestOpt) {
+	prev := defaultWorkers
+	defaultWorkers = []Worker{fakeWorker{}}
+	defer func() { defaultWorkers = prev }()
+	for _, k := range []string{"BUILDKIT_INTEGRATION_WORKERS", "BUILDKIT_WORKER_RANDOM", "BUILDKIT_MATRIX"} {
+		t.Setenv(k, "")
+	}
+
+	buildctl := filepath.Join(t.TempDir(), "buildctl")
+	require.NoError(t, os.WriteFile(buildctl, []byte("#!/bin/sh\nexit 0\n"), 0700))
+	opts = append([]TestOpt{WithoutMirror(), WithSandboxOpts(WithBuildctlPath(buildctl))}, opts...)
+	// parallel subtests only complete with their parent
+	t.Run("run", func(t *testing.T) {
+		Run(t, tests, opts...)
+	})
+}
+
+func TestRunSharedSandbox(t *testing.T) {
+	var mu sync.Mutex
+	sandboxes := map[string][]string{}
+	record := func(name string) Test {
+		return testFunc{name: name, run: func(t *testing.T, sb Sandbox) {
+			mu.Lock()
+			sandboxes[name] = append(sandboxes[name], sb.TempDir())
+			mu.Unlock()
+		}}
+	}
+	tests := []Test{record("first"), record("second"), record("unshared")}
+	runFake(t, tests,
+		WithMatrix("mode", map[string]interface{}{"a": "a", "b": "b"}),
+		WithSharedSandbox(),
+		WithoutSharedSandbox(tests[2]),
+	)
+
+	for _, name := range []string{"first", "second", "unshared"} {
+		require.Len(t, sandboxes[name], 2, name)
+	}
+	require.ElementsMatch(t, sandboxes["first"], sandboxes["second"])
+	require.NotEqual(t, sandboxes["first"][0], sandboxes["first"][1])
+	for _, dir := range sandboxes["unshared"] {
+		require.NotContains(t, sandboxes["first"], dir)
+	}
+}
+
+func TestRunSharedSandboxLimiter(t *testing.T) {
+	// the tests of a combination waiting for its sandbox count against
+	// -parallel
+	if testParallelism() < 4 {
+		t.Skip("requires -parallel 4 or more")
+	}
+	setSandboxLimit(t, 2)
+
+	// the first test of combination a holds its sandbox until all tests of b
+	// have run, which only happens if the tests of a waiting for the
+	// sandbox don't take the remaining slot
+	names := []string{"first", "second", "third"}
+	var mu sync.Mutex
+	var doneB int
+	var sawB bool
+	var tests []Test
+	for _, name := range names {
+		name := name
+		tests = append(tests, testFunc{name: name, run: func(t *testing.T, sb Sandbox) {
+			if mode, _ := sb.ValueString("mode"); mode == "b" {
+				mu.Lock()
+				doneB++
+				mu.Unlock()
+				return
+			}
+			if name != "first" {
+				return
+			}
+			for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+				mu.Lock()
+				sawB = doneB == len(names)
+				mu.Unlock()
+				if sawB {
+					return
+				}
+			}
+		}})
+	}
+	runFake(t, tests,
+		WithMatrix("mode", map[string]interface{}{"a": "a", "b": "b"}),
+		WithSharedSandbox(),
+	)
+	require.True(t, sawB)
+}
+
+func TestRunParallelLimit(t *testing.T) {
+	setSandboxLimit(t, 8)
+	var mu sync.Mutex
+	var running, max int
+	var tests []Test
+	for _, name := range []string{"first", "second", "third", "fourth"} {
+		tests = append(tests, testFunc{name: name, run: func(t *testing.T, sb Sandbox) {
+			mu.Lock()
+			running++
+			if running > max {
+				max = running
+			}
+			mu.Unlock()
+			// long enough for the other bodies to start if they could
+			time.Sleep(50 * time.Millisecond)
+			mu.Lock()
+			running--
+			mu.Unlock()
+		}})
+	}
+	runFake(t, tests,
+		WithMatrix("mode", map[string]interface{}{"a": "a", "b": "b"}),
+		WithParallel(2),
+	)
+	require.LessOrEqual(t, max, 2)
+	if testParallelism() > 2 {
+		// not serialized either
+		require.Equal(t, 2, max)
+	}
+}
+
+func TestSandboxesOf(t *testing.T) {
+	setSandboxLimit(t, 8)
+	require.Equal(t, int64(1), sandboxesOf(TestFuncs(testFunctionNameFree)[0]))
+	require.Equal(t, int64(2), sandboxesOf(testPair{}))
+
+	// a pair still runs if only one sandbox is allowed at a time
+	setSandboxLimit(t, 1)
+	require.Equal(t, int64(1), sandboxesOf(testPair{}))
+}
@@ -0,0 +1,111 @@
+package integration
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+// TestTwo is a test that needs two independent daemons, e.g. one exporting
+// cache and one importing it.
+type TestTwo interface {
+	Name() string
+	Run(t *testing.T, a, b Sandbox)
+}
+
+type testTwoFunc struct {
+	name string
+	run  func(t *testing.T, a, b Sandbox)
+}
+
+func (f testTwoFunc) Name() string {
+	return f.name
+}
+
+func (f testTwoFunc) Run(t *testing.T, a, b Sandbox) {
+	t.Helper()
+	f.run(t, a, b)
+}
+
+func TestTwoFuncs(funcs ...func(t *testing.T, a, b Sandbox)) []TestTwo {
+	var tests []TestTwo
+	for _, f := range funcs {
+		tests = append(tests, testTwoFunc{name: getFunctionName(f), run: f})
+	}
+	return tests
+}
+
+// RunTwo runs every test with two sandboxes. The first sandbox is created by
+// Run for every worker and matrix combination. The second one uses the same
+// matrix values, mirror and options and is started for every worker in turn,
+// so tests are named like Test/worker=oci/peer=containerd. Both sandboxes are
+// closed when the test completes.
+func RunTwo(t *testing.T, testCases []TestTwo, opt ...TestOpt) {
+	var tc testConf
+	for _, o := range opt {
+		o(&tc)
+	}
+	peers, err := filterWorkers(List(), os.Getenv("BUILDKIT_INTEGRATION_WORKERS"))
+	require.NoError(t, err)
+
+	tests := make([]Test, 0, len(testCases))
+	for _, test := range testCases {
+		tests = append(tests, testPair{test: test, peers: peers, opts: tc.sandboxOpts, requirements: tc.requirements})
+	}
+	Run(t, tests, opt...)
+}
+
+// testPair adapts a TestTwo to a Test that starts the second sandbox.
+type testPair struct {
+	test         TestTwo
+	peers        []Worker
+	opts         []SandboxOpt
+	requirements []Requirement
+}
+
+func (p testPair) Name() string {
+	return p.test.Name()
+}
+
+// sandboxes makes Run take a slot of the sandbox limiter for the peer too.
+// The peers are started one after the other, so there are never more than
+// two sandboxes.
+func (p testPair) sandboxes() int64 {
+	return 2
+}
+
+func (p testPair) Run(t *testing.T, a Sandbox) {
+	sa, ok := a.(*sandbox)
+	require.True(t, ok, "unexpected sandbox type %T", a)
+	for _, w := range p.peers {
+		w := w
+		t.Run("peer="+w.Name(), func(t *testing.T) {
+			if strings.Contains(p.test.Name(), "NoRootless") && w.Rootless() {
+				t.Skip("rootless")
+			}
+			b, closer, err := newSandboxWithRetry(sa.ctx, t, w, sa.mirror, sa.mv, p.opts)
+			if errors.Is(err, ErrRequirements) {
+				skipRequirement(t, w.Name(), err)
+			}
+			require.NoError(t, err)
+			defer func() {
+				require.NoError(t, closer())
+			}()
+			if err := checkRequirements(b, p.requirements); err != nil {
+				if errors.Is(err, ErrRequirements) {
+					skipRequirement(t, w.Name(), err)
+				}
+				require.NoError(t, err)
+			}
+			defer func() {
+				if t.Failed() {
+					b.PrintLogs(t)
+				}
+			}()
+			p.test.Run(t, a, b)
+		})
+	}
+}
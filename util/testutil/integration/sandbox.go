@@ -4,18 +4,24 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"reflect"
 	"runtime"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/google/shlex"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
+	tracev1 "go.opentelemetry.io/proto/otlp/trace/v1"
 )
 
 const buildkitdConfigFile = "buildkitd.toml"
@@ -26,6 +32,9 @@ type backend struct {
 	rootless          bool
 	snapshotter       string
 	isDockerd         bool
+	daemon            *daemonProcess // process started by the worker
+	buildctlAddress   string         // BUILDKIT_HOST for Cmd if it differs from address
+	dockerAddress     string         // Docker daemon started by the worker
 }
 
 func (b backend) Address() string {
@@ -48,53 +57,402 @@ type sandbox struct {
 	Backend
 
 	logs    map[string]*bytes.Buffer
-	cleanup *multiCloser
+	mu      sync.Mutex
+	cleanup *multiCloser // functions registered with Cleanup
 	mv      matrixValue
 	ctx     context.Context
 	name    string
+	mirror  string
+
+	dockerConfigDir string
+	auths           map[string]string
+	registryCA      *registryCA // set with RegistryTLS
+	configFile      string
+	daemonArgs      []string // command line the daemon was started with
+	tempDir         string
+	traces          *traceCollector
+	debugAddress    string
+	registryFactory RegistryFactory
+	buildctl        string
+	hosts           map[string]string // passed to builds with add-hosts
+	resourceLimits  *ResourceLimits
+	grpcRecorder    string // address of the recording proxy, see Address
+}
+
+func (sb *sandbox) TempDir() string {
+	return sb.tempDir
 }
 
 func (sb *sandbox) Name() string {
 	return sb.name
 }
 
+func (sb *sandbox) MirrorHost() string {
+	return sb.mirror
+}
+
+func (sb *sandbox) Traces() []*tracev1.Span {
+	if sb.traces == nil {
+		return nil
+	}
+	return sb.traces.Spans()
+}
+
 func (sb *sandbox) Context() context.Context {
 	return sb.ctx
 }
 
 func (sb *sandbox) PrintLogs(t *testing.T) {
-	printLogs(sb.logs, t.Log)
+	sb.printLogs(t.Log)
+}
+
+func (sb *sandbox) printLogs(f func(args ...interface{})) {
+	printLogs(sb.logs, f)
+	sb.printConfig(f)
+}
+
+// printConfig prints the command line of the daemon and the config file it
+// was started with.
+func (sb *sandbox) printConfig(f func(args ...interface{})) {
+	if len(sb.daemonArgs) > 0 {
+		f("daemon command: " + strings.Join(sb.daemonArgs, " "))
+	}
+	if sb.configFile == "" {
+		return
+	}
+	dt, err := os.ReadFile(sb.configFile)
+	if err != nil {
+		f(fmt.Sprintf("failed to read config %s: %v", sb.configFile, err))
+		return
+	}
+	f(sb.configFile)
+	s := bufio.NewScanner(bytes.NewReader(dt))
+	for s.Scan() {
+		f(s.Text())
+	}
+}
+
+// SandboxLogs contains the output of the processes started for a sandbox,
+// keyed by the path of the process binary.
+type SandboxLogs struct {
+	Stdout map[string][]byte
+	Stderr map[string][]byte
+}
+
+// ResourceStats describes the resource usage of the daemon process started
+// for a sandbox and all its descendants that are still running.
+type ResourceStats struct {
+	// PeakRSS is the sum of the peak resident set sizes of the processes in
+	// bytes.
+	PeakRSS int64
+	// CPUTime is the user and system time consumed by the processes and
+	// their exited children.
+	CPUTime time.Duration
+}
+
+func (sb *sandbox) Stats() (ResourceStats, error) {
+	b, ok := sb.Backend.(backend)
+	if !ok || b.daemon == nil || b.daemon.process().Process == nil {
+		return ResourceStats{}, errors.Errorf("daemon process of %s worker is unknown", sb.name)
+	}
+	return processTreeStats(b.daemon.process().Process.Pid)
+}
+
+// Restart stops the daemon and starts it again with the same configuration
+// and state directory. It returns once the daemon is ready.
+func (sb *sandbox) Restart() error {
+	b, ok := sb.Backend.(backend)
+	if !ok || b.daemon == nil {
+		return RequirementErrorf(SkipUnsupportedWorker, "restart is not supported by the %s worker", sb.name)
+	}
+	if err := b.daemon.Restart(); err != nil {
+		return errors.Wrapf(err, "failed to restart %s daemon", sb.name)
+	}
+	ctx, cancel := context.WithTimeout(sb.ctx, 30*time.Second)
+	defer cancel()
+	return sb.WaitReady(ctx)
+}
+
+func (sb *sandbox) Logs() SandboxLogs {
+	l := SandboxLogs{
+		Stdout: map[string][]byte{},
+		Stderr: map[string][]byte{},
+	}
+	for name, dt := range copyLogs(sb.logs) {
+		if p, ok := cutPrefix(name, "stdout: "); ok {
+			l.Stdout[p] = dt
+		} else if p, ok := cutPrefix(name, "stderr: "); ok {
+			l.Stderr[p] = dt
+		}
+	}
+	return l
+}
+
+func cutPrefix(s, prefix string) (string, bool) {
+	if !strings.HasPrefix(s, prefix) {
+		return s, false
+	}
+	return s[len(prefix):], true
 }
 
 func (sb *sandbox) NewRegistry() (string, error) {
-	url, cl, err := NewRegistry("")
+	return sb.newRegistry(registryOpt{})
+}
+
+func (sb *sandbox) NewRegistryWithAuth(user, pass string) (string, error) {
+	if user == "" {
+		return "", errors.Errorf("user is required for registry with auth")
+	}
+	url, err := sb.newRegistry(registryOpt{user: user, pass: pass})
 	if err != nil {
 		return "", err
 	}
-	sb.cleanup.append(cl)
+	if err := sb.addRegistryAuth(url, user, pass); err != nil {
+		return "", err
+	}
 	return url, nil
 }
 
+// newRegistry starts a registry for the sandbox with the factory selected
+// with WithRegistryFactory. The registry serves TLS if RegistryTLS is
+// selected through the matrix. Only the registries of DefaultRegistry
+// support TLS and authentication, other factories return an error wrapping
+// ErrRequirements for them.
+func (sb *sandbox) newRegistry(opt registryOpt) (string, error) {
+	f := sb.registryFactory
+	if f == nil {
+		f = DefaultRegistry
+	}
+	if _, ok := f.(localRegistry); ok {
+		if sb.registryCA != nil {
+			opt.tls = true
+			opt.issuer = sb.registryCA
+		}
+		opt.gc = true
+		url, cl, err := newRegistry("", &opt)
+		if err != nil {
+			return "", err
+		}
+		sb.Cleanup(cl)
+		return url, nil
+	}
+
+	switch {
+	case sb.registryCA != nil:
+		return "", RequirementErrorf(SkipUnsupportedWorker, "registry factory %T does not support TLS", f)
+	case opt.user != "":
+		return "", RequirementErrorf(SkipUnsupportedWorker, "registry factory %T does not support authentication", f)
+	}
+	url, cl, err := f.NewRegistry("")
+	if err != nil {
+		return "", err
+	}
+	sb.Cleanup(cl)
+	if gc, ok := f.(RegistryGarbageCollector); ok {
+		sb.Cleanup(registerRegistryGC(url, func() error {
+			return gc.GarbageCollect(url)
+		}))
+	}
+	return url, nil
+}
+
+// addRegistryAuth writes credentials for host into a docker config
+// directory that is passed to buildctl through DOCKER_CONFIG.
+func (sb *sandbox) addRegistryAuth(host, user, pass string) error {
+	if sb.dockerConfigDir == "" {
+		dir, err := os.MkdirTemp("", "bktest_dockerconfig")
+		if err != nil {
+			return err
+		}
+		// cleanups run after every test of a shared sandbox
+		sb.Cleanup(func() error {
+			sb.dockerConfigDir = ""
+			sb.auths = nil
+			return os.RemoveAll(dir)
+		})
+		sb.dockerConfigDir = dir
+		sb.auths = map[string]string{}
+	}
+	sb.auths[host] = base64.StdEncoding.EncodeToString([]byte(user + ":" + pass))
+
+	type authConfig struct {
+		Auth string `json:"auth"`
+	}
+	cfg := struct {
+		Auths map[string]authConfig `json:"auths"`
+	}{Auths: map[string]authConfig{}}
+	for h, a := range sb.auths {
+		cfg.Auths[h] = authConfig{Auth: a}
+	}
+	dt, err := json.Marshal(cfg)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(sb.dockerConfigDir, "config.json"), dt, 0600)
+}
+
+func (sb *sandbox) Cleanup(f func() error) {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	sb.cleanup.append(f)
+}
+
+// runCleanups calls the functions registered with Cleanup so far. It is
+// called by Run after every test so that a shared sandbox doesn't keep the
+// state of previous tests, and when the sandbox is closed.
+func (sb *sandbox) runCleanups() error {
+	sb.mu.Lock()
+	mc := sb.cleanup
+	sb.cleanup = &multiCloser{}
+	sb.mu.Unlock()
+	return mc.F()()
+}
+
 func (sb *sandbox) Cmd(args ...string) *exec.Cmd {
 	if len(args) == 1 {
 		if split, err := shlex.Split(args[0]); err == nil {
 			args = split
 		}
 	}
-	cmd := exec.Command("buildctl", args...)
+	cmd := exec.Command(sb.buildctl, args...)
 	cmd.Env = append(cmd.Env, os.Environ()...)
-	cmd.Env = append(cmd.Env, "BUILDKIT_HOST="+sb.Address())
+	addr := sb.buildctlAddress()
+	if sb.grpcRecorder != "" {
+		addr = sb.grpcRecorder
+	}
+	cmd.Env = append(cmd.Env, "BUILDKIT_HOST="+addr)
+	if sb.dockerConfigDir != "" {
+		cmd.Env = append(cmd.Env, "DOCKER_CONFIG="+sb.dockerConfigDir)
+	}
 	return cmd
 }
 
+// Address returns the address of the daemon, or of the proxy recording the
+// calls to it if the sandbox was created with WithGRPCRecording.
+func (sb *sandbox) Address() string {
+	if sb.grpcRecorder != "" {
+		return sb.grpcRecorder
+	}
+	return sb.Backend.Address()
+}
+
+// buildctlAddress returns the address of the daemon for buildctl.
+func (sb *sandbox) buildctlAddress() string {
+	if b, ok := sb.Backend.(backend); ok && b.buildctlAddress != "" {
+		return b.buildctlAddress
+	}
+	return sb.Backend.Address()
+}
+
+// WaitReady polls the daemon with "buildctl debug info" until it responds
+// or ctx is done.
+func (sb *sandbox) WaitReady(ctx context.Context) error {
+	step := 50 * time.Millisecond
+	for {
+		c := sb.Cmd("--timeout", "1", "debug", "info")
+		cmd := exec.CommandContext(ctx, c.Path, c.Args[1:]...)
+		cmd.Env = c.Env
+		out, err := cmd.CombinedOutput()
+		// daemons that don't implement the info API, like older dockerd,
+		// are ready once they answer
+		if err == nil || bytes.Contains(out, []byte("Unimplemented")) {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return errors.Wrapf(ctx.Err(), "daemon is not ready: %s", bytes.TrimSpace(out))
+		case <-time.After(step):
+		}
+	}
+}
+
+func (sb *sandbox) Exec(args ...string) (stdout, stderr []byte, exitCode int, err error) {
+	cmd := sb.Cmd(args...)
+	var outBuf, errBuf bytes.Buffer
+	cmd.Stdout = &outBuf
+	cmd.Stderr = &errBuf
+	if err := cmd.Run(); err != nil {
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) {
+			return nil, nil, -1, errors.Wrapf(err, "failed to run %v", cmd.Args)
+		}
+	}
+	return outBuf.Bytes(), errBuf.Bytes(), cmd.ProcessState.ExitCode(), nil
+}
+
 func (sb *sandbox) Value(k string) interface{} {
 	return sb.mv.values[k].value
 }
 
-func newSandbox(ctx context.Context, w Worker, mirror string, mv matrixValue) (s Sandbox, cl func() error, err error) {
+func (sb *sandbox) Values() map[string]interface{} {
+	return sb.mv.valueMap()
+}
+
+func (sb *sandbox) ValueString(k string) (string, bool) {
+	v, ok := sb.value(k, reflect.String)
+	if !ok {
+		return "", false
+	}
+	return v.String(), true
+}
+
+func (sb *sandbox) ValueBool(k string) (bool, bool) {
+	v, ok := sb.value(k, reflect.Bool)
+	if !ok {
+		return false, false
+	}
+	return v.Bool(), true
+}
+
+// value looks up a matrix value by kind so that named types like
+// RootlessNet can be read through the typed accessors.
+func (sb *sandbox) value(k string, kind reflect.Kind) (reflect.Value, bool) {
+	c, ok := sb.mv.values[k]
+	if !ok || c.value == nil {
+		return reflect.Value{}, false
+	}
+	v := reflect.ValueOf(c.value)
+	if v.Kind() != kind {
+		return reflect.Value{}, false
+	}
+	return v, true
+}
+
+// transientRetries is the number of times creating a sandbox is retried
+// after an ErrTransient error.
+const transientRetries = 2
+
+// newSandboxWithRetry calls newSandbox and retries with backoff if it fails
+// with ErrTransient.
+func newSandboxWithRetry(ctx context.Context, t testing.TB, w Worker, mirror string, mv matrixValue, opts []SandboxOpt) (Sandbox, func() error, error) {
+	backoff := 500 * time.Millisecond
+	for i := 0; ; i++ {
+		sb, cl, err := newSandbox(ctx, t, w, mirror, mv, opts)
+		if err == nil || !errors.Is(err, ErrTransient) || i == transientRetries {
+			return sb, cl, err
+		}
+		t.Logf("retrying sandbox for %s in %v after transient error: %v", w.Name(), backoff, err)
+		select {
+		case <-ctx.Done():
+			return nil, nil, err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+func newSandbox(ctx context.Context, t testing.TB, w Worker, mirror string, mv matrixValue, opts []SandboxOpt) (s Sandbox, cl func() error, err error) {
 	cfg := &BackendConfig{
 		Logs: make(map[string]*bytes.Buffer),
 	}
+	for _, o := range opts {
+		o.UpdateBackendConfig(cfg)
+	}
+	for _, v := range mv.values {
+		if o, ok := v.value.(SandboxOpt); ok {
+			o.UpdateBackendConfig(cfg)
+		}
+	}
 
 	var upt []ConfigUpdater
 	for _, v := range mv.values {
@@ -104,21 +462,122 @@ func newSandbox(ctx context.Context, w Worker, mirror string, mv matrixValue) (s
 	}
 
 	if mirror != "" {
-		upt = append(upt, withMirrorConfig(mirror))
+		upt = append(upt, withMirrorConfig(mirror, cfg.mirroredRegistries...))
 	}
 
 	deferF := &multiCloser{}
-	cl = deferF.F()
+	// tracked from the start so that partially started sandboxes are also
+	// cleaned up on SIGINT
+	cl = trackedCloser(deferF.F())
 
 	defer func() {
 		if err != nil {
-			deferF.F()()
+			cl()
 			cl = nil
 		}
 	}()
 
-	if len(upt) > 0 {
-		dir, err := writeConfig(upt)
+	for _, v := range mv.values {
+		if m, ok := v.value.(rootlessMode); ok {
+			if !bool(m) && w.Rootless() {
+				return nil, nil, RequirementErrorf(SkipUnsupportedWorker, "%s worker is always rootless", w.Name())
+			}
+			cfg.Rootless = bool(m)
+		}
+	}
+
+	if cfg.persistentDataKey != "" {
+		dir, err := persistentDataDir(cfg.persistentDataKey, w.Name(), cfg.Rootless && !w.Rootless())
+		if err != nil {
+			return nil, nil, err
+		}
+		cl, ok := usePersistentDataDir(dir)
+		deferF.append(cl)
+		if !ok {
+			t.Logf("persistent data dir %s is used by another sandbox concurrently, the state of the daemons may be corrupted", dir)
+		}
+		cfg.DataRoot = dir
+	}
+
+	if cfg.resourceLimits != nil {
+		if cfg.Rootless || w.Rootless() {
+			return nil, nil, RequirementErrorf(SkipUnsupportedWorker, "resource limits are not supported by rootless workers")
+		}
+		cg, cl, err := newDaemonCgroup(*cfg.resourceLimits)
+		if err != nil {
+			return nil, nil, err
+		}
+		// removed once the daemon has been stopped
+		deferF.append(cl)
+		cfg.cgroup = cg
+		cfg.DaemonConfig = append(cfg.DaemonConfig, cg.config())
+	}
+
+	var regCA *registryCA
+	for _, v := range mv.values {
+		if v.value == RegistryTLS {
+			// trusted by the daemon through the CA bundle below
+			ca, err := newRegistryCA()
+			if err != nil {
+				return nil, nil, err
+			}
+			cfg.caCerts = append(cfg.caCerts, ca.pem)
+			regCA = ca
+		}
+	}
+
+	if len(cfg.caCerts) > 0 {
+		bundle, cl, err := writeCABundle(cfg.caCerts)
+		if err != nil {
+			return nil, nil, err
+		}
+		deferF.append(cl)
+		cfg.caBundle = bundle
+		cfg.DaemonEnv = append(cfg.DaemonEnv, "SSL_CERT_FILE="+bundle)
+	}
+
+	var traces *traceCollector
+	if cfg.traceCollector {
+		c, cl, err := newTraceCollector()
+		if err != nil {
+			return nil, nil, err
+		}
+		deferF.append(cl)
+		cfg.DaemonEnv = append(cfg.DaemonEnv, c.env()...)
+		traces = c
+	}
+
+	if goroutineDumpEnabled() {
+		port, err := freePort()
+		if err != nil {
+			return nil, nil, err
+		}
+		cfg.debugAddress = "127.0.0.1:" + strconv.Itoa(port)
+	}
+
+	if cfg.overridesResolver() {
+		hostsFile, resolvConf, cl, err := writeResolverFiles(cfg.hosts, cfg.nameservers)
+		if err != nil {
+			return nil, nil, err
+		}
+		deferF.append(cl)
+		cfg.hostsFile = hostsFile
+		cfg.resolvConf = resolvConf
+		if len(cfg.nameservers) > 0 {
+			cfg.DaemonConfig = append(cfg.DaemonConfig, dnsConfig(cfg.nameservers))
+		}
+	}
+
+	if len(cfg.Entitlements) > 0 {
+		ec, err := entitlementsConfig(cfg.Entitlements)
+		if err != nil {
+			return nil, nil, err
+		}
+		cfg.DaemonConfig = append(cfg.DaemonConfig, ec)
+	}
+
+	if len(upt) > 0 || len(cfg.DaemonConfig) > 0 {
+		dir, err := writeConfig(upt, cfg.DaemonConfig)
 		if err != nil {
 			return nil, nil, err
 		}
@@ -128,20 +587,80 @@ func newSandbox(ctx context.Context, w Worker, mirror string, mv matrixValue) (s
 		cfg.ConfigFile = filepath.Join(dir, buildkitdConfigFile)
 	}
 
+	tempDir, err := os.MkdirTemp("", "buildkit-sandbox")
+	if err != nil {
+		return nil, nil, err
+	}
+	deferF.append(func() error { return os.RemoveAll(tempDir) })
+
 	b, closer, err := w.New(ctx, cfg)
 	if err != nil {
 		return nil, nil, err
 	}
 	deferF.append(closer)
 
-	return &sandbox{
+	if cfg.ignoresConfigFile {
+		// the mirror is only configured through the config file
+		mirror = ""
+		cfg.ConfigFile = ""
+	}
+
+	sb := &sandbox{
 		Backend: b,
 		logs:    cfg.Logs,
-		cleanup: deferF,
+		cleanup: &multiCloser{},
 		mv:      mv,
 		ctx:     ctx,
 		name:    w.Name(),
-	}, cl, nil
+		mirror:  mirror,
+
+		registryCA: regCA,
+		configFile: cfg.ConfigFile,
+		daemonArgs: daemonArgs(b),
+		tempDir:    tempDir,
+		traces:     traces,
+
+		debugAddress:    cfg.debugAddress,
+		registryFactory: cfg.RegistryFactory,
+		buildctl:        cfg.buildctlBinary(),
+		hosts:           cfg.hosts,
+		resourceLimits:  cfg.resourceLimits,
+	}
+
+	var grpcRecorder string
+	if cfg.grpcRecording != "" {
+		addr, cl, err := startGRPCRecorder(sb.buildctlAddress(), tempDir, cfg.grpcRecording)
+		if err != nil {
+			return nil, nil, err
+		}
+		// stopped after the cleanups that may still run buildctl
+		deferF.append(cl)
+		grpcRecorder = addr
+	}
+	deferF.append(sb.runCleanups)
+
+	readyCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	if err := sb.WaitReady(readyCtx); err != nil {
+		return nil, nil, errors.Wrapf(err, "%s: %s", w.Name(), formatLogs(cfg.Logs))
+	}
+	// calls made while the daemon starts are not recorded
+	sb.grpcRecorder = grpcRecorder
+	return sb, cl, nil
+}
+
+// daemonArgs returns the command line of the daemon started by the worker
+// for b, if it is known.
+func daemonArgs(b Backend) []string {
+	bk, ok := b.(backend)
+	if !ok || bk.daemon == nil {
+		return nil
+	}
+	cmd := bk.daemon.process()
+	if cmd == nil {
+		return nil
+	}
+	return append([]string{}, cmd.Args...)
 }
 
 func getBuildkitdAddr(tmpdir string) string {
@@ -152,7 +671,7 @@ func getBuildkitdAddr(tmpdir string) string {
 	return address
 }
 
-func runBuildkitd(ctx context.Context, conf *BackendConfig, args []string, logs map[string]*bytes.Buffer, uid, gid int, extraEnv []string) (address string, cl func() error, err error) {
+func runBuildkitd(ctx context.Context, conf *BackendConfig, args []string, logs map[string]*bytes.Buffer, uid, gid int, extraEnv []string) (address string, daemon *daemonProcess, cl func() error, err error) {
 	deferF := &multiCloser{}
 	cl = deferF.F()
 
@@ -167,39 +686,61 @@ func runBuildkitd(ctx context.Context, conf *BackendConfig, args []string, logs
 		args = append(args, "--config="+conf.ConfigFile)
 	}
 
-	tmpdir, err := os.MkdirTemp("", "bktest_buildkitd")
+	tmpdir, err := newDataDir("bktest_buildkitd")
 	if err != nil {
-		return "", nil, err
+		return "", nil, nil, err
 	}
 	if err := os.Chown(tmpdir, uid, gid); err != nil {
-		return "", nil, err
+		return "", nil, nil, err
 	}
 	if err := os.MkdirAll(filepath.Join(tmpdir, "tmp"), 0711); err != nil {
-		return "", nil, err
+		return "", nil, nil, err
 	}
 	if err := os.Chown(filepath.Join(tmpdir, "tmp"), uid, gid); err != nil {
-		return "", nil, err
+		return "", nil, nil, err
 	}
 
 	deferF.append(func() error { return os.RemoveAll(tmpdir) })
 
 	address = getBuildkitdAddr(tmpdir)
 
-	args = append(args, "--root", tmpdir, "--addr", address, "--debug")
-	cmd := exec.Command(args[0], args[1:]...)
-	cmd.Env = append(os.Environ(), "BUILDKIT_DEBUG_EXEC_OUTPUT=1", "BUILDKIT_DEBUG_PANIC_ON_ERROR=1", "TMPDIR="+filepath.Join(tmpdir, "tmp"))
-	cmd.Env = append(cmd.Env, extraEnv...)
-	cmd.SysProcAttr = getSysProcAttr()
-
-	stop, err := startCmd(cmd, logs)
+	root, err := conf.dataRoot(tmpdir, "buildkitd", uid, gid)
 	if err != nil {
-		return "", nil, err
+		return "", nil, nil, err
 	}
-	deferF.append(stop)
-
-	if err := waitUnix(address, 15*time.Second); err != nil {
-		return "", nil, err
+	args = append(args, "--root", root, "--addr", address, "--debug")
+	if conf.debugAddress != "" {
+		args = append(args, "--debugaddr", conf.debugAddress)
+	}
+	args, err = conf.resolverArgs(args)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	args = conf.cgroupArgs(args)
+	// the same command can be started again by Sandbox.Restart and reuses
+	// the state in root
+	daemon, err = startDaemon(logs, func() (*exec.Cmd, func() error, error) {
+		cmd := exec.Command(args[0], args[1:]...)
+		cmd.Env = append(os.Environ(), "BUILDKIT_DEBUG_EXEC_OUTPUT=1", "BUILDKIT_DEBUG_PANIC_ON_ERROR=1", "TMPDIR="+filepath.Join(tmpdir, "tmp"))
+		cmd.Env = append(cmd.Env, extraEnv...)
+		cmd.Env = applyEnv(cmd.Env, conf.DaemonEnv)
+		cmd.SysProcAttr = getSysProcAttr()
+		streamLogs(cmd, conf)
+
+		stop, err := startCmdWithOpts(cmd, logs, conf.stopOpts())
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := waitUnix(address, 15*time.Second); err != nil {
+			stop()
+			return nil, nil, classifyStartError(err, logs)
+		}
+		return cmd, stop, nil
+	})
+	if err != nil {
+		return "", nil, nil, err
 	}
+	deferF.append(daemon.Stop)
 
 	deferF.append(func() error {
 		f, err := os.Open("/proc/self/mountinfo")
@@ -209,14 +750,33 @@ func runBuildkitd(ctx context.Context, conf *BackendConfig, args []string, logs
 		defer f.Close()
 		s := bufio.NewScanner(f)
 		for s.Scan() {
-			if strings.Contains(s.Text(), tmpdir) {
-				return errors.Errorf("leaked mountpoint for %s", tmpdir)
+			for _, dir := range []string{tmpdir, root} {
+				if strings.Contains(s.Text(), dir) {
+					return errors.Errorf("leaked mountpoint for %s", dir)
+				}
 			}
 		}
 		return s.Err()
 	})
 
-	return address, cl, err
+	return address, daemon, cl, err
+}
+
+// rootlessNet validates the rootlesskit network driver selected for the
+// sandbox. Empty string is returned if the default should be used.
+func rootlessNet(cfg *BackendConfig, rootless bool) (string, error) {
+	if cfg.RootlessNet == "" {
+		return "", nil
+	}
+	if !rootless {
+		return "", RequirementErrorf(SkipUnsupportedWorker, "rootless network %s requires a rootless worker", cfg.RootlessNet)
+	}
+	if cfg.RootlessNet != "host" {
+		if err := lookupBinary(cfg.RootlessNet); err != nil {
+			return "", err
+		}
+	}
+	return cfg.RootlessNet, nil
 }
 
 func rootlessSupported(uid int) bool {
@@ -230,9 +790,9 @@ func rootlessSupported(uid int) bool {
 }
 
 func printLogs(logs map[string]*bytes.Buffer, f func(args ...interface{})) {
-	for name, l := range logs {
+	for name, dt := range copyLogs(logs) {
 		f(name)
-		s := bufio.NewScanner(l)
+		s := bufio.NewScanner(bytes.NewReader(dt))
 		for s.Scan() {
 			f(s.Text())
 		}
@@ -0,0 +1,98 @@
+package integration
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestSandbox returns a sandbox that isn't backed by a running daemon. It
+// has its own temporary directory and the functions registered with Cleanup
+// are called when the test ends.
+func newTestSandbox(t *testing.T) *sandbox {
+	sb := &sandbox{
+		Backend:  backend{address: "unix:///nonexistent/buildkitd.sock"},
+		cleanup:  &multiCloser{},
+		ctx:      context.TODO(),
+		name:     t.Name(),
+		tempDir:  t.TempDir(),
+		buildctl: "buildctl",
+	}
+	t.Cleanup(func() {
+		sb.runCleanups()
+	})
+	return sb
+}
+
+func TestSandboxTypedValues(t *testing.T) {
+	mv := newMatrixValue("net", "host", RootlessNet("host"))
+	mv.values["rootless"] = matrixValueChoice{name: "rootless", value: RootlessEnabled}
+	mv.values["count"] = matrixValueChoice{name: "1", value: 1}
+	sb := newTestSandbox(t)
+	sb.mv = mv
+
+	s, ok := sb.ValueString("net")
+	require.True(t, ok)
+	require.Equal(t, "host", s)
+
+	b, ok := sb.ValueBool("rootless")
+	require.True(t, ok)
+	require.True(t, b)
+
+	_, ok = sb.ValueString("count")
+	require.False(t, ok)
+	_, ok = sb.ValueBool("net")
+	require.False(t, ok)
+	s, ok = sb.ValueString("missing")
+	require.False(t, ok)
+	require.Equal(t, "", s)
+
+	values := sb.Values()
+	require.Equal(t, map[string]interface{}{
+		"net":      RootlessNet("host"),
+		"rootless": RootlessEnabled,
+		"count":    1,
+	}, values)
+	// the map is a copy
+	delete(values, "net")
+	require.Equal(t, RootlessNet("host"), sb.Value("net"))
+}
+
+func TestSandboxCleanup(t *testing.T) {
+	sb := newTestSandbox(t)
+	var calls []int
+	sb.Cleanup(func() error { calls = append(calls, 1); return nil })
+	sb.Cleanup(func() error { calls = append(calls, 2); return errors.New("failed") })
+
+	require.EqualError(t, sb.runCleanups(), "failed")
+	require.Equal(t, []int{2, 1}, calls)
+
+	// functions are only called once
+	require.NoError(t, sb.runCleanups())
+	require.Equal(t, []int{2, 1}, calls)
+}
+
+func TestSandboxPrintConfig(t *testing.T) {
+	cfg := filepath.Join(t.TempDir(), buildkitdConfigFile)
+	require.NoError(t, os.WriteFile(cfg, []byte("debug = true\n[worker.oci]\n  gc = false\n"), 0600))
+	sb := newTestSandbox(t)
+	sb.configFile = cfg
+	sb.daemonArgs = []string{"buildkitd", "--oci-worker=true", "--config=" + cfg}
+
+	var lines []string
+	sb.printConfig(func(args ...interface{}) {
+		lines = append(lines, fmt.Sprint(args...))
+	})
+	require.Equal(t, []string{
+		"daemon command: buildkitd --oci-worker=true --config=" + cfg,
+		cfg,
+		"debug = true",
+		"[worker.oci]",
+		"  gc = false",
+	}, lines)
+}
@@ -0,0 +1,124 @@
+package integration
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/containerd/containerd/archive/compression"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/platforms"
+	"github.com/moby/buildkit/util/contentutil"
+	"github.com/pkg/errors"
+)
+
+// Secret is a secret that is provided to a build with the --secret flag of
+// buildctl, e.g. for RUN --mount=type=secret,id=<ID>.
+type Secret struct {
+	ID    string
+	Value []byte
+	file  string
+}
+
+// NewSecret writes value to a file under the temp directory of the sandbox
+// and returns the secret with id.
+func NewSecret(sb Sandbox, id string, value []byte) (*Secret, error) {
+	if len(value) == 0 {
+		return nil, errors.Errorf("secret %s has no value", id)
+	}
+	dir, err := os.MkdirTemp(sb.TempDir(), "secret")
+	if err != nil {
+		return nil, err
+	}
+	file := filepath.Join(dir, "secret")
+	if err := os.WriteFile(file, value, 0600); err != nil {
+		return nil, err
+	}
+	return &Secret{ID: id, Value: value, file: file}, nil
+}
+
+// Args returns the buildctl flags that provide the secret to a build.
+func (s *Secret) Args() []string {
+	return []string{"--secret=id=" + s.ID + ",src=" + s.file}
+}
+
+// WithSecret provides s to the build.
+func WithSecret(s *Secret) BuildOpt {
+	return func(bo *buildOpts) {
+		bo.args = append(bo.args, s.Args()...)
+	}
+}
+
+// CheckNotInImage returns an error if the value of the secret appears in
+// the config or in the uncompressed content of a layer of the image ref,
+// e.g. pushed with BuildAndPush.
+func (s *Secret) CheckNotInImage(ctx context.Context, ref string) error {
+	desc, provider, err := contentutil.ProviderFromRef(ref)
+	if err != nil {
+		return err
+	}
+	mfst, err := images.Manifest(ctx, provider, desc, platforms.Default())
+	if err != nil {
+		return errors.Wrapf(err, "failed to read manifest of %s", ref)
+	}
+
+	dt, err := content.ReadBlob(ctx, provider, mfst.Config)
+	if err != nil {
+		return errors.Wrapf(err, "failed to read config of %s", ref)
+	}
+	if bytes.Contains(dt, s.Value) {
+		return errors.Errorf("secret %s found in config of %s", s.ID, ref)
+	}
+
+	for i, l := range mfst.Layers {
+		ra, err := provider.ReaderAt(ctx, l)
+		if err != nil {
+			return err
+		}
+		found, err := func() (bool, error) {
+			defer ra.Close()
+			r, err := compression.DecompressStream(content.NewReader(ra))
+			if err != nil {
+				return false, err
+			}
+			defer r.Close()
+			return streamContains(r, s.Value)
+		}()
+		if err != nil {
+			return errors.Wrapf(err, "failed to read layer %d of %s", i, ref)
+		}
+		if found {
+			return errors.Errorf("secret %s found in layer %d of %s", s.ID, i, ref)
+		}
+	}
+	return nil
+}
+
+// streamContains reports whether needle appears in r without reading all of
+// r into memory.
+func streamContains(r io.Reader, needle []byte) (bool, error) {
+	br := bufio.NewReaderSize(r, 64*1024)
+	buf := make([]byte, 0, 64*1024+len(needle))
+	chunk := make([]byte, 64*1024)
+	for {
+		n, err := br.Read(chunk)
+		buf = append(buf, chunk[:n]...)
+		if bytes.Contains(buf, needle) {
+			return true, nil
+		}
+		// keep the tail that could be the start of a match
+		if keep := len(needle) - 1; len(buf) > keep {
+			buf = append(buf[:0], buf[len(buf)-keep:]...)
+		}
+		if err == io.EOF {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+}
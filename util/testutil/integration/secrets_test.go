@@ -0,0 +1,27 @@
+package integration
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStreamContains(t *testing.T) {
+	data := bytes.Repeat([]byte("a"), 200*1024)
+	// crosses the boundary of the first read
+	copy(data[64*1024-3:], "secret")
+
+	found, err := streamContains(bytes.NewReader(data), []byte("secret"))
+	require.NoError(t, err)
+	require.True(t, found)
+
+	found, err = streamContains(bytes.NewReader(data), []byte("secrets"))
+	require.NoError(t, err)
+	require.False(t, found)
+
+	found, err = streamContains(strings.NewReader("abc"), []byte("c"))
+	require.NoError(t, err)
+	require.True(t, found)
+}
@@ -0,0 +1,141 @@
+package integration
+
+import (
+	"encoding/json"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+// SkipReason is the category of a requirement a test was skipped for, so
+// that skips can be aggregated, e.g. to report coverage gaps in CI.
+type SkipReason string
+
+const (
+	// SkipMissingBinary is a binary that is not installed or a daemon that
+	// is not running, e.g. git or dockerd.
+	SkipMissingBinary SkipReason = "missing-binary"
+	// SkipMissingKernelFeature is a feature the kernel doesn't provide or
+	// the test process can't use, e.g. overlayfs or cgroup v2.
+	SkipMissingKernelFeature SkipReason = "missing-kernel-feature"
+	// SkipUnsupportedPlatform is an operating system, architecture or
+	// privilege level the test can't run with, e.g. without root or in
+	// rootless mode.
+	SkipUnsupportedPlatform SkipReason = "unsupported-platform"
+	// SkipUnsupportedWorker is a feature of the sandbox that the worker
+	// doesn't support, e.g. overriding the resolver of the dockerd worker.
+	SkipUnsupportedWorker SkipReason = "unsupported-worker"
+	// SkipMissingCapability is a capability the daemon doesn't report, see
+	// RequireCapabilities.
+	SkipMissingCapability SkipReason = "missing-capability"
+	// SkipInsufficientCPUs is a host with fewer CPUs than required, see
+	// RequireCPUs.
+	SkipInsufficientCPUs SkipReason = "insufficient-cpus"
+	// SkipMissingEntitlement is an insecure entitlement the daemon doesn't
+	// allow, see RequireEntitlements.
+	SkipMissingEntitlement SkipReason = "missing-entitlement"
+	// SkipOther is a requirement without a category.
+	SkipOther SkipReason = "other"
+)
+
+// requirementError is an error matching ErrRequirements with the category
+// of the missing requirement.
+type requirementError struct {
+	reason SkipReason
+	error
+}
+
+func (e requirementError) Is(target error) bool {
+	return target == ErrRequirements
+}
+
+func (e requirementError) Unwrap() error {
+	return e.error
+}
+
+// RequirementErrorf returns an error matching ErrRequirements for a missing
+// requirement of the category reason, e.g. for a Worker that can't create a
+// backend for a BackendConfig.
+func RequirementErrorf(reason SkipReason, format string, args ...interface{}) error {
+	return requirementError{reason: reason, error: errors.Wrapf(ErrRequirements, format, args...)}
+}
+
+// SkipReasonOf returns the category of the missing requirement err is for.
+// SkipOther is returned for errors not created by RequirementErrorf, like
+// ErrRequirements wrapped with errors.Wrap.
+func SkipReasonOf(err error) SkipReason {
+	var re requirementError
+	if errors.As(err, &re) {
+		return re.reason
+	}
+	return SkipOther
+}
+
+// testSkip is a test skipped for a missing requirement.
+type testSkip struct {
+	Name    string     `json:"name"`
+	Worker  string     `json:"worker"`
+	Reason  SkipReason `json:"reason"`
+	Message string     `json:"message"`
+}
+
+// skipCollector records tests skipped for missing requirements from parallel
+// tests across all Run calls of the process.
+type skipCollector struct {
+	mu    sync.Mutex
+	skips []testSkip
+}
+
+var skips = &skipCollector{}
+
+// skipRequirement records that the test tb of worker is skipped because of
+// the missing requirement err and skips it.
+func skipRequirement(tb testing.TB, worker string, err error) {
+	skips.mu.Lock()
+	skips.skips = append(skips.skips, testSkip{
+		Name:    tb.Name(),
+		Worker:  worker,
+		Reason:  SkipReasonOf(err),
+		Message: err.Error(),
+	})
+	skips.mu.Unlock()
+	tb.Skip(err.Error())
+}
+
+// report logs the skips recorded under the test t, a JSON document per line
+// prefixed with "skip: ", and writes all skips of the process to the file in
+// BUILDKIT_TEST_SKIPS if it is set.
+func (c *skipCollector) report(t *testing.T) {
+	c.mu.Lock()
+	all := append([]testSkip(nil), c.skips...)
+	c.mu.Unlock()
+	sort.SliceStable(all, func(i, j int) bool {
+		return all[i].Name < all[j].Name
+	})
+
+	prefix := t.Name() + "/"
+	for _, s := range all {
+		if !strings.HasPrefix(s.Name, prefix) {
+			continue
+		}
+		dt, err := json.Marshal(s)
+		if err != nil {
+			continue
+		}
+		t.Logf("skip: %s", dt)
+	}
+
+	if fn := os.Getenv("BUILDKIT_TEST_SKIPS"); fn != "" {
+		dt, err := json.MarshalIndent(all, "", "  ")
+		if err == nil {
+			err = os.WriteFile(fn, dt, 0644)
+		}
+		if err != nil {
+			t.Logf("failed to write skips to %s: %v", fn, err)
+		}
+	}
+}
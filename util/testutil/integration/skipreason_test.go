@@ -0,0 +1,45 @@
+package integration
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequirementError(t *testing.T) {
+	err := RequirementErrorf(SkipMissingBinary, "failed to lookup %s binary", "git")
+	require.ErrorIs(t, err, ErrRequirements)
+	require.Equal(t, "failed to lookup git binary: missing requirements", err.Error())
+	require.Equal(t, SkipMissingBinary, SkipReasonOf(err))
+	require.Equal(t, SkipMissingBinary, SkipReasonOf(errors.Wrap(err, "failed to start")))
+
+	require.Equal(t, SkipOther, SkipReasonOf(errors.Wrap(ErrRequirements, "requires root")))
+	require.Equal(t, SkipUnsupportedWorker, SkipReasonOf((&external{}).supports(&BackendConfig{Rootless: true})))
+	require.Equal(t, SkipInsufficientCPUs, SkipReasonOf(RequireCPUs(1<<20)(nil)))
+
+	rootlessSandbox := newTestSandbox(t)
+	rootlessSandbox.Backend = backend{rootless: true}
+	require.Equal(t, SkipUnsupportedPlatform, SkipReasonOf(RequireNotRootless()(rootlessSandbox)))
+}
+
+func TestSkipRequirement(t *testing.T) {
+	t.Run("sub", func(t *testing.T) {
+		skipRequirement(t, "oci", RequirementErrorf(SkipUnsupportedPlatform, "requires linux"))
+	})
+	skips.mu.Lock()
+	defer skips.mu.Unlock()
+	var found bool
+	for _, s := range skips.skips {
+		if s.Name == t.Name()+"/sub" {
+			found = true
+			require.Equal(t, testSkip{
+				Name:    t.Name() + "/sub",
+				Worker:  "oci",
+				Reason:  SkipUnsupportedPlatform,
+				Message: "requires linux: missing requirements",
+			}, s)
+		}
+	}
+	require.True(t, found)
+}
@@ -0,0 +1,61 @@
+package integration
+
+import (
+	"bytes"
+	"os"
+)
+
+// Snapshotter selects the snapshotter of the oci and containerd workers,
+// e.g. "overlayfs", "native" or "fuse-overlayfs", when used as a matrix
+// value:
+//
+//	WithMatrix("snapshotter", map[string]interface{}{
+//		"overlayfs": Snapshotter("overlayfs"),
+//		"native":    Snapshotter("native"),
+//	})
+//
+// Sandboxes are skipped if the snapshotter is not available on the host or
+// the worker already uses another snapshotter.
+type Snapshotter string
+
+func (s Snapshotter) UpdateBackendConfig(cfg *BackendConfig) {
+	cfg.Snapshotter = string(s)
+}
+
+// selectSnapshotter returns the snapshotter for a worker using def by
+// default, checking that the one selected in cfg can be used.
+func selectSnapshotter(cfg *BackendConfig, def string) (string, error) {
+	if cfg.Snapshotter == "" || cfg.Snapshotter == def {
+		return def, nil
+	}
+	if def != "" {
+		return "", RequirementErrorf(SkipUnsupportedWorker, "worker uses %s snapshotter, %s requested", def, cfg.Snapshotter)
+	}
+	if err := snapshotterSupported(cfg.Snapshotter); err != nil {
+		return "", err
+	}
+	return cfg.Snapshotter, nil
+}
+
+func snapshotterSupported(name string) error {
+	switch name {
+	case "native":
+		return nil
+	case "overlayfs":
+		dt, err := os.ReadFile("/proc/filesystems")
+		if err != nil || !bytes.Contains(dt, []byte("\toverlay\n")) {
+			return RequirementErrorf(SkipMissingKernelFeature, "overlayfs snapshotter requires overlay filesystem support")
+		}
+		return nil
+	case "fuse-overlayfs":
+		if err := lookupBinary("fuse-overlayfs"); err != nil {
+			return err
+		}
+		if _, err := os.Stat("/dev/fuse"); err != nil {
+			return RequirementErrorf(SkipMissingKernelFeature, "fuse-overlayfs snapshotter requires /dev/fuse")
+		}
+		return nil
+	default:
+		return RequirementErrorf(SkipUnsupportedWorker, "unsupported snapshotter %s", name)
+	}
+}
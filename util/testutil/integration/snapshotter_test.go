@@ -0,0 +1,26 @@
+package integration
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSelectSnapshotter(t *testing.T) {
+	sn, err := selectSnapshotter(&BackendConfig{}, "stargz")
+	require.NoError(t, err)
+	require.Equal(t, "stargz", sn)
+
+	cfg := &BackendConfig{}
+	Snapshotter("native").UpdateBackendConfig(cfg)
+	sn, err = selectSnapshotter(cfg, "")
+	require.NoError(t, err)
+	require.Equal(t, "native", sn)
+
+	_, err = selectSnapshotter(cfg, "stargz")
+	require.True(t, errors.Is(err, ErrRequirements))
+
+	_, err = selectSnapshotter(&BackendConfig{Snapshotter: "unknown"}, "")
+	require.True(t, errors.Is(err, ErrRequirements))
+}
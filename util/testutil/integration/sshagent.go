@@ -0,0 +1,92 @@
+package integration
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// SSHAgent is an ssh agent holding a single key that is generated for the
+// test, e.g. for builds using RUN --mount=type=ssh.
+type SSHAgent struct {
+	// Socket is the unix socket the agent listens on, like SSH_AUTH_SOCK.
+	Socket string
+	// PublicKey is the public key of the agent in the authorized_keys
+	// format, e.g. for a git server the build clones from.
+	PublicKey string
+	// Signer signs with the key of the agent.
+	Signer ssh.Signer
+}
+
+// NewSSHAgent starts an ssh agent with a new ed25519 key. The agent is
+// stopped after the test.
+func NewSSHAgent(sb Sandbox) (*SSHAgent, error) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		return nil, err
+	}
+	keyring := agent.NewKeyring()
+	if err := keyring.Add(agent.AddedKey{PrivateKey: key, Comment: "buildkit-integration"}); err != nil {
+		return nil, err
+	}
+
+	dir, err := os.MkdirTemp(sb.TempDir(), "ssh-agent")
+	if err != nil {
+		return nil, err
+	}
+	socket := filepath.Join(dir, "agent.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to listen for ssh agent")
+	}
+	sb.Cleanup(func() error {
+		l.Close()
+		return os.RemoveAll(dir)
+	})
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				agent.ServeAgent(keyring, conn)
+			}()
+		}
+	}()
+
+	return &SSHAgent{
+		Socket:    socket,
+		PublicKey: strings.TrimSpace(string(ssh.MarshalAuthorizedKey(signer.PublicKey()))),
+		Signer:    signer,
+	}, nil
+}
+
+// Args returns the buildctl flags that forward the agent to a build as the
+// ssh socket id, that is "default" if id is empty.
+func (a *SSHAgent) Args(id string) []string {
+	if id == "" {
+		id = "default"
+	}
+	return []string{"--ssh=" + id + "=" + a.Socket}
+}
+
+// WithSSHAgent forwards a to the build as the ssh socket id, see
+// SSHAgent.Args.
+func WithSSHAgent(a *SSHAgent, id string) BuildOpt {
+	return func(bo *buildOpts) {
+		bo.args = append(bo.args, a.Args(id)...)
+	}
+}
@@ -0,0 +1,37 @@
+package integration
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func TestSSHAgent(t *testing.T) {
+	sb := newTestSandbox(t)
+	a, err := NewSSHAgent(sb)
+	require.NoError(t, err)
+
+	pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(a.PublicKey))
+	require.NoError(t, err)
+	require.Equal(t, a.Signer.PublicKey().Marshal(), pub.Marshal())
+
+	conn, err := net.Dial("unix", a.Socket)
+	require.NoError(t, err)
+	keys, err := agent.NewClient(conn).List()
+	conn.Close()
+	require.NoError(t, err)
+	require.Len(t, keys, 1)
+	require.Equal(t, pub.Marshal(), keys[0].Marshal())
+
+	require.Equal(t, []string{"--ssh=default=" + a.Socket}, a.Args(""))
+	var bo buildOpts
+	WithSSHAgent(a, "git")(&bo)
+	require.Equal(t, []string{"--ssh=git=" + a.Socket}, bo.args)
+
+	require.NoError(t, sb.runCleanups())
+	_, err = net.Dial("unix", a.Socket)
+	require.Error(t, err)
+}
@@ -0,0 +1,120 @@
+package integration
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/moby/buildkit/frontend/dockerfile/dockerfile2llb"
+	"github.com/moby/buildkit/frontend/dockerfile/instructions"
+	"github.com/moby/buildkit/frontend/dockerfile/parser"
+	"github.com/pkg/errors"
+)
+
+// Stage describes a build stage of a Dockerfile as parsed by the dockerfile
+// frontend.
+type Stage struct {
+	// Name is the name of the stage, or its index for unnamed stages.
+	Name string
+	// Base is the argument of FROM, e.g. an image reference or the name of
+	// another stage.
+	Base string
+	// Default is set for the last stage, that is built without a target.
+	Default bool
+	// DependsOn lists the stages used by FROM, COPY --from and
+	// RUN --mount=from, in the order they are referenced.
+	DependsOn []string
+}
+
+// ListStages returns the stages of dockerfile without solving it, so that
+// tests of the frontend can check stage names and dependencies quickly.
+func ListStages(ctx context.Context, dockerfile string) ([]Stage, error) {
+	l, err := dockerfile2llb.ListTargets(ctx, []byte(dockerfile))
+	if err != nil {
+		return nil, err
+	}
+	res, err := parser.Parse(bytes.NewReader([]byte(dockerfile)))
+	if err != nil {
+		return nil, err
+	}
+	parsed, _, err := instructions.Parse(res.AST)
+	if err != nil {
+		return nil, err
+	}
+	if len(parsed) != len(l.Targets) {
+		return nil, errors.Errorf("frontend listed %d targets for %d stages", len(l.Targets), len(parsed))
+	}
+
+	stages := make([]Stage, len(l.Targets))
+	for i, t := range l.Targets {
+		stages[i] = Stage{Name: t.Name, Base: t.Base, Default: t.Default}
+		if t.Name == "" {
+			stages[i].Name = strconv.Itoa(i)
+		}
+	}
+	lookup := func(i int, ref string) (string, bool) {
+		for j := range parsed {
+			if j == i {
+				continue
+			}
+			if strings.EqualFold(parsed[j].Name, ref) || strconv.Itoa(j) == ref {
+				return stages[j].Name, true
+			}
+		}
+		return "", false
+	}
+	for i, s := range parsed {
+		var deps []string
+		add := func(ref string) {
+			if name, ok := lookup(i, ref); ok && !contains(deps, name) {
+				deps = append(deps, name)
+			}
+		}
+		add(s.BaseName)
+		for _, cmd := range s.Commands {
+			switch c := cmd.(type) {
+			case *instructions.CopyCommand:
+				add(c.From)
+			case *instructions.RunCommand:
+				for _, m := range instructions.GetMounts(c) {
+					add(m.From)
+				}
+			}
+		}
+		stages[i].DependsOn = deps
+	}
+	return stages, nil
+}
+
+// BuildStage builds the stage target of dockerfile and exports its
+// filesystem to a new directory under the temp directory of the sandbox.
+// Use WithTarget with BuildAndPush to get an image of the stage instead.
+func BuildStage(sb Sandbox, dockerfile, target string, opts ...BuildOpt) (dir string, err error) {
+	bo := buildOpts{target: target}
+	for _, o := range opts {
+		o(&bo)
+	}
+	if err := bo.check(sb); err != nil {
+		return "", err
+	}
+
+	src, err := os.MkdirTemp(sb.TempDir(), "stage-context")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(src)
+	if err := bo.writeContext(src, dockerfile); err != nil {
+		return "", err
+	}
+
+	dir, err = os.MkdirTemp(sb.TempDir(), "stage")
+	if err != nil {
+		return "", err
+	}
+	if err := buildDockerfile(sb, src, "type=local,dest="+dir, bo); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
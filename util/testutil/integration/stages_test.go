@@ -0,0 +1,35 @@
+package integration
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestListStages(t *testing.T) {
+	stages, err := ListStages(context.TODO(), `
+FROM busybox AS base
+RUN true
+
+FROM base AS build
+RUN --mount=from=tools,target=/tools true
+
+FROM alpine AS Tools
+
+FROM scratch
+COPY --from=build /out /
+COPY --from=0 /etc /etc
+COPY --from=docker.io/library/alpine /bin /bin
+`)
+	require.NoError(t, err)
+	require.Equal(t, []Stage{
+		{Name: "base", Base: "busybox"},
+		{Name: "build", Base: "base", DependsOn: []string{"base", "tools"}},
+		{Name: "tools", Base: "alpine"},
+		{Name: "3", Base: "scratch", Default: true, DependsOn: []string{"build", "base"}},
+	}, stages)
+
+	_, err = ListStages(context.TODO(), "RUN true")
+	require.Error(t, err)
+}
@@ -0,0 +1,137 @@
+//go:build linux
+// +build linux
+
+package integration
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// clockTicks is USER_HZ, the unit of the times in /proc/<pid>/stat. It is
+// 100 on all architectures supported by Linux userspace.
+const clockTicks = 100
+
+type procStat struct {
+	state   string
+	ppid    int
+	session int
+	cpuTime time.Duration
+}
+
+func processTreeStats(pid int) (ResourceStats, error) {
+	procs := map[int]procStat{}
+	dirs, err := os.ReadDir("/proc")
+	if err != nil {
+		return ResourceStats{}, err
+	}
+	for _, d := range dirs {
+		p, err := strconv.Atoi(d.Name())
+		if err != nil {
+			continue
+		}
+		st, err := readProcStat(p)
+		if err != nil {
+			// process exited while scanning
+			continue
+		}
+		procs[p] = st
+	}
+	if _, ok := procs[pid]; !ok {
+		return ResourceStats{}, errors.Errorf("daemon process %d is not running", pid)
+	}
+
+	tree := map[int]struct{}{pid: {}}
+	for changed := true; changed; {
+		changed = false
+		for p, st := range procs {
+			if _, ok := tree[p]; ok {
+				continue
+			}
+			if _, ok := tree[st.ppid]; ok {
+				tree[p] = struct{}{}
+				changed = true
+			}
+		}
+	}
+
+	var stats ResourceStats
+	for p := range tree {
+		stats.CPUTime += procs[p].cpuTime
+		rss, err := readPeakRSS(p)
+		if err != nil {
+			continue
+		}
+		stats.PeakRSS += rss
+	}
+	return stats, nil
+}
+
+func readProcStat(pid int) (procStat, error) {
+	dt, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return procStat{}, err
+	}
+	// the command name can contain spaces and parentheses
+	s := string(dt)
+	i := strings.LastIndex(s, ")")
+	if i < 0 {
+		return procStat{}, errors.Errorf("invalid stat for %d", pid)
+	}
+	fields := strings.Fields(s[i+1:])
+	if len(fields) < 15 {
+		return procStat{}, errors.Errorf("invalid stat for %d", pid)
+	}
+	ppid, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return procStat{}, err
+	}
+	session, err := strconv.Atoi(fields[3])
+	if err != nil {
+		return procStat{}, err
+	}
+	var ticks int64
+	// utime, stime, cutime, cstime
+	for _, f := range fields[11:15] {
+		v, err := strconv.ParseInt(f, 10, 64)
+		if err != nil {
+			return procStat{}, err
+		}
+		ticks += v
+	}
+	return procStat{
+		state:   fields[0],
+		ppid:    ppid,
+		session: session,
+		cpuTime: time.Duration(ticks) * time.Second / clockTicks,
+	}, nil
+}
+
+func readPeakRSS(pid int) (int64, error) {
+	f, err := os.Open(filepath.Join("/proc", strconv.Itoa(pid), "status"))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		if v, ok := cutPrefix(s.Text(), "VmHWM:"); ok {
+			kb, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimSpace(v), " kB"), 10, 64)
+			if err != nil {
+				return 0, err
+			}
+			return kb * 1024, nil
+		}
+	}
+	if err := s.Err(); err != nil {
+		return 0, err
+	}
+	// kernel threads have no memory stats
+	return 0, nil
+}
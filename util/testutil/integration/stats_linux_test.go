@@ -0,0 +1,17 @@
+//go:build linux
+// +build linux
+
+package integration
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestProcessTreeStats(t *testing.T) {
+	stats, err := processTreeStats(os.Getpid())
+	require.NoError(t, err)
+	require.Greater(t, stats.PeakRSS, int64(0))
+}
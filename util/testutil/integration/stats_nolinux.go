@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package integration
+
+import (
+	"runtime"
+
+	"github.com/pkg/errors"
+)
+
+func processTreeStats(pid int) (ResourceStats, error) {
+	return ResourceStats{}, errors.Errorf("resource stats are not supported on %s", runtime.GOOS)
+}
@@ -0,0 +1,88 @@
+package integration
+
+import (
+	"encoding/json"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testTiming is the duration of a single worker and matrix combination of a
+// test. Time spent waiting for other parallel tests is not included.
+type testTiming struct {
+	Name     string        `json:"name"`
+	Worker   string        `json:"worker"`
+	Result   string        `json:"result"` // "pass", "fail" or "skip"
+	Duration time.Duration `json:"duration"`
+}
+
+// timingCollector records test durations from parallel tests across all Run
+// calls of the process.
+type timingCollector struct {
+	mu      sync.Mutex
+	timings []testTiming
+}
+
+var timings = &timingCollector{}
+
+func (c *timingCollector) record(t *testing.T, worker string, d time.Duration) {
+	result := "pass"
+	if t.Skipped() {
+		result = "skip"
+	} else if t.Failed() {
+		result = "fail"
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.timings = append(c.timings, testTiming{Name: t.Name(), Worker: worker, Result: result, Duration: d})
+}
+
+// sorted returns the timings recorded so far, slowest first.
+func (c *timingCollector) sorted() []testTiming {
+	c.mu.Lock()
+	out := append([]testTiming(nil), c.timings...)
+	c.mu.Unlock()
+	sort.SliceStable(out, func(i, j int) bool {
+		return out[i].Duration > out[j].Duration
+	})
+	return out
+}
+
+const timingSummaryLen = 10
+
+// report logs the slowest tests recorded under the test t and writes all
+// timings of the process to the file in BUILDKIT_TEST_TIMINGS if it is set.
+func (c *timingCollector) report(t *testing.T) {
+	all := c.sorted()
+	var own []testTiming
+	counts := map[string]int{}
+	prefix := t.Name() + "/"
+	for _, tt := range all {
+		if strings.HasPrefix(tt.Name, prefix) {
+			own = append(own, tt)
+			counts[tt.Result]++
+		}
+	}
+	if len(own) > 0 {
+		t.Logf("%d passed, %d failed, %d skipped; slowest:", counts["pass"], counts["fail"], counts["skip"])
+		for i, tt := range own {
+			if i == timingSummaryLen {
+				break
+			}
+			t.Logf("  %v\t%s\t%s", tt.Duration.Round(time.Millisecond), tt.Result, tt.Name)
+		}
+	}
+
+	if fn := os.Getenv("BUILDKIT_TEST_TIMINGS"); fn != "" {
+		dt, err := json.MarshalIndent(all, "", "  ")
+		if err == nil {
+			err = os.WriteFile(fn, dt, 0644)
+		}
+		if err != nil {
+			t.Logf("failed to write timings to %s: %v", fn, err)
+		}
+	}
+}
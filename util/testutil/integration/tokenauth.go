@@ -0,0 +1,327 @@
+package integration
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/moby/buildkit/identity"
+	"github.com/pkg/errors"
+)
+
+const (
+	tokenService = "buildkit-test-registry"
+	tokenIssuer  = "buildkit-test-token-server"
+
+	defaultTokenTTL = 5 * time.Minute
+)
+
+type tokenAuthConfig struct {
+	realm    string
+	certFile string
+}
+
+// TokenAuthRegistry is a registry that requires bearer tokens issued by a
+// separate token server, like most public registries. Each token is granted
+// the access requested for it.
+type TokenAuthRegistry struct {
+	// Host is the address of the registry.
+	Host string
+	// Realm is the URL of the token endpoint the registry points clients
+	// to.
+	Realm string
+
+	user, pass string
+	key        *ecdsa.PrivateKey
+	cert       []byte // DER encoded certificate of key
+	target     *url.URL
+
+	mu       sync.Mutex
+	ttl      time.Duration
+	issued   []string
+	revoked  map[string]struct{}
+	requests int
+}
+
+// NewRegistryWithTokenAuth starts a token server and a registry that only
+// accepts tokens issued by it. If user is set the token server requires those
+// credentials, either with basic auth or with the OAuth2 password grant, and
+// otherwise tokens are issued to anonymous clients.
+func NewRegistryWithTokenAuth(dir, user, pass string) (r *TokenAuthRegistry, cl func() error, err error) {
+	deferF := &multiCloser{}
+	cl = deferF.F()
+
+	defer func() {
+		if err != nil {
+			deferF.F()()
+			cl = nil
+		}
+	}()
+
+	if dir == "" {
+		tmpdir, err := os.MkdirTemp("", "test-registry")
+		if err != nil {
+			return nil, nil, err
+		}
+		deferF.append(func() error { return os.RemoveAll(tmpdir) })
+		dir = tmpdir
+	}
+
+	// the certificate is kept in dir with the config of the registry that
+	// refers to it
+	certFile, keyFile := filepath.Join(dir, "token-cert.pem"), filepath.Join(dir, "token-key.pem")
+	if _, err := os.Stat(certFile); err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			return nil, nil, err
+		}
+		if err := writeRegistryCert(certFile, keyFile, nil); err != nil {
+			return nil, nil, err
+		}
+	}
+	key, cert, err := loadTokenKey(certFile, keyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	r = &TokenAuthRegistry{
+		user:    user,
+		pass:    pass,
+		key:     key,
+		cert:    cert,
+		ttl:     defaultTokenTTL,
+		revoked: map[string]struct{}{},
+	}
+
+	tl, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, nil, err
+	}
+	tokenSrv := &http.Server{Handler: http.HandlerFunc(r.serveToken)}
+	go tokenSrv.Serve(tl)
+	deferF.append(tokenSrv.Close)
+	r.Realm = "http://localhost:" + portOf(tl.Addr()) + "/token"
+
+	host, stop, err := newRegistry(dir, &registryOpt{token: &tokenAuthConfig{realm: r.Realm, certFile: certFile}})
+	if err != nil {
+		return nil, nil, err
+	}
+	deferF.append(stop)
+	if r.target, err = url.Parse("http://" + host); err != nil {
+		return nil, nil, err
+	}
+
+	// the registry is behind a proxy so that tokens can be invalidated
+	// before they expire
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, nil, err
+	}
+	srv := &http.Server{Handler: r}
+	go srv.Serve(l)
+	deferF.append(srv.Close)
+	r.Host = "localhost:" + portOf(l.Addr())
+
+	return r, cl, nil
+}
+
+func loadTokenKey(certFile, keyFile string) (*ecdsa.PrivateKey, []byte, error) {
+	dt, err := os.ReadFile(certFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	certBlock, _ := pem.Decode(dt)
+	if certBlock == nil {
+		return nil, nil, errors.Errorf("no certificate found in %s", certFile)
+	}
+	dt, err = os.ReadFile(keyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyBlock, _ := pem.Decode(dt)
+	if keyBlock == nil {
+		return nil, nil, errors.Errorf("no key found in %s", keyFile)
+	}
+	key, err := x509.ParseECPrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "failed to parse %s", keyFile)
+	}
+	return key, certBlock.Bytes, nil
+}
+
+// SetTokenTTL sets the lifetime of the tokens issued from now on. Note that
+// the registry accepts tokens for up to a minute after they expired to allow
+// for clock skew, use ExpireTokens to have them rejected immediately.
+func (r *TokenAuthRegistry) SetTokenTTL(d time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.ttl = d
+}
+
+// ExpireTokens makes the registry reject all tokens issued so far, as if
+// they had expired. Clients receive the same challenge as without a token
+// and need to request a new one.
+func (r *TokenAuthRegistry) ExpireTokens() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, t := range r.issued {
+		r.revoked[t] = struct{}{}
+	}
+	r.issued = nil
+}
+
+// TokenRequests returns the number of tokens issued by the token server.
+func (r *TokenAuthRegistry) TokenRequests() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.requests
+}
+
+// MintToken returns a token granting access for scopes, e.g.
+// "repository:foo/bar:pull,push", that expires after ttl. A negative ttl
+// returns a token that the registry rejects as expired. Minted tokens are
+// not affected by ExpireTokens.
+func (r *TokenAuthRegistry) MintToken(ttl time.Duration, scopes ...string) (string, error) {
+	return r.signToken(ttl, scopes)
+}
+
+type tokenAccess struct {
+	Type    string   `json:"type"`
+	Name    string   `json:"name"`
+	Actions []string `json:"actions"`
+}
+
+func parseTokenScopes(scopes []string) ([]tokenAccess, error) {
+	access := []tokenAccess{}
+	for _, scope := range scopes {
+		for _, s := range strings.Fields(scope) {
+			// repository names don't contain colons but registry:catalog:*
+			// has no name, so only the type and the actions are split off
+			i, j := strings.Index(s, ":"), strings.LastIndex(s, ":")
+			if i < 0 || i == j {
+				return nil, errors.Errorf("invalid scope %q", s)
+			}
+			access = append(access, tokenAccess{
+				Type:    s[:i],
+				Name:    s[i+1 : j],
+				Actions: strings.Split(s[j+1:], ","),
+			})
+		}
+	}
+	return access, nil
+}
+
+func (r *TokenAuthRegistry) signToken(ttl time.Duration, scopes []string) (string, error) {
+	access, err := parseTokenScopes(scopes)
+	if err != nil {
+		return "", err
+	}
+	header, err := json.Marshal(map[string]interface{}{
+		"typ": "JWT",
+		"alg": "ES256",
+		"x5c": []string{base64.StdEncoding.EncodeToString(r.cert)},
+	})
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	claims, err := json.Marshal(map[string]interface{}{
+		"iss":    tokenIssuer,
+		"sub":    r.user,
+		"aud":    tokenService,
+		"exp":    now.Add(ttl).Unix(),
+		"nbf":    now.Add(-time.Minute).Unix(),
+		"iat":    now.Unix(),
+		"jti":    identity.NewID(),
+		"access": access,
+	})
+	if err != nil {
+		return "", err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	h := sha256.Sum256([]byte(payload))
+	sr, ss, err := ecdsa.Sign(rand.Reader, r.key, h[:])
+	if err != nil {
+		return "", err
+	}
+	// JWS uses the fixed size concatenation of R and S
+	sig := make([]byte, 64)
+	sr.FillBytes(sig[:32])
+	ss.FillBytes(sig[32:])
+	return payload + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+func (r *TokenAuthRegistry) serveToken(w http.ResponseWriter, req *http.Request) {
+	var user, pass string
+	var scopes []string
+	switch req.Method {
+	case http.MethodGet:
+		user, pass, _ = req.BasicAuth()
+		scopes = req.URL.Query()["scope"]
+	case http.MethodPost:
+		if err := req.ParseForm(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if gt := req.PostForm.Get("grant_type"); gt != "password" {
+			http.Error(w, "unsupported grant type "+gt, http.StatusBadRequest)
+			return
+		}
+		user, pass = req.PostForm.Get("username"), req.PostForm.Get("password")
+		scopes = req.PostForm["scope"]
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if r.user != "" && (user != r.user || pass != r.pass) {
+		http.Error(w, "invalid credentials", http.StatusUnauthorized)
+		return
+	}
+
+	r.mu.Lock()
+	ttl := r.ttl
+	r.mu.Unlock()
+	token, err := r.signToken(ttl, scopes)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	r.mu.Lock()
+	r.issued = append(r.issued, token)
+	r.requests++
+	r.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"token":        token,
+		"access_token": token,
+		"expires_in":   int(ttl / time.Second),
+		"issued_at":    time.Now().UTC().Format(time.RFC3339),
+	})
+}
+
+func (r *TokenAuthRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer "); token != "" {
+		r.mu.Lock()
+		_, revoked := r.revoked[token]
+		r.mu.Unlock()
+		if revoked {
+			// without the token the registry responds with the challenge
+			// for the requested resource
+			req.Header.Del("Authorization")
+		}
+	}
+	httputil.NewSingleHostReverseProxy(r.target).ServeHTTP(w, req)
+}
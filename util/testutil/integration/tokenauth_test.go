@@ -0,0 +1,173 @@
+package integration
+
+import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newTestTokenAuthRegistry(t *testing.T, backend string) *TokenAuthRegistry {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	require.NoError(t, writeRegistryCert(certFile, keyFile, nil))
+	key, cert, err := loadTokenKey(certFile, keyFile)
+	require.NoError(t, err)
+	target, err := url.Parse(backend)
+	require.NoError(t, err)
+
+	r := &TokenAuthRegistry{
+		user:    "user",
+		pass:    "pass",
+		key:     key,
+		cert:    cert,
+		target:  target,
+		ttl:     defaultTokenTTL,
+		revoked: map[string]struct{}{},
+	}
+	tokenSrv := httptest.NewServer(http.HandlerFunc(r.serveToken))
+	t.Cleanup(tokenSrv.Close)
+	r.Realm = tokenSrv.URL + "/token"
+	srv := httptest.NewServer(r)
+	t.Cleanup(srv.Close)
+	r.Host = srv.Listener.Addr().String()
+	return r
+}
+
+// verifyToken checks the signature of a token with the certificate in its
+// header like the registry does and returns the claims.
+func verifyToken(t *testing.T, token string) map[string]interface{} {
+	parts := strings.Split(token, ".")
+	require.Len(t, parts, 3)
+
+	var header struct {
+		Alg string   `json:"alg"`
+		X5c []string `json:"x5c"`
+	}
+	dt, err := base64.RawURLEncoding.DecodeString(parts[0])
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(dt, &header))
+	require.Equal(t, "ES256", header.Alg)
+	require.Len(t, header.X5c, 1)
+	der, err := base64.StdEncoding.DecodeString(header.X5c[0])
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	require.NoError(t, err)
+	require.Len(t, sig, 64)
+	h := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	pub := cert.PublicKey.(*ecdsa.PublicKey)
+	require.True(t, ecdsa.Verify(pub, h[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])))
+
+	var claims map[string]interface{}
+	dt, err = base64.RawURLEncoding.DecodeString(parts[1])
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(dt, &claims))
+	return claims
+}
+
+func TestTokenAuthRegistry(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") == "" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		io.WriteString(w, "ok")
+	}))
+	defer backend.Close()
+	r := newTestTokenAuthRegistry(t, backend.URL)
+
+	fetch := func(user, pass string) (int, string) {
+		req, err := http.NewRequest(http.MethodGet, r.Realm+"?service="+tokenService+"&scope=repository:foo/bar:pull,push", nil)
+		require.NoError(t, err)
+		req.SetBasicAuth(user, pass)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		var body struct {
+			Token string `json:"token"`
+		}
+		if resp.StatusCode == http.StatusOK {
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+		}
+		return resp.StatusCode, body.Token
+	}
+	get := func(token string) int {
+		req, err := http.NewRequest(http.MethodGet, "http://"+r.Host+"/v2/foo/bar/manifests/latest", nil)
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	code, _ := fetch("user", "wrong")
+	require.Equal(t, http.StatusUnauthorized, code)
+	require.Equal(t, 0, r.TokenRequests())
+
+	code, token := fetch("user", "pass")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, 1, r.TokenRequests())
+	claims := verifyToken(t, token)
+	require.Equal(t, tokenIssuer, claims["iss"])
+	require.Equal(t, tokenService, claims["aud"])
+	require.Equal(t, []interface{}{map[string]interface{}{
+		"type":    "repository",
+		"name":    "foo/bar",
+		"actions": []interface{}{"pull", "push"},
+	}}, claims["access"])
+
+	minted, err := r.MintToken(-2*time.Minute, "repository:foo/bar:pull")
+	require.NoError(t, err)
+	claims = verifyToken(t, minted)
+	require.Less(t, claims["exp"].(float64), float64(time.Now().Add(-time.Minute).Unix()))
+
+	require.Equal(t, http.StatusOK, get(token))
+	r.ExpireTokens()
+	require.Equal(t, http.StatusUnauthorized, get(token))
+	require.Equal(t, http.StatusOK, get(minted), "minted tokens are checked by the registry only")
+
+	_, token = fetch("user", "pass")
+	require.Equal(t, http.StatusOK, get(token))
+	require.Equal(t, 2, r.TokenRequests())
+}
+
+func TestTokenAuthRegistryOAuth(t *testing.T) {
+	r := newTestTokenAuthRegistry(t, "http://127.0.0.1:0")
+
+	post := func(form url.Values) int {
+		resp, err := http.PostForm(r.Realm, form)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	form := url.Values{
+		"grant_type": {"password"},
+		"username":   {"user"},
+		"password":   {"pass"},
+		"service":    {tokenService},
+		"scope":      {"repository:foo:pull repository:bar:pull"},
+	}
+	require.Equal(t, http.StatusOK, post(form))
+	form.Set("grant_type", "refresh_token")
+	require.Equal(t, http.StatusBadRequest, post(form))
+	form.Set("grant_type", "password")
+	form.Set("scope", "invalid")
+	require.Equal(t, http.StatusBadRequest, post(form))
+	require.Equal(t, 1, r.TokenRequests())
+}
@@ -0,0 +1,78 @@
+package integration
+
+import (
+	"context"
+	"net"
+	"sync"
+
+	collectortrace "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracev1 "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/grpc"
+)
+
+// WithTraceCollector returns a SandboxOpt that starts an OTLP receiver for
+// the sandbox and configures the daemon to export its traces to it. The
+// received spans are returned by Sandbox.Traces.
+func WithTraceCollector() SandboxOpt {
+	return traceCollectorOpt{}
+}
+
+type traceCollectorOpt struct{}
+
+func (traceCollectorOpt) UpdateBackendConfig(cfg *BackendConfig) {
+	cfg.traceCollector = true
+}
+
+// traceCollector is an in-process OTLP gRPC receiver that keeps all spans
+// in memory.
+type traceCollector struct {
+	collectortrace.UnimplementedTraceServiceServer
+
+	addr  string
+	mu    sync.Mutex
+	spans []*tracev1.Span
+}
+
+func newTraceCollector() (*traceCollector, func() error, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, nil, err
+	}
+	c := &traceCollector{addr: l.Addr().String()}
+	srv := grpc.NewServer()
+	collectortrace.RegisterTraceServiceServer(srv, c)
+	go srv.Serve(l)
+	return c, func() error {
+		srv.Stop()
+		return nil
+	}, nil
+}
+
+// env returns the environment that points the OTLP exporter of the daemon
+// at the collector. The batch delay is lowered so that spans show up while
+// the test is still running.
+func (c *traceCollector) env() []string {
+	return []string{
+		"OTEL_EXPORTER_OTLP_TRACES_ENDPOINT=http://" + c.addr,
+		"OTEL_EXPORTER_OTLP_TRACES_PROTOCOL=grpc",
+		"OTEL_EXPORTER_OTLP_TRACES_INSECURE=true",
+		"OTEL_BSP_SCHEDULE_DELAY=100",
+	}
+}
+
+func (c *traceCollector) Export(ctx context.Context, req *collectortrace.ExportTraceServiceRequest) (*collectortrace.ExportTraceServiceResponse, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, rs := range req.ResourceSpans {
+		for _, ils := range rs.InstrumentationLibrarySpans {
+			c.spans = append(c.spans, ils.Spans...)
+		}
+	}
+	return &collectortrace.ExportTraceServiceResponse{}, nil
+}
+
+func (c *traceCollector) Spans() []*tracev1.Span {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]*tracev1.Span(nil), c.spans...)
+}
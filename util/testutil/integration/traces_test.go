@@ -0,0 +1,34 @@
+package integration
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+func TestTraceCollector(t *testing.T) {
+	c, closer, err := newTraceCollector()
+	require.NoError(t, err)
+	defer closer()
+
+	for _, env := range c.env() {
+		kv := strings.SplitN(env, "=", 2)
+		t.Setenv(kv[0], kv[1])
+	}
+
+	ctx := context.TODO()
+	exp, err := otlptracegrpc.New(ctx)
+	require.NoError(t, err)
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exp))
+	_, span := tp.Tracer("test").Start(ctx, "test-span")
+	span.End()
+	require.NoError(t, tp.Shutdown(ctx))
+
+	spans := c.Spans()
+	require.Len(t, spans, 1)
+	require.Equal(t, "test-span", spans[0].Name)
+}
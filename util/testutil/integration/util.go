@@ -3,6 +3,7 @@ package integration
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"net"
@@ -10,6 +11,7 @@ import (
 	"os/exec"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"testing"
 	"time"
@@ -21,22 +23,52 @@ import (
 )
 
 func startCmd(cmd *exec.Cmd, logs map[string]*bytes.Buffer) (func() error, error) {
+	return startCmdWithOpts(cmd, logs, stopOpts{})
+}
+
+// errUncleanShutdown is returned when stopping a process started with
+// stopOpts.checkExit fails to exit cleanly.
+var errUncleanShutdown = errors.New("unclean shutdown")
+
+type stopOpts struct {
+	timeout   time.Duration // time to wait after SIGTERM, defaults to 20s
+	force     bool          // send SIGKILL right away
+	checkExit bool          // fail if the process doesn't exit with 0 after SIGTERM
+}
+
+func teeWriter(w io.Writer, extra io.Writer) io.Writer {
+	if extra == nil {
+		return w
+	}
+	return io.MultiWriter(w, extra)
+}
+
+func startCmdWithOpts(cmd *exec.Cmd, logs map[string]*bytes.Buffer, opts stopOpts) (func() error, error) {
+	if opts.timeout == 0 {
+		opts.timeout = 20 * time.Second
+	}
 	if logs != nil {
+		// writers set by the caller, e.g. by streamLogs, receive a copy
+		logsMu.Lock()
 		b := new(bytes.Buffer)
 		logs["stdout: "+cmd.Path] = b
-		cmd.Stdout = &lockingWriter{Writer: b}
+		cmd.Stdout = teeWriter(&lockingWriter{mu: &logsMu, Writer: b}, cmd.Stdout)
 		b = new(bytes.Buffer)
 		logs["stderr: "+cmd.Path] = b
-		cmd.Stderr = &lockingWriter{Writer: b}
+		cmd.Stderr = teeWriter(&lockingWriter{mu: &logsMu, Writer: b}, cmd.Stderr)
+		logsMu.Unlock()
 	}
 
 	fmt.Fprintf(cmd.Stderr, "> startCmd %v %+v\n", time.Now(), cmd.Args)
 
+	markSpawned(cmd)
 	if err := cmd.Start(); err != nil {
 		return nil, err
 	}
+	recordSpawned(cmd.Process.Pid)
 	eg, ctx := errgroup.WithContext(context.TODO())
 
+	var killed int32
 	stopped := make(chan struct{})
 	stop := make(chan struct{})
 	eg.Go(func() error {
@@ -45,6 +77,14 @@ func startCmd(cmd *exec.Cmd, logs map[string]*bytes.Buffer) (func() error, error
 		close(stopped)
 		select {
 		case <-stop:
+			if opts.checkExit && !opts.force {
+				if atomic.LoadInt32(&killed) == 1 {
+					return errors.Wrapf(errUncleanShutdown, "%s did not exit within %v after SIGTERM", cmd.Path, opts.timeout)
+				}
+				if st.ExitCode() != 0 {
+					return errors.Wrapf(errUncleanShutdown, "%s exited with code %d", cmd.Path, st.ExitCode())
+				}
+			}
 			return nil
 		default:
 			return err
@@ -56,12 +96,18 @@ func startCmd(cmd *exec.Cmd, logs map[string]*bytes.Buffer) (func() error, error
 		case <-ctx.Done():
 		case <-stopped:
 		case <-stop:
+			if opts.force {
+				fmt.Fprintf(cmd.Stderr, "> sending sigkill %v\n", time.Now())
+				cmd.Process.Kill()
+				return nil
+			}
 			fmt.Fprintf(cmd.Stderr, "> sending sigterm %v\n", time.Now())
 			cmd.Process.Signal(syscall.SIGTERM)
 			go func() {
 				select {
 				case <-stopped:
-				case <-time.After(20 * time.Second):
+				case <-time.After(opts.timeout):
+					atomic.StoreInt32(&killed, 1)
 					cmd.Process.Kill()
 				}
 			}()
@@ -98,46 +144,101 @@ func waitUnix(address string, d time.Duration) error {
 	return nil
 }
 
+// multiCloser collects closers that are run in reverse order by the function
+// returned by F. It is safe for concurrent use, the signal handler may run F
+// while the sandbox is still being started and appending to it. Each closer
+// is run at most once.
 type multiCloser struct {
+	mu  sync.Mutex
 	fns []func() error
 }
 
 func (mc *multiCloser) F() func() error {
 	return func() error {
+		mc.mu.Lock()
+		fns := mc.fns
+		mc.fns = nil
+		mc.mu.Unlock()
+
 		var err error
-		for i := range mc.fns {
-			if err1 := mc.fns[len(mc.fns)-1-i](); err == nil {
+		for i := range fns {
+			if err1 := fns[len(fns)-1-i](); err == nil {
 				err = err1
 			}
 		}
-		mc.fns = nil
 		return err
 	}
 }
 
 func (mc *multiCloser) append(f func() error) {
+	mc.mu.Lock()
 	mc.fns = append(mc.fns, f)
+	mc.mu.Unlock()
 }
 
 var ErrRequirements = errors.Errorf("missing requirements")
 
+// ErrTransient matches errors that are likely to go away if the sandbox is
+// created again, such as a port taken by another process between picking
+// and binding it. Run retries creating the sandbox instead of skipping the
+// test.
+var ErrTransient = errors.Errorf("transient error")
+
+type transientError struct {
+	error
+}
+
+func (e transientError) Is(target error) bool {
+	return target == ErrTransient
+}
+
+func (e transientError) Unwrap() error {
+	return e.error
+}
+
+// classifyStartError marks err as transient if the logs show that the
+// process failed because an address was already in use.
+func classifyStartError(err error, logs map[string]*bytes.Buffer) error {
+	if err != nil && strings.Contains(formatLogs(logs), "address already in use") {
+		return transientError{err}
+	}
+	return err
+}
+
 func lookupBinary(name string) error {
 	_, err := exec.LookPath(name)
 	if err != nil {
-		return errors.Wrapf(ErrRequirements, "failed to lookup %s binary", name)
+		return RequirementErrorf(SkipMissingBinary, "failed to lookup %s binary", name)
 	}
 	return nil
 }
 
 func requireRoot() error {
 	if os.Getuid() != 0 {
-		return errors.Wrap(ErrRequirements, "requires root")
+		return RequirementErrorf(SkipUnsupportedPlatform, "requires root")
 	}
 	return nil
 }
 
+// logsMu guards the maps of captured logs, which gain entries while a
+// sandbox runs, e.g. when its daemon is restarted, and the buffers in them.
+var logsMu sync.Mutex
+
+// copyLogs returns the contents of the buffers in logs.
+func copyLogs(logs map[string]*bytes.Buffer) map[string][]byte {
+	logsMu.Lock()
+	defer logsMu.Unlock()
+	m := make(map[string][]byte, len(logs))
+	for name, b := range logs {
+		if b != nil {
+			m[name] = append([]byte(nil), b.Bytes()...)
+		}
+	}
+	return m
+}
+
 type lockingWriter struct {
-	mu sync.Mutex
+	mu *sync.Mutex
 	io.Writer
 }
 
@@ -167,3 +268,19 @@ func Tmpdir(t *testing.T, appliers ...fstest.Applier) (string, error) {
 	}
 	return tmpdir, nil
 }
+
+// RunJSON runs buildctl with args in the sandbox and decodes its stdout as
+// JSON into v. On failure the returned error includes stderr.
+func RunJSON(sb Sandbox, v interface{}, args ...string) error {
+	stdout, stderr, code, err := sb.Exec(args...)
+	if err != nil {
+		return err
+	}
+	if code != 0 {
+		return errors.Errorf("buildctl %v exited with code %d: %s", args, code, stderr)
+	}
+	if err := json.Unmarshal(stdout, v); err != nil {
+		return errors.Wrapf(err, "failed to decode output of buildctl %v: %s%s", args, stdout, stderr)
+	}
+	return nil
+}
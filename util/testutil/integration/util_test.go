@@ -0,0 +1,21 @@
+package integration
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClassifyStartError(t *testing.T) {
+	logs := map[string]*bytes.Buffer{"buildkitd": bytes.NewBufferString("listen tcp 127.0.0.1:1234: bind: address already in use\n")}
+	err := classifyStartError(errors.New("failed dialing"), logs)
+	require.True(t, errors.Is(err, ErrTransient))
+	require.False(t, errors.Is(err, ErrRequirements))
+	require.Equal(t, "failed dialing", err.Error())
+
+	logs = map[string]*bytes.Buffer{"buildkitd": bytes.NewBufferString("permission denied\n")}
+	require.False(t, errors.Is(classifyStartError(errors.New("failed dialing"), logs), ErrTransient))
+	require.NoError(t, classifyStartError(nil, logs))
+}
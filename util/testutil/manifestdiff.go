@@ -0,0 +1,152 @@
+package testutil
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/platforms"
+	"github.com/moby/buildkit/util/contentutil"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// DescriptorField is a field of a descriptor that differs between two
+// manifests.
+type DescriptorField string
+
+const (
+	FieldDigest    DescriptorField = "digest"
+	FieldSize      DescriptorField = "size"
+	FieldMediaType DescriptorField = "mediaType"
+	// FieldMissing is reported for layers that only exist in one of the
+	// manifests.
+	FieldMissing DescriptorField = "missing"
+)
+
+// DescriptorDiff describes how the descriptors of the config or of a layer
+// differ.
+type DescriptorDiff struct {
+	// Index is the position of the layer in the manifest, or -1 for the
+	// config.
+	Index  int
+	Fields []DescriptorField
+	// A and B are the descriptors of the first and second manifest. A
+	// missing layer has an empty descriptor.
+	A, B ocispecs.Descriptor
+}
+
+func (d DescriptorDiff) String() string {
+	name := "config"
+	if d.Index >= 0 {
+		name = fmt.Sprintf("layer %d", d.Index)
+	}
+	var parts []string
+	for _, f := range d.Fields {
+		switch f {
+		case FieldDigest:
+			parts = append(parts, fmt.Sprintf("digest %s != %s", d.A.Digest, d.B.Digest))
+		case FieldSize:
+			parts = append(parts, fmt.Sprintf("size %d != %d", d.A.Size, d.B.Size))
+		case FieldMediaType:
+			parts = append(parts, fmt.Sprintf("mediaType %s != %s", d.A.MediaType, d.B.MediaType))
+		case FieldMissing:
+			parts = append(parts, "missing")
+		}
+	}
+	return name + ": " + strings.Join(parts, ", ")
+}
+
+// ManifestDiff is the difference between the configs and layers of two
+// image manifests.
+type ManifestDiff struct {
+	Config *DescriptorDiff
+	Layers []DescriptorDiff
+}
+
+// Empty reports whether the manifests have the same config and layers.
+func (d *ManifestDiff) Empty() bool {
+	return d.Config == nil && len(d.Layers) == 0
+}
+
+func (d *ManifestDiff) String() string {
+	if d.Empty() {
+		return "no differences"
+	}
+	var lines []string
+	if d.Config != nil {
+		lines = append(lines, d.Config.String())
+	}
+	for _, l := range d.Layers {
+		lines = append(lines, l.String())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// DiffManifests compares the images host/refA and host/refB. Indexes are
+// resolved to the manifest for the default platform.
+func DiffManifests(host, refA, refB string) (*ManifestDiff, error) {
+	ctx := context.TODO()
+	descA, providerA, err := contentutil.ProviderFromRef(host + "/" + refA)
+	if err != nil {
+		return nil, err
+	}
+	descB, providerB, err := contentutil.ProviderFromRef(host + "/" + refB)
+	if err != nil {
+		return nil, err
+	}
+	return diffManifests(ctx, providerA, descA, providerB, descB)
+}
+
+func diffManifests(ctx context.Context, pa content.Provider, a ocispecs.Descriptor, pb content.Provider, b ocispecs.Descriptor) (*ManifestDiff, error) {
+	ma, err := images.Manifest(ctx, pa, a, platforms.Default())
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read manifest %s", a.Digest)
+	}
+	mb, err := images.Manifest(ctx, pb, b, platforms.Default())
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read manifest %s", b.Digest)
+	}
+
+	diff := &ManifestDiff{}
+	if d := diffDescriptor(-1, ma.Config, mb.Config); d != nil {
+		diff.Config = d
+	}
+	n := len(ma.Layers)
+	if len(mb.Layers) > n {
+		n = len(mb.Layers)
+	}
+	for i := 0; i < n; i++ {
+		if i >= len(ma.Layers) {
+			diff.Layers = append(diff.Layers, DescriptorDiff{Index: i, Fields: []DescriptorField{FieldMissing}, B: mb.Layers[i]})
+			continue
+		}
+		if i >= len(mb.Layers) {
+			diff.Layers = append(diff.Layers, DescriptorDiff{Index: i, Fields: []DescriptorField{FieldMissing}, A: ma.Layers[i]})
+			continue
+		}
+		if d := diffDescriptor(i, ma.Layers[i], mb.Layers[i]); d != nil {
+			diff.Layers = append(diff.Layers, *d)
+		}
+	}
+	return diff, nil
+}
+
+func diffDescriptor(index int, a, b ocispecs.Descriptor) *DescriptorDiff {
+	var fields []DescriptorField
+	if a.Digest != b.Digest {
+		fields = append(fields, FieldDigest)
+	}
+	if a.Size != b.Size {
+		fields = append(fields, FieldSize)
+	}
+	if a.MediaType != b.MediaType {
+		fields = append(fields, FieldMediaType)
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+	return &DescriptorDiff{Index: index, Fields: fields, A: a, B: b}
+}
@@ -0,0 +1,61 @@
+package testutil
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"runtime"
+	"testing"
+
+	"github.com/containerd/containerd/content"
+	"github.com/moby/buildkit/util/contentutil"
+	digest "github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiffManifests(t *testing.T) {
+	ctx := context.TODO()
+	buf := contentutil.NewBuffer()
+
+	write := func(mediaType string, dt []byte) ocispecs.Descriptor {
+		desc := ocispecs.Descriptor{MediaType: mediaType, Digest: digest.FromBytes(dt), Size: int64(len(dt))}
+		require.NoError(t, content.WriteBlob(ctx, buf, desc.Digest.String(), bytes.NewReader(dt), desc))
+		return desc
+	}
+	manifest := func(config string, layers ...ocispecs.Descriptor) ocispecs.Descriptor {
+		dt, err := json.Marshal(ocispecs.Image{OS: runtime.GOOS, Architecture: runtime.GOARCH, Author: config})
+		require.NoError(t, err)
+		dt, err = json.Marshal(ocispecs.Manifest{
+			Versioned: specs.Versioned{SchemaVersion: 2},
+			MediaType: ocispecs.MediaTypeImageManifest,
+			Config:    write(ocispecs.MediaTypeImageConfig, dt),
+			Layers:    layers,
+		})
+		require.NoError(t, err)
+		return write(ocispecs.MediaTypeImageManifest, dt)
+	}
+
+	l1 := write(ocispecs.MediaTypeImageLayer, []byte("layer1"))
+	l2 := write(ocispecs.MediaTypeImageLayer, []byte("layer2"))
+	l2gz := write(ocispecs.MediaTypeImageLayerGzip, []byte("layer2"))
+	l3 := write(ocispecs.MediaTypeImageLayer, []byte("layer03"))
+
+	diff, err := diffManifests(ctx, buf, manifest("a", l1, l2), buf, manifest("a", l1, l2))
+	require.NoError(t, err)
+	require.True(t, diff.Empty(), diff.String())
+
+	diff, err = diffManifests(ctx, buf, manifest("a", l1, l2), buf, manifest("b", l1, l2gz, l3))
+	require.NoError(t, err)
+	require.False(t, diff.Empty())
+	require.NotNil(t, diff.Config)
+	require.Equal(t, -1, diff.Config.Index)
+	require.Equal(t, []DescriptorField{FieldDigest}, diff.Config.Fields)
+	require.Len(t, diff.Layers, 2)
+	require.Equal(t, 1, diff.Layers[0].Index)
+	require.Equal(t, []DescriptorField{FieldMediaType}, diff.Layers[0].Fields)
+	require.Equal(t, 2, diff.Layers[1].Index)
+	require.Equal(t, []DescriptorField{FieldMissing}, diff.Layers[1].Fields)
+	require.Equal(t, l3, diff.Layers[1].B)
+}